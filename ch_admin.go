@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//go:embed ui/play.html
+var playHTML []byte
+
+//go:embed ui/dashboard.html
+var dashboardHTML []byte
+
+// readyTimeout 就绪检查查询的超时时间
+const readyTimeout = 3 * time.Second
+
+// registerAdminHandlers 健康检查和管理页面，负载均衡和探针访问时没有认证信息，不做认证。
+// play 和 dashboard 只返回静态页面，页面里的查询仍然经过 / 的认证。/metrics 和探针一样由 prometheus 直接抓取
+func (c *ChServer) registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/ping", c.Ping)
+	mux.HandleFunc("/replicas_status", c.ReplicasStatus)
+	mux.HandleFunc("/ready", c.Ready)
+	mux.HandleFunc("/play", servePage(playHTML))
+	mux.HandleFunc("/dashboard", servePage(dashboardHTML))
+	if c.metrics != nil {
+		mux.Handle("/metrics", c.metrics.Handler())
+	}
+}
+
+// Ping 和 clickhouse 一样返回 Ok.，只说明进程存活
+func (c *ChServer) Ping(wr http.ResponseWriter, r *http.Request) {
+	wr.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	_, _ = fmt.Fprint(wr, "Ok.\n")
+}
+
+// ReplicasStatus 单机没有副本，总是返回 Ok.
+func (c *ChServer) ReplicasStatus(wr http.ResponseWriter, r *http.Request) {
+	wr.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	_, _ = fmt.Fprint(wr, "Ok.\n")
+}
+
+// Ready 执行一条简单查询，数据库不可用时返回 503
+func (c *ChServer) Ready(wr http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	wr.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	var one int
+	if err := c.conn.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		wr.WriteHeader(503)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s\n", err)
+		return
+	}
+	_, _ = fmt.Fprint(wr, "Ok.\n")
+}
+
+func servePage(page []byte) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		wr.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		_, _ = wr.Write(page)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestAdminHandlers(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	c := &ChServer{conn: db, pgServer: &PgServer{enableAuth: true}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", c.ServeHTTP)
+	c.registerAdminHandlers(mux)
+
+	for _, path := range []string{"/ping", "/replicas_status", "/ready"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != 200 || rec.Body.String() != "Ok.\n" {
+			t.Errorf("%s: unexpected response %d %q", path, rec.Code, rec.Body.String())
+		}
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/play", nil))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "text/html; charset=UTF-8" {
+		t.Errorf("/play: unexpected response %d", rec.Code)
+	}
+	// 查询仍然需要认证
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?query=SELECT+1", nil))
+	if rec.Code != 401 {
+		t.Errorf("expected query without credentials to be rejected, got %d", rec.Code)
+	}
+
+	_ = db.Close()
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != 503 {
+		t.Errorf("expected /ready to fail on a closed database, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/ipc"
+)
+
+// positionWriter arrow 的 FileWriter 只用 Seek(0, io.SeekCurrent) 获取当前位置，http 响应不能 seek，这里只记录写入的字节数
+type positionWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (p *positionWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.pos += int64(n)
+	return n, err
+}
+
+func (p *positionWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return 0, errors.New("seek is not supported")
+	}
+	return p.pos, nil
+}
+
+type arrowRecordWriter interface {
+	Write(rec arrow.Record) error
+	Close() error
+}
+
+type ArrowFormatWriter struct {
+	writer arrowRecordWriter
+}
+
+func (a *ArrowFormatWriter) WriteBlock(rec arrow.Record) error {
+	return a.writer.Write(rec)
+}
+
+func (a *ArrowFormatWriter) Close() error {
+	return a.writer.Close()
+}
+
+func newArrowFormatWriter(schema *arrow.Schema, writer io.Writer) (ClickhouseBlockWriter, error) {
+	w, err := ipc.NewFileWriter(&positionWriter{w: writer}, ipc.WithSchema(schema))
+	if err != nil {
+		return nil, err
+	}
+	return &ArrowFormatWriter{writer: w}, nil
+}
+
+func newArrowStreamFormatWriter(schema *arrow.Schema, writer io.Writer) (ClickhouseBlockWriter, error) {
+	return &ArrowFormatWriter{writer: ipc.NewWriter(writer, ipc.WithSchema(schema))}, nil
+}
+
+// arrowFileRecordReader 把 ipc.FileReader 适配为按顺序读取的 array.RecordReader
+type arrowFileRecordReader struct {
+	refs   atomic.Int64
+	reader *ipc.FileReader
+	rec    arrow.Record
+	next   int
+	err    error
+}
+
+func newArrowFileRecordReader(reader *ipc.FileReader) *arrowFileRecordReader {
+	a := &arrowFileRecordReader{reader: reader}
+	a.refs.Add(1)
+	return a
+}
+
+func (a *arrowFileRecordReader) Retain() {
+	a.refs.Add(1)
+}
+
+func (a *arrowFileRecordReader) Release() {
+	if a.refs.Add(-1) == 0 {
+		if a.rec != nil {
+			a.rec.Release()
+			a.rec = nil
+		}
+		_ = a.reader.Close()
+	}
+}
+
+func (a *arrowFileRecordReader) Schema() *arrow.Schema {
+	return a.reader.Schema()
+}
+
+func (a *arrowFileRecordReader) Next() bool {
+	if a.rec != nil {
+		a.rec.Release()
+		a.rec = nil
+	}
+	if a.err != nil || a.next >= a.reader.NumRecords() {
+		return false
+	}
+	a.rec, a.err = a.reader.RecordAt(a.next)
+	a.next++
+	return a.err == nil
+}
+
+func (a *arrowFileRecordReader) Record() arrow.Record {
+	return a.rec
+}
+
+func (a *arrowFileRecordReader) Err() error {
+	return a.err
+}
+
+// ArrowFormatReader 不逐行返回给 appender，由 Insert 通过 duckdb 的 arrow scan 整体写入
+type ArrowFormatReader struct {
+	columns     []string
+	columnTypes []string
+	reader      array.RecordReader
+	closer      io.Closer
+}
+
+func newArrowFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	// Arrow 文件格式的 footer 在末尾，需要先落盘才能随机读取
+	f, err := os.CreateTemp("", "duckserver-*.arrow")
+	if err != nil {
+		return nil, err
+	}
+	closer := &tempFileCloser{f}
+	if _, err = io.Copy(f, reader); err != nil {
+		_ = closer.Close()
+		return nil, err
+	}
+	fr, err := ipc.NewFileReader(f)
+	if err != nil {
+		_ = closer.Close()
+		return nil, err
+	}
+	return &ArrowFormatReader{
+		columns:     columnNames,
+		columnTypes: columnTypes,
+		reader:      newArrowFileRecordReader(fr),
+		closer:      closer,
+	}, nil
+}
+
+func newArrowStreamFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	r, err := ipc.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ArrowFormatReader{
+		columns:     columnNames,
+		columnTypes: columnTypes,
+		reader:      r,
+	}, nil
+}
+
+func (a *ArrowFormatReader) Read(values []driver.Value) error {
+	return errors.New("arrow input must be inserted by ArrowFormatReader.Insert")
+}
+
+// Insert 把输入注册为视图，按列名转换为表的类型后写入 schema.table，返回写入的行数。
+// 输入中的列必须在 columns 中，没有的列使用表的默认值
+func (a *ArrowFormatReader) Insert(ctx context.Context, conn driver.Conn, schema, table string) (int64, error) {
+	fields := a.reader.Schema().Fields()
+	if len(fields) == 0 {
+		return 0, errors.New("arrow input has no columns")
+	}
+	columns := make([]string, len(fields))
+	selects := make([]string, len(fields))
+	for i, f := range fields {
+		idx := slices.Index(a.columns, f.Name)
+		if idx < 0 {
+			return 0, fmt.Errorf("column %s not found in table", f.Name)
+		}
+		columns[i] = quoteIdentifier(f.Name)
+		selects[i] = fmt.Sprintf("CAST(%s AS %s)", columns[i], a.columnTypes[idx])
+	}
+	view := fmt.Sprintf("duckserver_arrow_%d", stageTableSeq.Add(1))
+	release, err := registerArrowView(conn, a.reader, view)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	execer := conn.(driver.ExecerContext)
+	defer execer.ExecContext(context.Background(), "DROP VIEW IF EXISTS "+quoteIdentifier(view), nil)
+	target := quoteIdentifier(table)
+	if schema != "" {
+		target = quoteIdentifier(schema) + "." + target
+	}
+	result, err := execer.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s",
+		target, strings.Join(columns, ", "), strings.Join(selects, ", "), quoteIdentifier(view)), nil)
+	if err != nil {
+		return 0, fmt.Errorf("inserting values: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (a *ArrowFormatReader) Close() error {
+	a.reader.Release()
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+type tempFileCloser struct {
+	f *os.File
+}
+
+func (t *tempFileCloser) Close() error {
+	removeTempFile(t.f)
+	return nil
+}
+
+func removeTempFile(f *os.File) {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
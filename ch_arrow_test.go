@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestArrowFormatInsert(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	execer := conn.(driver.ExecerContext)
+	if _, err = execer.ExecContext(context.Background(), `CREATE TABLE "order" (id BIGINT, "select" VARCHAR, tags VARCHAR[], d INTEGER DEFAULT 7)`, nil); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := duckdb.NewArrowFromConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columnNames, columnTypes := []string{"id", "select", "tags", "d"}, []string{"BIGINT", "VARCHAR", "VARCHAR[]", "INTEGER"}
+	for format, factory := range map[string]ClickhouseBlockWriterFactory{"Arrow": newArrowFormatWriter, "ArrowStream": newArrowStreamFormatWriter} {
+		// 输入的 id 为 INTEGER，写入时转换为表的类型，没有的列 d 使用默认值
+		reader, err := ar.QueryContext(context.Background(), `SELECT i::INTEGER AS id, 'v' || i AS "select", ['a', NULL] AS tags FROM range(3000) t(i)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w, err := factory(reader.Schema(), &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for reader.Next() {
+			if err = w.WriteBlock(reader.Record()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reader.Release()
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := GetClickhouseInputFormat(format)(columnNames, columnTypes, &buf, defaultFormatSettings())
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := r.(*ArrowFormatReader).Insert(context.Background(), conn, "", "order")
+		_ = r.Close()
+		if err != nil || n != 3000 {
+			t.Fatalf("%s: inserted %d rows: %v", format, n, err)
+		}
+		if fr, ok := r.(*ArrowFormatReader).reader.(*arrowFileRecordReader); ok && fr.refs.Load() != 0 {
+			t.Errorf("expected the arrow file reader to be released, got %d references", fr.refs.Load())
+		}
+	}
+
+	rows, err := conn.(driver.QueryerContext).QueryContext(context.Background(),
+		`SELECT count(*), max(id), max("select"), any_value(tags)::VARCHAR, min(d),
+		(SELECT count(*) FROM duckdb_views() WHERE view_name LIKE 'duckserver_arrow_%') FROM "order"`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 6)
+	if err = rows.Next(values); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []driver.Value{int64(6000), int64(2999), "v999", "[a, NULL]", int32(7), int64(0)}) {
+		t.Errorf("unexpected result %v", values)
+	}
+
+	r, err := newArrowStreamFormatReader([]string{"id"}, []string{"BIGINT"}, bytes.NewReader(nil), defaultFormatSettings())
+	if err == nil {
+		_ = r.Close()
+		t.Error("expected error for empty input")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// chExternalTable clickhouse 的外部数据：multipart 中的文件作为临时表，只在本次查询中可见
+type chExternalTable struct {
+	name        string
+	columnNames []string
+	columnTypes []string
+	format      string
+	file        *os.File
+}
+
+var externalTableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseExternalTables 读取 multipart/form-data 请求，文件按 <name>_structure 或 <name>_types 和 <name>_format 描述，
+// 先落盘，拿到连接后再导入。同时返回表单中的 query 字段
+func parseExternalTables(r *http.Request) ([]*chExternalTable, string, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	values := r.URL.Query()
+	var tables []*chExternalTable
+	var query string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeExternalTables(tables)
+			return nil, "", err
+		}
+		if part.FileName() == "" {
+			if part.FormName() == "query" {
+				d, err := io.ReadAll(part)
+				if err != nil {
+					closeExternalTables(tables)
+					return nil, "", err
+				}
+				query = string(d)
+			}
+			continue
+		}
+		t, err := newExternalTable(part.FormName(), values)
+		if err == nil {
+			t.file, err = os.CreateTemp("", "duckserver-external-*")
+		}
+		if err == nil {
+			tables = append(tables, t)
+			_, err = io.Copy(t.file, part)
+		}
+		if err == nil {
+			_, err = t.file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			closeExternalTables(tables)
+			return nil, "", err
+		}
+	}
+	return tables, query, nil
+}
+
+// ExternalQuery 带外部数据的查询，外部表在查询结束后删除
+func (c *ChServer) ExternalQuery(r *http.Request, settings *QuerySettings, wr http.ResponseWriter) {
+	tables, formQuery, err := parseExternalTables(r)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Error reading external data: %s", err)
+		return
+	}
+	defer closeExternalTables(tables)
+	settings.External = tables
+	query := r.URL.Query().Get("query")
+	if formQuery != "" {
+		query += " " + formQuery
+	}
+	c.RunQuery(r.Context(), query, settings, wr)
+}
+
+func newExternalTable(name string, values url.Values) (*chExternalTable, error) {
+	if !externalTableNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid external table name %q", name)
+	}
+	t := &chExternalTable{name: name, format: values.Get(name + "_format")}
+	if t.format == "" {
+		t.format = "TabSeparated"
+	}
+	if GetClickhouseInputFormat(t.format) == nil {
+		return nil, fmt.Errorf("unknown format %s for external table %s", t.format, name)
+	}
+	var columns []string
+	if structure := values.Get(name + "_structure"); structure != "" {
+		columns = splitTypeArgs(structure)
+	} else if types := values.Get(name + "_types"); types != "" {
+		for i, typ := range splitTypeArgs(types) {
+			columns = append(columns, fmt.Sprintf("_%d %s", i+1, typ))
+		}
+	} else {
+		return nil, fmt.Errorf("neither %s_structure nor %s_types is set", name, name)
+	}
+	for _, column := range columns {
+		idx := strings.IndexAny(column, " \t")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid structure of external table %s: %q", name, column)
+		}
+		t.columnNames = append(t.columnNames, strings.Trim(column[:idx], "`\""))
+		typ, _, err := duckTypeFromClickhouse(strings.TrimSpace(column[idx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("external table %s: %w", name, err)
+		}
+		t.columnTypes = append(t.columnTypes, typ.String())
+	}
+	return t, nil
+}
+
+// load 在查询使用的连接上创建临时表并导入文件
+func (t *chExternalTable) load(q *chQuery) error {
+	columnDefs := make([]string, len(t.columnNames))
+	for i, name := range t.columnNames {
+		columnDefs[i] = `"` + strings.ReplaceAll(name, `"`, `""`) + `" ` + t.columnTypes[i]
+	}
+	_, err := q.conn.ExecContext(q.ctx, fmt.Sprintf(`CREATE TEMP TABLE "%s" (%s)`, t.name, strings.Join(columnDefs, ", ")))
+	if err != nil {
+		return fmt.Errorf("creating external table %s: %w", t.name, err)
+	}
+	q.external = append(q.external, t)
+	// multiquery 时每条语句都会重新导入
+	if _, err = t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader, err := GetClickhouseInputFormat(t.format)(t.columnNames, t.columnTypes, t.file, q.settings.Format)
+	if err != nil {
+		return fmt.Errorf("external table %s: %w", t.name, err)
+	}
+	defer reader.Close()
+	err = q.conn.Raw(func(driverConn any) error {
+		if arrowReader, ok := reader.(*ArrowFormatReader); ok {
+			_, err := arrowReader.Insert(q.ctx, driverConn.(driver.Conn), "", t.name)
+			return err
+		}
+		return appendRows(q.ctx, driverConn.(driver.Conn), "", t.name, t.columnNames, t.columnTypes, false, reader)
+	})
+	if err != nil {
+		return fmt.Errorf("external table %s: %w", t.name, err)
+	}
+	return nil
+}
+
+func (t *chExternalTable) drop(q *chQuery) {
+	_, _ = q.conn.ExecContext(context.Background(), fmt.Sprintf(`DROP TABLE IF EXISTS temp."%s"`, t.name))
+}
+
+func closeExternalTables(tables []*chExternalTable) {
+	for _, t := range tables {
+		if t.file != nil {
+			removeTempFile(t.file)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNewExternalTable(t *testing.T) {
+	values := url.Values{
+		"ids_structure": {"id UInt32, `name` Nullable(String), tags Array(String)"},
+		"kv_types":      {"String,Decimal(10, 2)"},
+		"kv_format":     {"CSV"},
+	}
+	table, err := newExternalTable("ids", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.format != "TabSeparated" || !reflect.DeepEqual(table.columnNames, []string{"id", "name", "tags"}) ||
+		!reflect.DeepEqual(table.columnTypes, []string{"UINTEGER", "VARCHAR", "VARCHAR[]"}) {
+		t.Errorf("unexpected table %+v", table)
+	}
+	table, err = newExternalTable("kv", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.format != "CSV" || !reflect.DeepEqual(table.columnNames, []string{"_1", "_2"}) ||
+		!reflect.DeepEqual(table.columnTypes, []string{"VARCHAR", "DECIMAL(10,2)"}) {
+		t.Errorf("unexpected table %+v", table)
+	}
+	if _, err = newExternalTable("missing", values); err == nil {
+		t.Error("expected error for missing structure")
+	}
+	if _, err = newExternalTable(`a"b`, values); err == nil {
+		t.Error("expected error for invalid name")
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"database/sql/driver"
 	"encoding/csv"
 	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/v14/arrow"
 	"github.com/goccy/go-json"
+	"github.com/marcboeker/go-duckdb"
 	"io"
+	"math/big"
+	"strconv"
+	"strings"
 )
 
 type ClickhouseFormatWriter interface {
@@ -18,109 +25,260 @@ type ClickhouseFormatReader interface {
 	io.Closer
 }
 
-type ClickhouseFormatReaderFactory func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error)
+type ClickhouseFormatReaderFactory func(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error)
 
-type ClickhouseFormatWriterFactory func(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error)
+type ClickhouseFormatWriterFactory func(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error)
 
-func newJsonLinesFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+// ClickhouseBlockWriter 列式格式按 block 写入，每个 block 对应 duckdb 结果的一个 chunk
+type ClickhouseBlockWriter interface {
+	WriteBlock(rec arrow.Record) error
+	io.Closer
+}
+
+type ClickhouseBlockWriterFactory func(schema *arrow.Schema, writer io.Writer) (ClickhouseBlockWriter, error)
+
+func newJsonLinesFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
 	decoder := json.NewDecoder(reader)
-	return &JsonLinesFormatReader{
-		columns:  columnNames,
-		decoder:  decoder,
-		receiver: make(map[string]any, len(columnNames)),
-	}, nil
+	// 保留数字原文，避免大整数和 decimal 经过 float64 丢失精度
+	decoder.UseNumber()
+	j := &JsonLinesFormatReader{
+		columns:           columnNames,
+		columnIndex:       make(map[string]int, len(columnNames)),
+		types:             make([]*duckType, len(columnTypes)),
+		defaults:          make([]func() (driver.Value, error), len(columnNames)),
+		nullable:          make([]bool, len(columnNames)),
+		decoder:           decoder,
+		skipUnknownFields: settings.InputSkipUnknownFields,
+		nullAsDefault:     settings.InputNullAsDefault,
+	}
+	for i, column := range columnNames {
+		j.columnIndex[column] = i
+		j.nullable[i] = true
+		j.defaults[i] = func() (driver.Value, error) { return nil, nil }
+	}
+	for i, columnType := range columnTypes {
+		t, err := parseDuckType(columnType)
+		if err != nil {
+			return nil, err
+		}
+		j.types[i] = t
+	}
+	return j, nil
 }
 
 type JsonLinesFormatReader struct {
-	columns  []string
-	decoder  *json.Decoder
-	receiver map[string]any
-	closer   io.Closer
+	columns           []string
+	columnIndex       map[string]int
+	types             []*duckType
+	defaults          []func() (driver.Value, error)
+	nullable          []bool
+	decoder           *json.Decoder
+	skipUnknownFields bool
+	nullAsDefault     bool
+	closer            io.Closer
+}
+
+// SetColumnDefaults 设置缺失字段使用的默认值，nullable 为 false 的列在 input_format_null_as_default 时把 null 替换为默认值
+func (j *JsonLinesFormatReader) SetColumnDefaults(defaults []func() (driver.Value, error), nullable []bool) {
+	copy(j.defaults, defaults)
+	copy(j.nullable, nullable)
 }
 
 func (j *JsonLinesFormatReader) Read(value []driver.Value) error {
-	err := j.decoder.Decode(&j.receiver)
+	if len(j.columns) != len(value) {
+		return errors.New("column length mismatch")
+	}
+	// 每行使用新的 map，避免缺失的字段沿用上一行的值
+	var row map[string]any
+	err := j.decoder.Decode(&row)
 	if err != nil {
 		return err
-
 	}
-	if len(j.columns) != len(value) {
-		return errors.New("column length mismatch")
+	if row == nil {
+		return errors.New("JSONEachRow expects an object per row")
+	}
+	if !j.skipUnknownFields {
+		for key := range row {
+			if _, ok := j.columnIndex[key]; !ok {
+				return fmt.Errorf("unknown field found while parsing JSONEachRow format: %s", key)
+			}
+		}
 	}
 	for i, column := range j.columns {
-		value[i] = j.receiver[column]
+		v, ok := row[column]
+		if !ok || (v == nil && j.nullAsDefault && !j.nullable[i]) {
+			if value[i], err = j.defaults[i](); err != nil {
+				return fmt.Errorf("column %s: %w", column, err)
+			}
+			continue
+		}
+		if value[i], err = j.types[i].cast(v); err != nil {
+			return fmt.Errorf("column %s: %w", column, err)
+		}
 	}
 	return nil
 }
 
 func (j *JsonLinesFormatReader) Close() error {
+	if j.closer == nil {
+		return nil
+	}
 	return j.closer.Close()
 }
 
-func newJsonLinesFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+func newJsonLinesFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
 	encoder := json.NewEncoder(writer)
 	return &JsonLinesFormatWriter{
-		columns: columnNames,
-		encoder: encoder,
-		m:       make(map[string]any, len(columnNames)),
+		columns:     columnNames,
+		encoder:     encoder,
+		m:           make(map[string]any, len(columnNames)),
+		quoteBigInt: settings.JSONQuote64bitIntegers,
 	}, nil
 }
 
 type JsonLinesFormatWriter struct {
-	columns []string
-	encoder *json.Encoder
-	m       map[string]any
+	columns     []string
+	encoder     *json.Encoder
+	m           map[string]any
+	quoteBigInt bool
 }
 
 func (j *JsonLinesFormatWriter) Write(value []any) error {
 	for i, column := range j.columns {
-		j.m[column] = value[i]
+		j.m[column] = jsonValue(value[i], j.quoteBigInt)
 	}
 	return j.encoder.Encode(j.m)
 }
 
+// jsonValue 把 duckdb 驱动返回的值转换为可以 json 编码的值，quoteBigInt 对应 output_format_json_quote_64bit_integers
+func jsonValue(v any, quoteBigInt bool) any {
+	switch val := v.(type) {
+	case duckdb.Map:
+		m := make(map[string]any, len(val))
+		for k, e := range val {
+			m[duckValueToString(k)] = jsonValue(e, quoteBigInt)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(val))
+		for k, e := range val {
+			m[k] = jsonValue(e, quoteBigInt)
+		}
+		return m
+	case []any:
+		list := make([]any, len(val))
+		for i, e := range val {
+			list[i] = jsonValue(e, quoteBigInt)
+		}
+		return list
+	case int64:
+		if quoteBigInt {
+			return strconv.FormatInt(val, 10)
+		}
+	case uint64:
+		if quoteBigInt {
+			return strconv.FormatUint(val, 10)
+		}
+	case duckdb.Decimal:
+		return json.Number(duckDecimalToString(val))
+	case *big.Int:
+		if quoteBigInt {
+			return val.String()
+		}
+		return json.Number(val.String())
+	}
+	return v
+}
+
 func (j *JsonLinesFormatWriter) Close() error {
 	return nil
 }
 
-func newCSVFormatReaderGeneric(columnNames, columnTypes []string, reader io.Reader, sep rune, header bool) (ClickhouseFormatReader, error) {
+// FormatSettings 文本格式相关的设置，对应 clickhouse 的 format_* 设置项
+type FormatSettings struct {
+	CSVNullRepresentation  string
+	TSVNullRepresentation  string
+	CSVDelimiter           rune
+	InputSkipUnknownFields bool
+	InputNullAsDefault     bool
+	CSVCRLF                bool
+	TSVCRLF                bool
+	JSONQuote64bitIntegers bool
+}
+
+func defaultFormatSettings() *FormatSettings {
+	return &FormatSettings{
+		CSVNullRepresentation:  "\\N",
+		TSVNullRepresentation:  "\\N",
+		CSVDelimiter:           ',',
+		InputSkipUnknownFields: true,
+		InputNullAsDefault:     true,
+	}
+}
+
+// ColumnDefaultsSetter 由需要知道目标表默认值的 reader 实现
+type ColumnDefaultsSetter interface {
+	SetColumnDefaults(defaults []func() (driver.Value, error), nullable []bool)
+}
+
+// textFormat 决定 CSV/TSV 字段的转义方式
+type textFormat int
+
+const (
+	textFormatCSV textFormat = iota
+	textFormatTSV
+	textFormatTSVRaw
+)
+
+func newColumnParsers(columnTypes []string) []func(string) (driver.Value, error) {
+	columnParsers := make([]func(string) (driver.Value, error), len(columnTypes))
+	for i, columnType := range columnTypes {
+		columnParsers[i] = getDuckDBConverter(columnType)
+		if columnParsers[i] == nil {
+			columnType := columnType
+			columnParsers[i] = func(in string) (driver.Value, error) {
+				return castToDuckType(in, columnType)
+			}
+		}
+	}
+	return columnParsers
+}
+
+func newCSVFormatReaderGeneric(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings, headerLines int) (ClickhouseFormatReader, error) {
 	r := csv.NewReader(reader)
 	r.ReuseRecord = true
-	r.Comma = sep
-	if header {
+	r.Comma = settings.CSVDelimiter
+	for i := 0; i < headerLines; i++ {
 		_, err := r.Read()
 		if err != nil {
 			return nil, err
 		}
 	}
-	columnParsers := make([]func(string) (driver.Value, error), len(columnTypes))
-	for i, columnType := range columnTypes {
-		columnParsers[i] = getDuckDBConverter(columnType)
-	}
 	return &CSVFormatReader{
 		columns:       columnNames,
-		columnParsers: columnParsers,
+		columnParsers: newColumnParsers(columnTypes),
 		reader:        r,
+		null:          settings.CSVNullRepresentation,
 	}, nil
 }
-func newCSVFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
-	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, ',', false)
-}
 
-func newCSVHeaderFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
-	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, ',', true)
+func newCSVFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, settings, 0)
 }
-func newTSVFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
-	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, '\t', false)
+
+func newCSVHeaderFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, settings, 1)
 }
-func newTSVHeaderFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
-	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, '\t', true)
+
+func newCSVHeaderWithTypesFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, settings, 2)
 }
 
 type CSVFormatReader struct {
 	columns       []string
 	columnParsers []func(string) (driver.Value, error)
 	reader        *csv.Reader
+	null          string
 	closer        io.Closer
 }
 
@@ -132,7 +290,14 @@ func (c *CSVFormatReader) Read(values []driver.Value) error {
 	if err != nil {
 		return err
 	}
+	if len(record) != len(c.columns) {
+		return fmt.Errorf("expected %d fields, got %d", len(c.columns), len(record))
+	}
 	for i := range c.columns {
+		if record[i] == c.null {
+			values[i] = nil
+			continue
+		}
 		values[i], err = c.columnParsers[i](record[i])
 		if err != nil {
 			return err
@@ -142,104 +307,290 @@ func (c *CSVFormatReader) Read(values []driver.Value) error {
 }
 
 func (c *CSVFormatReader) Close() error {
+	if c.closer == nil {
+		return nil
+	}
 	return c.closer.Close()
 }
 
-type CSVFormatWriter struct {
-	columns []string
-	writer  *csv.Writer
-	closer  io.Closer
+func newTSVFormatReaderGeneric(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings, headerLines int, raw bool) (ClickhouseFormatReader, error) {
+	rd, ok := reader.(*bufio.Reader)
+	if !ok {
+		rd = bufio.NewReader(reader)
+	}
+	t := &TSVFormatReader{
+		columns:       columnNames,
+		columnParsers: newColumnParsers(columnTypes),
+		composite:     make([]bool, len(columnTypes)),
+		reader:        rd,
+		null:          settings.TSVNullRepresentation,
+		raw:           raw,
+	}
+	for i, columnType := range columnTypes {
+		if typ, err := parseDuckType(columnType); err == nil {
+			t.composite[i] = isClickhouseComposite(typ)
+		}
+	}
+	for i := 0; i < headerLines; i++ {
+		if _, err := t.readLine(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
 }
 
-func (c *CSVFormatWriter) Write(values []any) error {
-	strValues := make([]string, len(values))
-	for i, value := range values {
-		strValues[i] = duckValueToString(value)
+func newTSVFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	return newTSVFormatReaderGeneric(columnNames, columnTypes, reader, settings, 0, false)
+}
+
+func newTSVHeaderFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	return newTSVFormatReaderGeneric(columnNames, columnTypes, reader, settings, 1, false)
+}
+
+func newTSVHeaderWithTypesFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	return newTSVFormatReaderGeneric(columnNames, columnTypes, reader, settings, 2, false)
+}
+
+func newTSVRawFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	return newTSVFormatReaderGeneric(columnNames, columnTypes, reader, settings, 0, true)
+}
+
+// TSVFormatReader clickhouse 的 TabSeparated 不使用引号，而是用反斜杠转义 \t \n \\ 等字符
+type TSVFormatReader struct {
+	columns       []string
+	columnParsers []func(string) (driver.Value, error)
+	composite     []bool
+	reader        *bufio.Reader
+	null          string
+	raw           bool
+}
+
+func (t *TSVFormatReader) readLine() (string, error) {
+	line, err := t.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
 	}
-	return c.writer.Write(strValues)
+	return strings.TrimSuffix(line, "\n"), err
 }
 
-func (c *CSVFormatWriter) Close() error {
-	c.writer.Flush()
+func (t *TSVFormatReader) Read(values []driver.Value) error {
+	if len(t.columns) != len(values) {
+		return errors.New("column length mismatch")
+	}
+	line, err := t.readLine()
+	if err != nil {
+		return err
+	}
+	fields := strings.Split(line, "\t")
+	if len(fields) != len(t.columns) {
+		return fmt.Errorf("expected %d fields, got %d", len(t.columns), len(fields))
+	}
+	for i, field := range fields {
+		if field == t.null {
+			values[i] = nil
+			continue
+		}
+		// 复合类型内部的字符串自带引号和转义，整体不再反转义
+		if !t.raw && !t.composite[i] {
+			field = unescapeClickhouseString(field)
+		}
+		values[i], err = t.columnParsers[i](field)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-var typesMapping = map[string]string{
-	"INTEGER": "Int32",
-	"VARCHAR": "String",
-	"BIGINT":  "Int64",
-	"BOOLEAN": "UInt8",
-	"DOUBLE":  "Float64",
+func (t *TSVFormatReader) Close() error {
+	return nil
+}
+
+// CSVFormatWriter 输出 CSV 和 TabSeparated 系列格式
+type CSVFormatWriter struct {
+	columns []string
+	types   []*duckType
+	writer  *bufio.Writer
+	format  textFormat
+	sep     byte
+	null    string
+	eol     string
+}
+
+func (c *CSVFormatWriter) writeField(s string, quoted bool) error {
+	switch {
+	case c.format == textFormatTSV:
+		_, err := c.writer.WriteString(escapeClickhouseString(s))
+		return err
+	case c.format == textFormatCSV && quoted:
+		_ = c.writer.WriteByte('"')
+		_, _ = c.writer.WriteString(strings.ReplaceAll(s, `"`, `""`))
+		return c.writer.WriteByte('"')
+	}
+	_, err := c.writer.WriteString(s)
+	return err
 }
 
-func typesToClickhouseTypes(types []string) []string {
-	clickhouseTypes := make([]string, len(types))
-	for i, t := range types {
-		clickhouseTypes[i] = typesMapping[t]
-		if clickhouseTypes[i] == "" {
-			clickhouseTypes[i] = "String"
+func (c *CSVFormatWriter) writeLine(fields []string, quoted bool) error {
+	for i, field := range fields {
+		if i > 0 {
+			_ = c.writer.WriteByte(c.sep)
+		}
+		if err := c.writeField(field, quoted); err != nil {
+			return err
 		}
 	}
-	return clickhouseTypes
+	_, err := c.writer.WriteString(c.eol)
+	return err
 }
 
-func newCSVFormatWriterGeneric(columnNames, columnTypes []string, writer io.Writer, sep rune, header bool, types bool) (ClickhouseFormatWriter, error) {
-	w := csv.NewWriter(writer)
-	w.Comma = sep
-	if header {
-		err := w.Write(columnNames)
+func (c *CSVFormatWriter) Write(values []any) error {
+	for i, value := range values {
+		if i > 0 {
+			_ = c.writer.WriteByte(c.sep)
+		}
+		if value == nil {
+			_, _ = c.writer.WriteString(c.null)
+			continue
+		}
+		t := c.types[i]
+		text := formatClickhouseText(value, t, false)
+		var err error
+		if isClickhouseComposite(t) && c.format != textFormatCSV {
+			// 复合类型内部的字符串已经带引号和转义
+			_, err = c.writer.WriteString(text)
+		} else {
+			err = c.writeField(text, !isClickhouseTextUnquoted(t))
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	if types {
+	_, err := c.writer.WriteString(c.eol)
+	return err
+}
 
-		err := w.Write(typesToClickhouseTypes(columnTypes))
+func (c *CSVFormatWriter) Close() error {
+	return c.writer.Flush()
+}
+
+func newCSVFormatWriterGeneric(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings, format textFormat, header bool, types bool) (ClickhouseFormatWriter, error) {
+	c := &CSVFormatWriter{
+		columns: columnNames,
+		types:   make([]*duckType, len(columnTypes)),
+		writer:  bufio.NewWriter(writer),
+		format:  format,
+		sep:     '\t',
+		null:    settings.TSVNullRepresentation,
+		eol:     "\n",
+	}
+	if settings.TSVCRLF {
+		c.eol = "\r\n"
+	}
+	if format == textFormatCSV {
+		c.sep = byte(settings.CSVDelimiter)
+		c.null = settings.CSVNullRepresentation
+		c.eol = "\n"
+		if settings.CSVCRLF {
+			c.eol = "\r\n"
+		}
+	}
+	for i, columnType := range columnTypes {
+		t, err := parseDuckType(columnType)
 		if err != nil {
+			t = &duckType{name: "VARCHAR"}
+		}
+		c.types[i] = t
+	}
+	if header {
+		if err := c.writeLine(columnNames, true); err != nil {
 			return nil, err
 		}
 	}
-	return &CSVFormatWriter{
-		columns: columnNames,
-		writer:  w,
-	}, nil
+	if types {
+		if err := c.writeLine(typesToClickhouseTypes(columnTypes), true); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func newCSVFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, settings, textFormatCSV, false, false)
 }
 
-func newCSVFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
-	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, ',', false, false)
+func newCSVHeaderFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, settings, textFormatCSV, true, false)
 }
 
-func newCSVHeaderFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
-	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, ',', true, false)
+func newCSVHeaderWithTypesFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, settings, textFormatCSV, true, true)
 }
 
-func newTSVFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
-	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, '\t', false, false)
+func newTSVFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, settings, textFormatTSV, false, false)
 }
 
-func newTSVHeaderFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
-	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, '\t', true, false)
+func newTSVHeaderFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, settings, textFormatTSV, true, false)
 }
 
-func newTSVHeaderWithTypesFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
-	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, '\t', true, true)
+func newTSVHeaderWithTypesFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, settings, textFormatTSV, true, true)
+}
+
+func newTSVRawFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings *FormatSettings) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, settings, textFormatTSVRaw, false, false)
 }
 
 var chInputFormats = map[string]ClickhouseFormatReaderFactory{
-	"JSONEachRow":           newJsonLinesFormatReader,
-	"CSV":                   newCSVFormatReader,
-	"CSVWithNames":          newCSVHeaderFormatReader,
-	"TabSeparated":          newTSVFormatReader,
-	"TabSeparatedWithNames": newTSVHeaderFormatReader,
+	"JSONEachRow":                   newJsonLinesFormatReader,
+	"CSV":                           newCSVFormatReader,
+	"CSVWithNames":                  newCSVHeaderFormatReader,
+	"CSVWithNamesAndTypes":          newCSVHeaderWithTypesFormatReader,
+	"TabSeparated":                  newTSVFormatReader,
+	"TabSeparatedWithNames":         newTSVHeaderFormatReader,
+	"TabSeparatedWithNamesAndTypes": newTSVHeaderWithTypesFormatReader,
+	"TabSeparatedRaw":               newTSVRawFormatReader,
+	"Native":                        newNativeFormatReader,
+	"Arrow":                         newArrowFormatReader,
+	"ArrowStream":                   newArrowStreamFormatReader,
 }
 
 var chOutputFormats = map[string]ClickhouseFormatWriterFactory{
 	"JSONEachRow":                   newJsonLinesFormatWriter,
 	"CSV":                           newCSVFormatWriter,
 	"CSVWithNames":                  newCSVHeaderFormatWriter,
+	"CSVWithNamesAndTypes":          newCSVHeaderWithTypesFormatWriter,
 	"TabSeparated":                  newTSVFormatWriter,
 	"TabSeparatedWithNames":         newTSVHeaderFormatWriter,
 	"TabSeparatedWithNamesAndTypes": newTSVHeaderWithTypesFormatWriter,
+	"TabSeparatedRaw":               newTSVRawFormatWriter,
+}
+
+// chFormatAliases clickhouse 格式名的别名
+var chFormatAliases = map[string]string{
+	"TSV":                  "TabSeparated",
+	"TSVWithNames":         "TabSeparatedWithNames",
+	"TSVWithNamesAndTypes": "TabSeparatedWithNamesAndTypes",
+	"TSVRaw":               "TabSeparatedRaw",
+	"Raw":                  "TabSeparatedRaw",
+}
+
+var chBlockOutputFormats = map[string]ClickhouseBlockWriterFactory{
+	"Native":      newNativeFormatWriter,
+	"Arrow":       newArrowFormatWriter,
+	"ArrowStream": newArrowStreamFormatWriter,
+}
+
+// chCopyOutputFormats 由 duckdb 的 COPY TO 直接导出的格式，值为 COPY 的选项
+var chCopyOutputFormats = map[string]string{
+	"Parquet": "FORMAT PARQUET",
+}
+
+// chScanInputFormats 落盘后由 duckdb 表函数直接读取的格式，值为表函数名
+var chScanInputFormats = map[string]string{
+	"Parquet": "read_parquet",
 }
 
 var chFormatContentTypes = map[string]string{
@@ -247,18 +598,43 @@ var chFormatContentTypes = map[string]string{
 	"TabSeparatedWithNames":         "text/tab-separated-values; charset=UTF-8",
 	"TabSeparatedWithNamesAndTypes": "text/tab-separated-values; charset=UTF-8",
 	"CSV":                           "text/csv; charset=UTF-8",
+	"TabSeparatedRaw":               "text/tab-separated-values; charset=UTF-8",
 	"CSVWithNames":                  "text/csv; charset=UTF-8",
+	"CSVWithNamesAndTypes":          "text/csv; charset=UTF-8",
 	"JSONEachRow":                   "application/json; charset=UTF-8",
+	"Native":                        "application/octet-stream",
+	"Arrow":                         "application/vnd.apache.arrow.file",
+	"ArrowStream":                   "application/vnd.apache.arrow.stream",
+	"Parquet":                       "application/octet-stream",
+}
+
+func canonicalClickhouseFormat(name string) string {
+	if alias, ok := chFormatAliases[name]; ok {
+		return alias
+	}
+	return name
 }
 
 func GetClickhouseFormatContentType(name string) string {
-	return chFormatContentTypes[name]
+	return chFormatContentTypes[canonicalClickhouseFormat(name)]
 }
 
 func GetClickhouseInputFormat(name string) ClickhouseFormatReaderFactory {
-	return chInputFormats[name]
+	return chInputFormats[canonicalClickhouseFormat(name)]
 }
 
 func GetClickhouseOutputFormat(name string) ClickhouseFormatWriterFactory {
-	return chOutputFormats[name]
+	return chOutputFormats[canonicalClickhouseFormat(name)]
+}
+
+func GetClickhouseBlockOutputFormat(name string) ClickhouseBlockWriterFactory {
+	return chBlockOutputFormats[name]
+}
+
+func GetClickhouseCopyOutputFormat(name string) string {
+	return chCopyOutputFormats[name]
+}
+
+func GetClickhouseScanInputFormat(name string) string {
+	return chScanInputFormats[name]
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestClickhouseTypes(t *testing.T) {
+	types := []string{"INTEGER", "DECIMAL(10,2)", "VARCHAR[]", "MAP(VARCHAR, INTEGER)", `STRUCT(a INTEGER, "b c" VARCHAR)`, "TIMESTAMP WITH TIME ZONE"}
+	expected := []string{"Nullable(Int32)", "Nullable(Decimal(10, 2))", "Array(Nullable(String))",
+		"Map(String, Nullable(Int32))", "Tuple(a Nullable(Int32), `b c` Nullable(String))", "Nullable(DateTime64(6, 'UTC'))"}
+	if got := typesToClickhouseTypes(types); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected types %v, expected %v", got, expected)
+	}
+}
+
+func TestTSVFormatRoundTrip(t *testing.T) {
+	columnNames := []string{"a", "b", "c"}
+	columnTypes := []string{"INTEGER", "VARCHAR", "VARCHAR[]"}
+	settings := defaultFormatSettings()
+	var buf bytes.Buffer
+	w, err := newTSVHeaderWithTypesFormatWriter(columnNames, columnTypes, &buf, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Write([]any{int32(1), "x\ty\\z\n", []any{"it's", nil}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Write([]any{nil, nil, nil}); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+	expected := "a\tb\tc\nNullable(Int32)\tNullable(String)\tArray(Nullable(String))\n" +
+		"1\tx\\ty\\\\z\\n\t['it\\'s',NULL]\n\\N\t\\N\t\\N\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+
+	r, err := newTSVHeaderWithTypesFormatReader(columnNames[:2], columnTypes[:2], bytes.NewBufferString(
+		"a\tb\nInt32\tString\n1\tx\\ty\\\\z\\n\n\\N\t\\N\n"), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]driver.Value, 2)
+	if err = r.Read(values); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []driver.Value{int32(1), "x\ty\\z\n"}) {
+		t.Errorf("unexpected row %v", values)
+	}
+	if err = r.Read(values); err != nil || values[0] != nil || values[1] != nil {
+		t.Errorf("expected nulls, got %v %v", values, err)
+	}
+}
+
+func TestCSVNullRepresentation(t *testing.T) {
+	settings := defaultFormatSettings()
+	settings.CSVNullRepresentation = "NULL"
+	var buf bytes.Buffer
+	w, _ := newCSVFormatWriter([]string{"a", "b"}, []string{"DOUBLE", "VARCHAR"}, &buf, settings)
+	_ = w.Write([]any{1.5, `say "hi"`})
+	_ = w.Write([]any{nil, nil})
+	_ = w.Close()
+	if expected := "1.5,\"say \"\"hi\"\"\"\nNULL,NULL\n"; buf.String() != expected {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
+
+func TestJsonLinesFormatReader(t *testing.T) {
+	columnNames := []string{"a", "b", "c", "d"}
+	columnTypes := []string{"INTEGER", "DECIMAL(10,2)", "STRUCT(x BIGINT, y VARCHAR[])", "VARCHAR"}
+	settings := defaultFormatSettings()
+	input := `{"a":1,"b":"1.005","c":{"x":2,"y":["p"]},"d":"q","e":0}
+{"a":"2"}
+`
+	r, err := newJsonLinesFormatReader(columnNames, columnTypes, bytes.NewBufferString(input), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]driver.Value, len(columnNames))
+	if err = r.Read(values); err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != int32(1) || duckDecimalToString(values[1].(duckdb.Decimal)) != "1.01" ||
+		!reflect.DeepEqual(values[2], map[string]any{"x": int64(2), "y": []any{"p"}}) || values[3] != "q" {
+		t.Errorf("unexpected row %v", values)
+	}
+	// 缺失的字段不能沿用上一行的值
+	if err = r.Read(values); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []driver.Value{int32(2), nil, nil, nil}) {
+		t.Errorf("unexpected row %v", values)
+	}
+
+	settings.InputSkipUnknownFields = false
+	r, _ = newJsonLinesFormatReader(columnNames, columnTypes, bytes.NewBufferString(input), settings)
+	if err = r.Read(values); err == nil {
+		t.Error("expected unknown field error")
+	}
+}
+
+func TestAppendRowsStagedIdentifiers(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	execer := conn.(driver.ExecerContext)
+	if _, err = execer.ExecContext(context.Background(), `CREATE SCHEMA "my schema"; CREATE TABLE "my schema"."order" ("select" DECIMAL(10,2), "b c" VARCHAR, d INTEGER DEFAULT 7)`, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 只写部分列时走临时表
+	columnNames, columnTypes := []string{"select", "b c"}, []string{"DECIMAL(10,2)", "VARCHAR"}
+	r, err := newTSVFormatReader(columnNames, columnTypes, bytes.NewBufferString("1.5\tx\n"), defaultFormatSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = appendRows(context.Background(), conn, "my schema", "order", columnNames, columnTypes, true, r); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := conn.(driver.QueryerContext).QueryContext(context.Background(), `SELECT "select"::VARCHAR, "b c", d FROM "my schema"."order"`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 3)
+	if err = rows.Next(values); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []driver.Value{"1.50", "x", int32(7)}) {
+		t.Errorf("unexpected row %v", values)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var killQueryRegexp = regexp.MustCompile(`(?is)^\s*KILL\s+QUERY\s+WHERE\s+(.+?)(?:\s+(SYNC|ASYNC|TEST))?(?:\s+FORMAT\s+(\w+))?[\s;]*$`)
+
+// killSyncTimeout KILL QUERY ... SYNC 等待查询结束的最长时间
+const killSyncTimeout = 10 * time.Second
+
+// KillQuery 执行 KILL QUERY WHERE ...，条件在 system.processes 上求值，
+// 返回每个匹配的查询和取消的状态
+func (c *ChServer) KillQuery(ctx context.Context, query string, settings *QuerySettings, wr http.ResponseWriter) {
+	m := killQueryRegexp.FindStringSubmatch(query)
+	if settings.Readonly > 0 {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "Cannot execute query in readonly mode")
+		return
+	}
+	mode := strings.ToUpper(m[2])
+	format := settings.DefaultFormat
+	if m[3] != "" {
+		format = m[3]
+	}
+	formater := GetClickhouseOutputFormat(format)
+	if formater == nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Unknown format %s", format)
+		return
+	}
+	if err := checkKillCondition(m[1]); err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid KILL QUERY condition: %s", err)
+		return
+	}
+	// system.processes 在 KILL 登记之前取快照，不会匹配到自己。只有管理员可以取消其他用户的查询
+	var args []any
+	selectQuery := fmt.Sprintf(`SELECT query_id, "user", query FROM (%s) WHERE (%s)`, c.queries.processesRelation(), m[1])
+	if !c.isAdmin(settings.User) {
+		selectQuery += ` AND "user" = ?`
+		args = append(args, settings.User)
+	}
+	q, err := c.beginQuery(ctx, settings, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error starting query: %s", err)
+		return
+	}
+	defer q.Close()
+	// 条件拼接后必须仍然是一条 SELECT 语句
+	var typ int
+	err = q.conn.Raw(func(driverConn any) error {
+		typ, err = duckdbStatementType(driverConn.(driver.Conn), selectQuery)
+		return err
+	})
+	if err == nil && typ != duckdbStatementSelect {
+		err = fmt.Errorf("condition is not an expression")
+	}
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid KILL QUERY condition: %s", q.err(err))
+		return
+	}
+	rows, err := q.conn.QueryContext(q.ctx, selectQuery, args...)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
+		return
+	}
+	var matched [][]any
+	for rows.Next() {
+		var id, user, text string
+		if err = rows.Scan(&id, &user, &text); err != nil {
+			break
+		}
+		matched = append(matched, []any{"", id, user, text})
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
+		return
+	}
+	for _, row := range matched {
+		id := row[1].(string)
+		switch {
+		case mode == "TEST":
+			row[0] = "cancel_tested"
+		case !c.queries.Cancel(id):
+			row[0] = "finished"
+		case mode == "SYNC" && c.queries.wait(ctx, id, killSyncTimeout):
+			row[0] = "finished"
+		default:
+			row[0] = "waiting"
+		}
+	}
+	fmter, err := formater([]string{"kill_status", "query_id", "user", "query"},
+		[]string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"}, wr, settings.Format)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating format: %s", err)
+		return
+	}
+	wr.Header().Set("x-clickhouse-format", format)
+	wr.Header().Set("Content-Type", GetClickhouseFormatContentType(format))
+	wr.WriteHeader(200)
+	for _, row := range matched {
+		if err = fmter.Write(row); err != nil {
+			writeStreamError(wr, "Error writing row: %s", err)
+			return
+		}
+	}
+	_ = fmter.Close()
+}
+
+// checkKillCondition KILL QUERY 的条件只能是一个表达式：括号必须配对，不能有分号、注释和反斜杠，
+// 避免用 ) UNION ... 或多条语句执行条件以外的 SQL。duckdb 的字符串不支持反斜杠转义，直接拒绝以免和这里的扫描不一致
+func checkKillCondition(cond string) error {
+	depth := 0
+	for i := 0; i < len(cond); i++ {
+		switch ch := cond[i]; {
+		case ch == '\'' || ch == '"':
+			end := i + 1
+			for ; end < len(cond); end++ {
+				if cond[end] != ch {
+					continue
+				}
+				if end+1 < len(cond) && cond[end+1] == ch {
+					end++
+					continue
+				}
+				break
+			}
+			if end >= len(cond) {
+				return fmt.Errorf("unterminated quote")
+			}
+			i = end
+		case ch == '\\':
+			return fmt.Errorf("backslashes are not allowed")
+		case ch == ';':
+			return fmt.Errorf("multiple statements are not allowed")
+		case strings.HasPrefix(cond[i:], "--") || strings.HasPrefix(cond[i:], "/*"):
+			return fmt.Errorf("comments are not allowed")
+		case ch == '$' && dollarQuoteRegexp.MatchString(cond[i:]):
+			return fmt.Errorf("dollar quoted strings are not allowed")
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced parentheses")
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced parentheses")
+	}
+	return nil
+}
+
+// isAdmin 没有开启认证时所有请求都是同一个用户，开启认证后只有 -admin_users 中的用户是管理员
+func (c *ChServer) isAdmin(user string) bool {
+	return !c.pgServer.enableAuth || c.adminUsers[user]
+}
+
+// SignalBackends 执行 SELECT pg_cancel_backend(pid) / pg_terminate_backend(pid) [FROM ...]，
+// pid 来自 system.processes 或 pg_stat_activity，返回每个 pid 是否存在
+func (c *ChServer) SignalBackends(ctx context.Context, query string, settings *QuerySettings, wr http.ResponseWriter) {
+	format := settings.DefaultFormat
+	if m := selectFormatRegexp.FindStringSubmatch(query); len(m) > 2 {
+		format = m[2]
+		query = m[1]
+	}
+	name, pidQuery, ok := parseBackendSignal(query)
+	if !ok {
+		c.SelectQuery(ctx, query, settings, wr)
+		return
+	}
+	if settings.Readonly > 0 {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "Cannot execute query in readonly mode")
+		return
+	}
+	formater := GetClickhouseOutputFormat(format)
+	if formater == nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Unknown format %s", format)
+		return
+	}
+	results, err := c.queries.signalBackends(ctx, c.conn, name, pidQuery)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	fmter, err := formater([]string{name}, []string{"BOOLEAN"}, wr, settings.Format)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating format: %s", err)
+		return
+	}
+	wr.Header().Set("x-clickhouse-format", format)
+	wr.Header().Set("Content-Type", GetClickhouseFormatContentType(format))
+	wr.WriteHeader(200)
+	for _, result := range results {
+		if err = fmter.Write([]any{result}); err != nil {
+			writeStreamError(wr, "Error writing row: %s", err)
+			return
+		}
+	}
+	_ = fmter.Close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestKillQuery(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE t (a INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	c := &ChServer{conn: db, pgServer: &PgServer{enableAuth: true}, sessions: newChSessionManager(db),
+		queries: newQueryRegistry(), adminUsers: map[string]bool{"root": true}}
+	for _, q := range []*runningQuery{{ID: "a1", User: "alice", Query: "SELECT 1"}, {ID: "b1", User: "bob", Query: "SELECT 2"}} {
+		_, finish, err := c.queries.Begin(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer finish()
+	}
+	kill := func(user, query string) (int, string) {
+		settings := defaultQuerySettings()
+		settings.User = user
+		settings.QueryID = newQueryID()
+		settings.DefaultFormat = "CSV"
+		rec := httptest.NewRecorder()
+		c.KillQuery(context.Background(), query, settings, rec)
+		return rec.Code, rec.Body.String()
+	}
+
+	// 普通用户只能取消自己的查询
+	if code, body := kill("bob", "KILL QUERY WHERE 1 = 1 TEST"); code != 200 || body != "\"cancel_tested\",\"b1\",\"bob\",\"SELECT 2\"\n" {
+		t.Errorf("unexpected response %d %q", code, body)
+	}
+	if code, body := kill("root", "KILL QUERY WHERE query_id IN ('a1', 'b1') TEST"); code != 200 || strings.Count(body, "cancel_tested") != 2 {
+		t.Errorf("unexpected admin response %d %q", code, body)
+	}
+
+	// 条件只能是一个表达式
+	for _, query := range []string{
+		"KILL QUERY WHERE 1 = 1; DROP TABLE t",
+		"KILL QUERY WHERE 1 = 1) OR (1 = 1",
+		"KILL QUERY WHERE 1 = 1) UNION SELECT 'x', 'y', 'z' FROM t WHERE (1 = 1",
+		"KILL QUERY WHERE query_id = '\\' ) OR (1 = 1 --'",
+		"KILL QUERY WHERE 1 = 1 /* comment */",
+	} {
+		if code, _ := kill("bob", query); code != 400 {
+			t.Errorf("%s: got %d, want 400", query, code)
+		}
+	}
+	if code, _ := kill("bob", "KILL QUERY WHERE query_id = 'a1'')' TEST"); code != 200 {
+		t.Errorf("quoted parenthesis: got %d", code)
+	}
+	if err = db.QueryRow("SELECT count(*) FROM t").Scan(new(int)); err != nil {
+		t.Errorf("table t must still exist: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var dollarQuoteRegexp = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+// splitStatements 按分号切分多条语句，字符串(包括 $$ 字符串)、带引号的标识符和注释中的分号不处理，语句开头的注释和空语句去掉
+func splitStatements(query string) []string {
+	var statements []string
+	start := 0
+	hasContent := false
+	for i := 0; i < len(query); {
+		switch ch := query[i]; {
+		case ch == '\'' || ch == '"' || ch == '`':
+			i = skipQuoted(query, i)
+			hasContent = true
+		case ch == '$' && dollarQuoteRegexp.MatchString(query[i:]):
+			tag := dollarQuoteRegexp.FindString(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			hasContent = true
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			if !hasContent {
+				start = i
+			}
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			if !hasContent {
+				start = i
+			}
+		case ch == ';':
+			if hasContent {
+				statements = append(statements, strings.TrimSpace(query[start:i]))
+			}
+			i++
+			start = i
+			hasContent = false
+		default:
+			if ch != ' ' && ch != '\t' && ch != '\n' && ch != '\r' {
+				hasContent = true
+			}
+			i++
+		}
+	}
+	if hasContent {
+		statements = append(statements, strings.TrimSpace(query[start:]))
+	}
+	return statements
+}
+
+// multiQueryWriter 多条语句的结果依次写入同一个响应，语句出错时暂存错误信息，由 MultiQuery 加上语句序号后输出
+type multiQueryWriter struct {
+	wr      http.ResponseWriter
+	started bool
+	failed  bool
+	status  int
+	errBuf  bytes.Buffer
+}
+
+func (m *multiQueryWriter) Header() http.Header {
+	return m.wr.Header()
+}
+
+func (m *multiQueryWriter) Write(p []byte) (int, error) {
+	if m.failed {
+		return m.errBuf.Write(p)
+	}
+	if !m.started {
+		m.started = true
+		// 多条语句的结果拼接在一起，不能使用第一条语句的长度
+		m.wr.Header().Del("Content-Length")
+		m.wr.WriteHeader(200)
+	}
+	return m.wr.Write(p)
+}
+
+// WriteHeader 成功的状态码等到有结果输出时再写出，没有结果的语句出错时仍然可以返回错误状态码
+func (m *multiQueryWriter) WriteHeader(status int) {
+	if status >= 400 && !m.failed {
+		m.failed = true
+		m.status = status
+	}
+}
+
+// MultiQuery 依次执行多条语句，遇到错误时停止并报告出错的语句。
+// 没有 session_id 时使用一个临时 session，多条语句共用同一个连接，SET 和临时表对后续语句可见
+func (c *ChServer) MultiQuery(ctx context.Context, statements []string, settings *QuerySettings, wr http.ResponseWriter) {
+	settings = settings.Clone()
+	if settings.SessionID == "" {
+		settings.SessionID = "multiquery-" + settings.QueryID
+		settings.SessionCheck = false
+		defer c.sessions.Remove(settings.User, settings.SessionID)
+	}
+	mw := &multiQueryWriter{wr: wr}
+	for i, statement := range statements {
+		c.runStatement(ctx, statement, settings, mw)
+		if !mw.failed {
+			continue
+		}
+		message := fmt.Sprintf("Error in statement %d (%s): %s", i+1, shortStatement(statement), mw.errBuf.String())
+		if mw.started {
+			writeStreamError(wr, "%s", message)
+		} else {
+			wr.WriteHeader(mw.status)
+			_, _ = fmt.Fprint(wr, message)
+		}
+		return
+	}
+	if !mw.started {
+		wr.WriteHeader(200)
+	}
+}
+
+// shortStatement 错误信息中只保留语句开头的一部分
+func shortStatement(statement string) string {
+	statement = strings.Join(strings.Fields(statement), " ")
+	if len(statement) > 80 {
+		return statement[:80] + "..."
+	}
+	return statement
+}
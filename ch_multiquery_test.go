@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements("-- setup\nCREATE TABLE t(a int);\n" +
+		"INSERT INTO t VALUES (1), ($$a;b$$), ('c;d') /* ; */;\n;  \n/* only a comment */\nSELECT \"x;y\" FROM t -- ;\n")
+	expected := []string{
+		"CREATE TABLE t(a int)",
+		"INSERT INTO t VALUES (1), ($$a;b$$), ('c;d') /* ; */",
+		"SELECT \"x;y\" FROM t -- ;",
+	}
+	if !reflect.DeepEqual(statements, expected) {
+		t.Errorf("unexpected statements %q", statements)
+	}
+	if statements = splitStatements(" ; -- nothing\n"); len(statements) != 0 {
+		t.Errorf("expected no statements, got %q", statements)
+	}
+}
+
+func TestRowQueryRouting(t *testing.T) {
+	for _, query := range []string{"SELECT 1", "WITH x AS (SELECT 1) SELECT * FROM x", "SHOW TABLES", "DESC t",
+		"EXPLAIN SELECT 1", "(SELECT 1) UNION (SELECT 2)", "FROM t"} {
+		if !testRowQueryRegexp.MatchString(query) {
+			t.Errorf("%q should produce rows", query)
+		}
+	}
+	for _, query := range []string{"INSERT INTO t SELECT 1", "CREATE TABLE t AS SELECT 1", "DROP TABLE t"} {
+		if testRowQueryRegexp.MatchString(query) {
+			t.Errorf("%q should not produce rows", query)
+		}
+	}
+	if !testInsertFormatRegexp.MatchString("INSERT INTO db.t (a, b)\nFORMAT CSV\n") ||
+		testInsertFormatRegexp.MatchString("INSERT INTO t SELECT 'a format b'") {
+		t.Error("unexpected INSERT ... FORMAT matching")
+	}
+	if !testInsertQueryRegexp.MatchString("INSERT INTO t\nSELECT 1") || testInsertQueryRegexp.MatchString("INSERT INTO t") {
+		t.Error("unexpected INSERT ... SELECT matching")
+	}
+}
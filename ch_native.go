@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/marcboeker/go-duckdb"
+)
+
+/*
+Native 是 clickhouse 的列式格式，https://clickhouse.com/docs/en/interfaces/formats#native
+每个 block 依次为: varuint 列数, varuint 行数, 然后每一列依次为 列名, clickhouse 类型名, 列数据。
+http 协议下不发送 BlockInfo。
+*/
+
+type nativeBuffer struct {
+	b []byte
+}
+
+func (n *nativeBuffer) putUvarint(v uint64) {
+	n.b = binary.AppendUvarint(n.b, v)
+}
+
+func (n *nativeBuffer) putString(s string) {
+	n.putUvarint(uint64(len(s)))
+	n.b = append(n.b, s...)
+}
+
+func (n *nativeBuffer) putBytes(s []byte) {
+	n.putUvarint(uint64(len(s)))
+	n.b = append(n.b, s...)
+}
+
+func (n *nativeBuffer) putUint8(v uint8) {
+	n.b = append(n.b, v)
+}
+
+func (n *nativeBuffer) putUint16(v uint16) {
+	n.b = binary.LittleEndian.AppendUint16(n.b, v)
+}
+
+func (n *nativeBuffer) putUint32(v uint32) {
+	n.b = binary.LittleEndian.AppendUint32(n.b, v)
+}
+
+func (n *nativeBuffer) putUint64(v uint64) {
+	n.b = binary.LittleEndian.AppendUint64(n.b, v)
+}
+
+// nativeColumnEncoder 把一个 arrow 列编码为 Native 列数据，不包含列名和类型
+type nativeColumnEncoder struct {
+	typeName string
+	nullable bool
+	encode   func(buf *nativeBuffer, arr arrow.Array) error
+}
+
+func (e *nativeColumnEncoder) write(buf *nativeBuffer, arr arrow.Array) error {
+	if e.nullable {
+		for i := 0; i < arr.Len(); i++ {
+			if arr.IsNull(i) {
+				buf.putUint8(1)
+			} else {
+				buf.putUint8(0)
+			}
+		}
+	}
+	return e.encode(buf, arr)
+}
+
+func newNativeColumnEncoder(dt arrow.DataType, nullable bool) (*nativeColumnEncoder, error) {
+	e := &nativeColumnEncoder{nullable: nullable}
+	switch t := dt.(type) {
+	case *arrow.NullType:
+		e.typeName = "Nothing"
+		e.nullable = true
+		e.encode = func(buf *nativeBuffer, arr arrow.Array) error {
+			for i := 0; i < arr.Len(); i++ {
+				buf.putUint8('0')
+			}
+			return nil
+		}
+	case *arrow.BooleanType:
+		e.typeName = "Bool"
+		e.encode = func(buf *nativeBuffer, arr arrow.Array) error {
+			a := arr.(*array.Boolean)
+			for i := 0; i < a.Len(); i++ {
+				if a.Value(i) {
+					buf.putUint8(1)
+				} else {
+					buf.putUint8(0)
+				}
+			}
+			return nil
+		}
+	case *arrow.Int8Type:
+		e.typeName = "Int8"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Int8, i int) { buf.putUint8(uint8(a.Value(i))) })
+	case *arrow.Int16Type:
+		e.typeName = "Int16"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Int16, i int) { buf.putUint16(uint16(a.Value(i))) })
+	case *arrow.Int32Type:
+		e.typeName = "Int32"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Int32, i int) { buf.putUint32(uint32(a.Value(i))) })
+	case *arrow.Int64Type:
+		e.typeName = "Int64"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Int64, i int) { buf.putUint64(uint64(a.Value(i))) })
+	case *arrow.Uint8Type:
+		e.typeName = "UInt8"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Uint8, i int) { buf.putUint8(a.Value(i)) })
+	case *arrow.Uint16Type:
+		e.typeName = "UInt16"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Uint16, i int) { buf.putUint16(a.Value(i)) })
+	case *arrow.Uint32Type:
+		e.typeName = "UInt32"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Uint32, i int) { buf.putUint32(a.Value(i)) })
+	case *arrow.Uint64Type:
+		e.typeName = "UInt64"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Uint64, i int) { buf.putUint64(a.Value(i)) })
+	case *arrow.Float32Type:
+		e.typeName = "Float32"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Float32, i int) { buf.putUint32(math.Float32bits(a.Value(i))) })
+	case *arrow.Float64Type:
+		e.typeName = "Float64"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Float64, i int) { buf.putUint64(math.Float64bits(a.Value(i))) })
+	case *arrow.StringType:
+		e.typeName = "String"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.String, i int) { buf.putString(a.Value(i)) })
+	case *arrow.LargeStringType:
+		e.typeName = "String"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.LargeString, i int) { buf.putString(a.Value(i)) })
+	case *arrow.BinaryType:
+		e.typeName = "String"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Binary, i int) { buf.putBytes(a.Value(i)) })
+	case *arrow.LargeBinaryType:
+		e.typeName = "String"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.LargeBinary, i int) { buf.putBytes(a.Value(i)) })
+	case *arrow.Date32Type:
+		e.typeName = "Date32"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Date32, i int) { buf.putUint32(uint32(a.Value(i))) })
+	case *arrow.Date64Type:
+		e.typeName = "Date32"
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Date64, i int) {
+			buf.putUint32(uint32(int64(a.Value(i)) / (24 * 3600 * 1000)))
+		})
+	case *arrow.TimestampType:
+		precision := map[arrow.TimeUnit]int{arrow.Second: 0, arrow.Millisecond: 3, arrow.Microsecond: 6, arrow.Nanosecond: 9}[t.Unit]
+		if t.TimeZone != "" {
+			e.typeName = fmt.Sprintf("DateTime64(%d, '%s')", precision, t.TimeZone)
+		} else {
+			e.typeName = fmt.Sprintf("DateTime64(%d)", precision)
+		}
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Timestamp, i int) { buf.putUint64(uint64(a.Value(i))) })
+	case *arrow.Decimal128Type:
+		e.typeName = fmt.Sprintf("Decimal(%d, %d)", t.Precision, t.Scale)
+		precision := t.Precision
+		e.encode = encodeFixed(func(buf *nativeBuffer, a *array.Decimal128, i int) {
+			v := a.Value(i)
+			switch {
+			case precision <= 9:
+				buf.putUint32(uint32(v.LowBits()))
+			case precision <= 18:
+				buf.putUint64(v.LowBits())
+			default:
+				buf.putUint64(v.LowBits())
+				buf.putUint64(uint64(v.HighBits()))
+			}
+		})
+	case *arrow.ListType, *arrow.LargeListType:
+		elem := dt.(arrow.ListLikeType).ElemField()
+		inner, err := newNativeColumnEncoder(elem.Type, elem.Nullable && canBeInsideNullable(elem.Type))
+		if err != nil {
+			return nil, err
+		}
+		e.typeName = "Array(" + inner.fullTypeName() + ")"
+		e.nullable = false
+		e.encode = func(buf *nativeBuffer, arr arrow.Array) error {
+			a := arr.(array.ListLike)
+			return encodeListLike(buf, a, func(start, end int64) error {
+				values := array.NewSlice(a.ListValues(), start, end)
+				defer values.Release()
+				return inner.write(buf, values)
+			})
+		}
+	case *arrow.MapType:
+		keyEncoder, err := newNativeColumnEncoder(t.KeyType(), false)
+		if err != nil {
+			return nil, err
+		}
+		item := t.ItemField()
+		itemEncoder, err := newNativeColumnEncoder(item.Type, item.Nullable && canBeInsideNullable(item.Type))
+		if err != nil {
+			return nil, err
+		}
+		e.typeName = fmt.Sprintf("Map(%s, %s)", keyEncoder.fullTypeName(), itemEncoder.fullTypeName())
+		e.nullable = false
+		e.encode = func(buf *nativeBuffer, arr arrow.Array) error {
+			a := arr.(*array.Map)
+			return encodeListLike(buf, a, func(start, end int64) error {
+				keys := array.NewSlice(a.Keys(), start, end)
+				defer keys.Release()
+				items := array.NewSlice(a.Items(), start, end)
+				defer items.Release()
+				if err := keyEncoder.write(buf, keys); err != nil {
+					return err
+				}
+				return itemEncoder.write(buf, items)
+			})
+		}
+	case *arrow.StructType:
+		fields := t.Fields()
+		encoders := make([]*nativeColumnEncoder, len(fields))
+		elements := make([]string, len(fields))
+		for i, f := range fields {
+			fe, err := newNativeColumnEncoder(f.Type, f.Nullable && canBeInsideNullable(f.Type))
+			if err != nil {
+				return nil, err
+			}
+			encoders[i] = fe
+			elements[i] = quoteClickhouseIdentifier(f.Name) + " " + fe.fullTypeName()
+		}
+		e.typeName = "Tuple(" + strings.Join(elements, ", ") + ")"
+		e.nullable = false
+		e.encode = func(buf *nativeBuffer, arr arrow.Array) error {
+			a := arr.(*array.Struct)
+			for i, fe := range encoders {
+				if err := fe.write(buf, a.Field(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case *arrow.DictionaryType, *arrow.Time32Type, *arrow.Time64Type, *arrow.MonthDayNanoIntervalType,
+		*arrow.DayTimeIntervalType, *arrow.MonthIntervalType, *arrow.DurationType, *arrow.FixedSizeBinaryType,
+		*arrow.Decimal256Type:
+		// clickhouse 没有对应类型的，以文本形式输出
+		e.typeName = "String"
+		e.encode = func(buf *nativeBuffer, arr arrow.Array) error {
+			for i := 0; i < arr.Len(); i++ {
+				if arr.IsNull(i) {
+					buf.putString("")
+				} else {
+					buf.putString(arr.ValueStr(i))
+				}
+			}
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported arrow type %s for Native format", dt)
+	}
+	return e, nil
+}
+
+func (e *nativeColumnEncoder) fullTypeName() string {
+	if e.nullable {
+		return "Nullable(" + e.typeName + ")"
+	}
+	return e.typeName
+}
+
+// canBeInsideNullable clickhouse 不允许 Nullable(Array/Map/Tuple)
+func canBeInsideNullable(dt arrow.DataType) bool {
+	switch dt.(type) {
+	case *arrow.ListType, *arrow.LargeListType, *arrow.MapType, *arrow.StructType:
+		return false
+	}
+	return true
+}
+
+var simpleIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func quoteClickhouseIdentifier(name string) string {
+	if simpleIdentifierRegexp.MatchString(name) {
+		return name
+	}
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+func encodeFixed[T arrow.Array](put func(buf *nativeBuffer, a T, i int)) func(buf *nativeBuffer, arr arrow.Array) error {
+	return func(buf *nativeBuffer, arr arrow.Array) error {
+		a := arr.(T)
+		for i := 0; i < a.Len(); i++ {
+			put(buf, a, i)
+		}
+		return nil
+	}
+}
+
+// encodeListLike 写入累计的 UInt64 offsets，然后写入所有元素
+func encodeListLike(buf *nativeBuffer, a array.ListLike, writeValues func(start, end int64) error) error {
+	if a.Len() == 0 {
+		return writeValues(0, 0)
+	}
+	first, _ := a.ValueOffsets(0)
+	var last int64
+	for i := 0; i < a.Len(); i++ {
+		_, last = a.ValueOffsets(i)
+		buf.putUint64(uint64(last - first))
+	}
+	return writeValues(first, last)
+}
+
+func newNativeFormatWriter(schema *arrow.Schema, writer io.Writer) (ClickhouseBlockWriter, error) {
+	fields := schema.Fields()
+	n := &NativeFormatWriter{
+		writer:   writer,
+		names:    make([]string, len(fields)),
+		encoders: make([]*nativeColumnEncoder, len(fields)),
+	}
+	for i, f := range fields {
+		e, err := newNativeColumnEncoder(f.Type, f.Nullable && canBeInsideNullable(f.Type))
+		if err != nil {
+			return nil, err
+		}
+		n.names[i] = f.Name
+		n.encoders[i] = e
+	}
+	return n, nil
+}
+
+type NativeFormatWriter struct {
+	writer   io.Writer
+	names    []string
+	encoders []*nativeColumnEncoder
+	buf      nativeBuffer
+}
+
+func (n *NativeFormatWriter) WriteBlock(rec arrow.Record) error {
+	if rec.NumRows() == 0 {
+		return nil
+	}
+	n.buf.b = n.buf.b[:0]
+	n.buf.putUvarint(uint64(rec.NumCols()))
+	n.buf.putUvarint(uint64(rec.NumRows()))
+	for i, col := range rec.Columns() {
+		n.buf.putString(n.names[i])
+		n.buf.putString(n.encoders[i].fullTypeName())
+		if err := n.encoders[i].write(&n.buf, col); err != nil {
+			return err
+		}
+	}
+	_, err := n.writer.Write(n.buf.b)
+	return err
+}
+
+func (n *NativeFormatWriter) Close() error {
+	return nil
+}
+
+// nativeColumnDecoder 读取 rows 行的列数据
+type nativeColumnDecoder func(r *bufio.Reader, rows int) ([]any, error)
+
+// 请求中的长度不可信：一个 block 的行数、一个数组列的元素总数和字符串长度有上限，
+// 数据按 nativeReadChunk 分块读取，分配的内存随实际读到的数据增长
+const (
+	nativeMaxRows         = 1 << 24
+	nativeMaxStringLength = 1 << 30
+	nativeReadChunk       = 64 << 10
+)
+
+// readNativeBytes 读取 n 字节，数据不足时返回错误而不是先分配 n 字节
+func readNativeBytes(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, 0, min(n, nativeReadChunk))
+	for len(buf) < n {
+		chunk := min(n-len(buf), nativeReadChunk)
+		buf = slices.Grow(buf, chunk)[:len(buf)+chunk]
+		if _, err := io.ReadFull(r, buf[len(buf)-chunk:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// checkNativeRows 检查行数或者数组的元素数
+func checkNativeRows(rows uint64) (int, error) {
+	if rows > nativeMaxRows {
+		return 0, fmt.Errorf("native block has %d rows or array elements, more than the limit %d", rows, nativeMaxRows)
+	}
+	return int(rows), nil
+}
+
+func readUvarintString(r *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if l > nativeMaxStringLength {
+		return "", fmt.Errorf("native string length %d is more than the limit %d", l, nativeMaxStringLength)
+	}
+	b, err := readNativeBytes(r, int(l))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodeFixed(size int, conv func(b []byte) any) nativeColumnDecoder {
+	return func(r *bufio.Reader, rows int) ([]any, error) {
+		if rows > 0 && size > math.MaxInt/rows {
+			return nil, fmt.Errorf("native column of %d rows with %d bytes each is too large", rows, size)
+		}
+		buf, err := readNativeBytes(r, size*rows)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]any, rows)
+		for i := range values {
+			values[i] = conv(buf[i*size : (i+1)*size])
+		}
+		return values, nil
+	}
+}
+
+// splitTypeArgs 按顶层逗号切分类型参数，忽略括号和引号内的逗号，clickhouse 和 duckdb 的类型名通用
+func splitTypeArgs(s string) []string {
+	var args []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case quote != 0:
+			if ch == '\\' && quote == '\'' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case ch == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		args = append(args, rest)
+	}
+	return args
+}
+
+// parseClickhouseTypeName 把 `Name(args)` 切分为 Name 和参数列表
+func parseClickhouseTypeName(typ string) (string, []string) {
+	typ = strings.TrimSpace(typ)
+	idx := strings.IndexByte(typ, '(')
+	if idx < 0 || !strings.HasSuffix(typ, ")") {
+		return typ, nil
+	}
+	return typ[:idx], splitTypeArgs(typ[idx+1 : len(typ)-1])
+}
+
+var nativeFixedDecoders = map[string]nativeColumnDecoder{
+	"Int8":    decodeFixed(1, func(b []byte) any { return int8(b[0]) }),
+	"UInt8":   decodeFixed(1, func(b []byte) any { return b[0] }),
+	"Bool":    decodeFixed(1, func(b []byte) any { return b[0] != 0 }),
+	"Int16":   decodeFixed(2, func(b []byte) any { return int16(binary.LittleEndian.Uint16(b)) }),
+	"UInt16":  decodeFixed(2, func(b []byte) any { return binary.LittleEndian.Uint16(b) }),
+	"Int32":   decodeFixed(4, func(b []byte) any { return int32(binary.LittleEndian.Uint32(b)) }),
+	"UInt32":  decodeFixed(4, func(b []byte) any { return binary.LittleEndian.Uint32(b) }),
+	"Int64":   decodeFixed(8, func(b []byte) any { return int64(binary.LittleEndian.Uint64(b)) }),
+	"UInt64":  decodeFixed(8, func(b []byte) any { return binary.LittleEndian.Uint64(b) }),
+	"Float32": decodeFixed(4, func(b []byte) any { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }),
+	"Float64": decodeFixed(8, func(b []byte) any { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }),
+	"Int128":  decodeFixed(16, func(b []byte) any { return littleEndianToBigInt(b, true) }),
+	"UInt128": decodeFixed(16, func(b []byte) any { return littleEndianToBigInt(b, false) }),
+	"Int256":  decodeFixed(32, func(b []byte) any { return littleEndianToBigInt(b, true) }),
+	"UInt256": decodeFixed(32, func(b []byte) any { return littleEndianToBigInt(b, false) }),
+	"Date": decodeFixed(2, func(b []byte) any {
+		return time.Unix(int64(binary.LittleEndian.Uint16(b))*24*3600, 0).UTC()
+	}),
+	"Date32": decodeFixed(4, func(b []byte) any {
+		return time.Unix(int64(int32(binary.LittleEndian.Uint32(b)))*24*3600, 0).UTC()
+	}),
+	"UUID": decodeFixed(16, func(b []byte) any {
+		var u duckdb.UUID
+		for i := 0; i < 8; i++ {
+			u[i] = b[7-i]
+			u[8+i] = b[15-i]
+		}
+		return u
+	}),
+	"String": func(r *bufio.Reader, rows int) ([]any, error) {
+		values := make([]any, 0, min(rows, nativeReadChunk))
+		for len(values) < rows {
+			s, err := readUvarintString(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	},
+	"Nothing": decodeFixed(1, func(b []byte) any { return nil }),
+}
+
+func littleEndianToBigInt(b []byte, signed bool) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if signed && be[0]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return v
+}
+
+func newNativeColumnDecoder(typ string) (nativeColumnDecoder, error) {
+	if d, ok := nativeFixedDecoders[strings.TrimSpace(typ)]; ok {
+		return d, nil
+	}
+	name, args := parseClickhouseTypeName(typ)
+	switch name {
+	case "Nullable":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		inner, err := newNativeColumnDecoder(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(r *bufio.Reader, rows int) ([]any, error) {
+			nullMap, err := readNativeBytes(r, rows)
+			if err != nil {
+				return nil, err
+			}
+			values, err := inner(r, rows)
+			if err != nil {
+				return nil, err
+			}
+			for i, isNull := range nullMap {
+				if isNull != 0 {
+					values[i] = nil
+				}
+			}
+			return values, nil
+		}, nil
+	case "Array":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		inner, err := newNativeColumnDecoder(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(r *bufio.Reader, rows int) ([]any, error) {
+			offsets, err := readNativeOffsets(r, rows)
+			if err != nil {
+				return nil, err
+			}
+			count, err := checkNativeRows(offsets[rows])
+			if err != nil {
+				return nil, err
+			}
+			elements, err := inner(r, count)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]any, rows)
+			for i := range values {
+				values[i] = elements[offsets[i]:offsets[i+1]]
+			}
+			return values, nil
+		}, nil
+	case "Map":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		keyDecoder, err := newNativeColumnDecoder(args[0])
+		if err != nil {
+			return nil, err
+		}
+		valueDecoder, err := newNativeColumnDecoder(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(r *bufio.Reader, rows int) ([]any, error) {
+			offsets, err := readNativeOffsets(r, rows)
+			if err != nil {
+				return nil, err
+			}
+			count, err := checkNativeRows(offsets[rows])
+			if err != nil {
+				return nil, err
+			}
+			keys, err := keyDecoder(r, count)
+			if err != nil {
+				return nil, err
+			}
+			items, err := valueDecoder(r, count)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]any, rows)
+			for i := range values {
+				m := duckdb.Map{}
+				for j := offsets[i]; j < offsets[i+1]; j++ {
+					m[keys[j]] = items[j]
+				}
+				values[i] = m
+			}
+			return values, nil
+		}, nil
+	case "Tuple":
+		names := make([]string, len(args))
+		decoders := make([]nativeColumnDecoder, len(args))
+		for i, arg := range args {
+			names[i] = strconv.Itoa(i + 1)
+			if idx := strings.IndexByte(arg, ' '); idx > 0 && !strings.Contains(arg[:idx], "(") {
+				names[i] = strings.Trim(arg[:idx], "`\"")
+				arg = arg[idx+1:]
+			}
+			d, err := newNativeColumnDecoder(arg)
+			if err != nil {
+				return nil, err
+			}
+			decoders[i] = d
+		}
+		return func(r *bufio.Reader, rows int) ([]any, error) {
+			// 先读完所有元素列，再按行组装
+			columns := make([][]any, len(decoders))
+			for j, d := range decoders {
+				elements, err := d(r, rows)
+				if err != nil {
+					return nil, err
+				}
+				columns[j] = elements
+			}
+			values := make([]any, rows)
+			for i := range values {
+				m := make(map[string]any, len(names))
+				for j, elements := range columns {
+					m[names[j]] = elements[i]
+				}
+				values[i] = m
+			}
+			return values, nil
+		}, nil
+	case "DateTime":
+		return decodeFixed(4, func(b []byte) any {
+			return time.Unix(int64(binary.LittleEndian.Uint32(b)), 0).UTC()
+		}), nil
+	case "DateTime64":
+		if len(args) < 1 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		precision, err := strconv.Atoi(args[0])
+		if err != nil || precision < 0 || precision > 9 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		scale := int64(math.Pow10(9 - precision))
+		return decodeFixed(8, func(b []byte) any {
+			return time.Unix(0, int64(binary.LittleEndian.Uint64(b))*scale).UTC()
+		}), nil
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		var precision, scale int
+		var err error
+		if name == "Decimal" {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("invalid type %s", typ)
+			}
+			precision, err = strconv.Atoi(args[0])
+			if err == nil {
+				scale, err = strconv.Atoi(args[1])
+			}
+		} else {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid type %s", typ)
+			}
+			precision = map[string]int{"Decimal32": 9, "Decimal64": 18, "Decimal128": 38, "Decimal256": 76}[name]
+			scale, err = strconv.Atoi(args[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		size := 32
+		switch {
+		case precision <= 9:
+			size = 4
+		case precision <= 18:
+			size = 8
+		case precision <= 38:
+			size = 16
+		}
+		return decodeFixed(size, func(b []byte) any {
+			return duckdb.Decimal{Width: uint8(precision), Scale: uint8(scale), Value: littleEndianToBigInt(b, true)}
+		}), nil
+	case "FixedString":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size <= 0 || size > nativeMaxStringLength {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		return decodeFixed(size, func(b []byte) any { return strings.TrimRight(string(b), "\x00") }), nil
+	case "Enum8", "Enum16":
+		names := make(map[int64]string, len(args))
+		for _, arg := range args {
+			idx := strings.LastIndexByte(arg, '=')
+			if idx < 0 {
+				return nil, fmt.Errorf("invalid type %s", typ)
+			}
+			v, err := strconv.ParseInt(strings.TrimSpace(arg[idx+1:]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid type %s", typ)
+			}
+			names[v] = strings.Trim(strings.TrimSpace(arg[:idx]), "'")
+		}
+		if name == "Enum8" {
+			return decodeFixed(1, func(b []byte) any { return names[int64(int8(b[0]))] }), nil
+		}
+		return decodeFixed(2, func(b []byte) any { return names[int64(int16(binary.LittleEndian.Uint16(b)))] }), nil
+	}
+	return nil, fmt.Errorf("unsupported clickhouse type %s for Native format", typ)
+}
+
+func readNativeOffsets(r *bufio.Reader, rows int) ([]uint64, error) {
+	buf, err := readNativeBytes(r, rows*8)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, rows+1)
+	for i := 0; i < rows; i++ {
+		offsets[i+1] = binary.LittleEndian.Uint64(buf[i*8:])
+		if offsets[i+1] < offsets[i] {
+			return nil, errors.New("invalid array offsets")
+		}
+	}
+	return offsets, nil
+}
+
+func newNativeFormatReader(columnNames, columnTypes []string, reader io.Reader, settings *FormatSettings) (ClickhouseFormatReader, error) {
+	rd, ok := reader.(*bufio.Reader)
+	if !ok {
+		rd = bufio.NewReader(reader)
+	}
+	columnIndex := make(map[string]int, len(columnNames))
+	for i, name := range columnNames {
+		columnIndex[name] = i
+	}
+	return &NativeFormatReader{
+		columns:     columnNames,
+		columnTypes: columnTypes,
+		columnIndex: columnIndex,
+		reader:      rd,
+	}, nil
+}
+
+// NativeFormatReader 按 block 解码，再逐行返回给 appender
+type NativeFormatReader struct {
+	columns     []string
+	columnTypes []string
+	columnIndex map[string]int
+	reader      *bufio.Reader
+	block       [][]any
+	rows        int
+	pos         int
+}
+
+func (n *NativeFormatReader) readBlock() error {
+	numColumns, err := binary.ReadUvarint(n.reader)
+	if err != nil {
+		return err
+	}
+	numRows, err := binary.ReadUvarint(n.reader)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	rows, err := checkNativeRows(numRows)
+	if err != nil {
+		return err
+	}
+	block := make([][]any, len(n.columns))
+	for i := uint64(0); i < numColumns; i++ {
+		name, err := readUvarintString(n.reader)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		typ, err := readUvarintString(n.reader)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		idx, ok := n.columnIndex[name]
+		if !ok {
+			return fmt.Errorf("column %s not found in table", name)
+		}
+		decoder, err := newNativeColumnDecoder(typ)
+		if err != nil {
+			return err
+		}
+		values, err := decoder(n.reader, rows)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		block[idx] = values
+	}
+	n.block = block
+	n.rows = rows
+	n.pos = 0
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (n *NativeFormatReader) Read(values []driver.Value) error {
+	if len(n.columns) != len(values) {
+		return errors.New("column length mismatch")
+	}
+	for n.pos >= n.rows {
+		if err := n.readBlock(); err != nil {
+			return err
+		}
+	}
+	var err error
+	for i, column := range n.block {
+		if column == nil {
+			values[i] = nil
+			continue
+		}
+		values[i], err = castToDuckType(column[n.pos], n.columnTypes[i])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", n.columns[i], err)
+		}
+	}
+	n.pos++
+	return nil
+}
+
+func (n *NativeFormatReader) Close() error {
+	return nil
+}
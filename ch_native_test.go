@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestNativeFormatRoundTrip(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ar, err := duckdb.NewArrowFromConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := ar.QueryContext(context.Background(), `select i::integer as a, 'v' || i as b, [i, i + 1] as c,
+       case when i % 2 = 0 then null else i * 1.5 end as d, timestamp '2024-01-02 03:04:05' as e
+from range(3000) t(i)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+
+	var buf bytes.Buffer
+	w, err := newNativeFormatWriter(reader.Schema(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := 0
+	for reader.Next() {
+		if err := w.WriteBlock(reader.Record()); err != nil {
+			t.Fatal(err)
+		}
+		blocks++
+	}
+	if blocks < 2 {
+		t.Errorf("expected result to be split into several blocks, got %d", blocks)
+	}
+
+	columnNames := []string{"a", "b", "c", "d", "e"}
+	columnTypes := []string{"BIGINT", "VARCHAR", "INTEGER[]", "DOUBLE", "TIMESTAMP"}
+	r, err := newNativeFormatReader(columnNames, columnTypes, &buf, defaultFormatSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]driver.Value, len(columnNames))
+	rows := 0
+	for {
+		err := r.Read(values)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows == 3 {
+			expected := []driver.Value{int64(3), "v3", []any{int32(3), int32(4)}, 4.5,
+				time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+			if !reflect.DeepEqual(values, expected) {
+				t.Errorf("unexpected row %v, expected %v", values, expected)
+			}
+		}
+		if rows == 4 && values[3] != nil {
+			t.Errorf("expected null, got %v", values[3])
+		}
+		rows++
+	}
+	if rows != 3000 {
+		t.Errorf("expected 3000 rows, got %d", rows)
+	}
+}
+
+func TestNativeFormatReaderLimits(t *testing.T) {
+	block := func(rows uint64, typ string, data func(n *nativeBuffer)) *nativeBuffer {
+		n := &nativeBuffer{}
+		n.putUvarint(1)
+		n.putUvarint(rows)
+		n.putString("a")
+		n.putString(typ)
+		data(n)
+		return n
+	}
+	for name, n := range map[string]*nativeBuffer{
+		"rows":         block(1<<40, "Int64", func(n *nativeBuffer) {}),
+		"string":       block(1, "String", func(n *nativeBuffer) { n.putUvarint(1 << 62) }),
+		"fixed string": block(1<<20, "FixedString(9223372036854775807)", func(n *nativeBuffer) {}),
+		"array":        block(1, "Array(Int64)", func(n *nativeBuffer) { n.putUint64(1 << 62) }),
+		"short read":   block(1000, "Int64", func(n *nativeBuffer) { n.putUint64(1) }),
+	} {
+		r, err := newNativeFormatReader([]string{"a"}, []string{"BIGINT"}, bytes.NewReader(n.b), defaultFormatSettings())
+		if err == nil {
+			err = r.Read(make([]driver.Value, 1))
+		}
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+var queryParamRegexp = regexp.MustCompile(`^\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*:\s*([^{}]+?)\s*\}`)
+
+// bindQueryParams 把 clickhouse 的 {name:Type} 占位符改写为 duckdb 的预编译参数 CAST(? AS T)，
+// 参数值来自 url 中的 param_name，按声明的类型转换。字符串、注释和带引号的标识符中的内容不处理
+func bindQueryParams(query string, params map[string]string) (string, []any, error) {
+	if !strings.Contains(query, "{") {
+		return query, nil, nil
+	}
+	var sb strings.Builder
+	var args []any
+	for i := 0; i < len(query); {
+		switch ch := query[i]; {
+		case ch == '\'' || ch == '"' || ch == '`':
+			end := skipQuoted(query, i)
+			sb.WriteString(query[i:end])
+			i = end
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			sb.WriteString(query[i : i+end])
+			i += end
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 2
+			} else {
+				end += 2
+			}
+			sb.WriteString(query[i : i+2+end])
+			i += 2 + end
+		case ch == '{':
+			m := queryParamRegexp.FindStringSubmatch(query[i:])
+			if m == nil {
+				// 不是占位符，例如 duckdb 的 struct 字面量
+				sb.WriteByte(ch)
+				i++
+				continue
+			}
+			expr, exprArgs, err := bindQueryParam(m[1], m[2], params)
+			if err != nil {
+				return "", nil, err
+			}
+			sb.WriteString(expr)
+			args = append(args, exprArgs...)
+			i += len(m[0])
+		default:
+			sb.WriteByte(ch)
+			i++
+		}
+	}
+	return sb.String(), args, nil
+}
+
+// skipQuoted 返回从 start 开始的引号内容结束后的位置，支持反斜杠转义和重复引号
+func skipQuoted(s string, start int) int {
+	quote := s[start]
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+func bindQueryParam(name, typ string, params map[string]string) (string, []any, error) {
+	value, ok := params[name]
+	if !ok {
+		return "", nil, fmt.Errorf("substitution `%s` is not set", name)
+	}
+	if typ == "Identifier" {
+		// 标识符不能作为参数绑定，加双引号转义后替换
+		return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`, nil, nil
+	}
+	t, nullable, err := duckTypeFromClickhouse(typ)
+	if err != nil {
+		return "", nil, fmt.Errorf("parameter %s: %w", name, err)
+	}
+	if nullable && value == `\N` {
+		return "CAST(NULL AS " + t.String() + ")", nil, nil
+	}
+	// 参数值使用 clickhouse 的 escaped 文本格式
+	var v any = value
+	if !isClickhouseComposite(t) {
+		v = unescapeClickhouseString(value)
+	}
+	v, err = t.cast(v)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot parse parameter %s as %s: %w", name, typ, err)
+	}
+	expr, args, err := duckParamExpr(v, t)
+	if err != nil {
+		return "", nil, fmt.Errorf("parameter %s: %w", name, err)
+	}
+	return expr, args, nil
+}
+
+// duckParamExpr 驱动只能绑定标量，复合类型展开为 [..]、{..}、MAP {..} 表达式，每个标量单独绑定
+func duckParamExpr(v any, t *duckType) (string, []any, error) {
+	switch val := v.(type) {
+	case nil:
+		return "CAST(NULL AS " + t.String() + ")", nil, nil
+	case []any:
+		elements := make([]string, len(val))
+		var args []any
+		for i, e := range val {
+			expr, exprArgs, err := duckParamExpr(e, t.children[0])
+			if err != nil {
+				return "", nil, err
+			}
+			elements[i] = expr
+			args = append(args, exprArgs...)
+		}
+		return "CAST([" + strings.Join(elements, ", ") + "] AS " + t.String() + ")", args, nil
+	case map[string]any:
+		elements := make([]string, len(t.names))
+		var args []any
+		for i, name := range t.names {
+			expr, exprArgs, err := duckParamExpr(val[name], t.children[i])
+			if err != nil {
+				return "", nil, err
+			}
+			elements[i] = quoteSqlString(name) + ": " + expr
+			args = append(args, exprArgs...)
+		}
+		return "CAST({" + strings.Join(elements, ", ") + "} AS " + t.String() + ")", args, nil
+	case duckdb.Map:
+		elements := make([]string, 0, len(val))
+		var args []any
+		for k, e := range val {
+			keyExpr, keyArgs, err := duckParamExpr(k, t.children[0])
+			if err != nil {
+				return "", nil, err
+			}
+			valueExpr, valueArgs, err := duckParamExpr(e, t.children[1])
+			if err != nil {
+				return "", nil, err
+			}
+			elements = append(elements, keyExpr+": "+valueExpr)
+			args = append(append(args, keyArgs...), valueArgs...)
+		}
+		return "CAST(MAP {" + strings.Join(elements, ", ") + "} AS " + t.String() + ")", args, nil
+	case bool, int8, int16, int32, int64, uint8, uint16, uint32, uint64, float32, float64, string, time.Time:
+		return "CAST(? AS " + t.String() + ")", []any{v}, nil
+	}
+	// DECIMAL、HUGEINT 等以文本绑定，由 duckdb 转换
+	text, err := formatDuckText(v, t, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return "CAST(? AS " + t.String() + ")", []any{text}, nil
+}
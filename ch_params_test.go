@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBindQueryParams(t *testing.T) {
+	params := map[string]string{"id": "42", "name": `it's\ta`, "ids": "[1,2]", "tbl": `a"b`}
+	query, args, err := bindQueryParams(
+		"SELECT '{id:UInt8}', {id:UInt8}, {name:String} /* {x:y} */ FROM {tbl:Identifier} WHERE list_contains({ids:Array(Int32)}, 1) AND {'k': 1} IS NOT NULL", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT '{id:UInt8}', CAST(? AS UTINYINT), CAST(? AS VARCHAR) /* {x:y} */ FROM \"a\"\"b\" " +
+		"WHERE list_contains(CAST([CAST(? AS INTEGER), CAST(? AS INTEGER)] AS INTEGER[]), 1) AND {'k': 1} IS NOT NULL"
+	if query != expected {
+		t.Errorf("unexpected query %q", query)
+	}
+	if !reflect.DeepEqual(args, []any{uint8(42), "it's\ta", int32(1), int32(2)}) {
+		t.Errorf("unexpected args %#v", args)
+	}
+
+	if _, _, err = bindQueryParams("SELECT {missing:String}", params); err == nil {
+		t.Error("expected error for missing parameter")
+	}
+	if _, _, err = bindQueryParams("SELECT {name:Int32}", params); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
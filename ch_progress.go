@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressExceptionCode 进度头已经发出后查询出错时的 X-ClickHouse-Exception-Code，对应 clickhouse 的 STD_EXCEPTION
+const progressExceptionCode = 1001
+
+// chProgress 一次请求的执行进度。输出的结果行数、字节数和写入的行数由各个格式统计，
+// 读取的行数来自 duckdb_query_progress，只在 send_progress_in_http_headers=1 时轮询，是最后一次读到的值
+type chProgress struct {
+	start       time.Time
+	resultRows  atomic.Int64
+	resultBytes atomic.Int64
+	writtenRows atomic.Int64
+	readRows    atomic.Int64
+	totalRows   atomic.Int64
+
+	// mu 保护 source，读取进度时连接不能被释放
+	mu     sync.Mutex
+	source *duckdbProgress
+	// baseRows/baseTotal 同一个请求中已经结束的语句的行数
+	baseRows  int64
+	baseTotal int64
+}
+
+func newChProgress() *chProgress {
+	return &chProgress{start: time.Now()}
+}
+
+func (p *chProgress) AddResultRows(n int64) {
+	if p != nil {
+		p.resultRows.Add(n)
+	}
+}
+
+func (p *chProgress) AddWrittenRows(n int64) {
+	if p != nil {
+		p.writtenRows.Add(n)
+	}
+}
+
+func (p *chProgress) AddResultBytes(n int64) {
+	if p != nil {
+		p.resultBytes.Add(n)
+	}
+}
+
+func (p *chProgress) ResultBytes() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.resultBytes.Load()
+}
+
+func (p *chProgress) ResultRows() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.resultRows.Load()
+}
+
+func (p *chProgress) WrittenRows() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.writtenRows.Load()
+}
+
+func (p *chProgress) ReadRows() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.readRows.Load()
+}
+
+// Watch 开始读取连接上正在执行的查询的进度
+func (p *chProgress) Watch(source *duckdbProgress) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.source = source
+	p.mu.Unlock()
+}
+
+// Unwatch 连接释放之前停止读取进度，保留最后读到的行数
+func (p *chProgress) Unwatch() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.source == nil {
+		return
+	}
+	p.pollLocked()
+	p.source = nil
+	p.baseRows, p.baseTotal = p.readRows.Load(), p.totalRows.Load()
+}
+
+// Poll 读取一次当前语句的进度
+func (p *chProgress) Poll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.source != nil {
+		p.pollLocked()
+	}
+}
+
+func (p *chProgress) pollLocked() {
+	rows, total, ok := p.source.Read()
+	if !ok {
+		return
+	}
+	p.readRows.Store(max(p.readRows.Load(), p.baseRows+rows))
+	p.totalRows.Store(max(p.totalRows.Load(), p.baseTotal+total))
+}
+
+func (p *chProgress) String() string {
+	return p.format(p.resultBytes.Load())
+}
+
+// format clickhouse 的 X-ClickHouse-Progress/X-ClickHouse-Summary 格式，数值以字符串表示，只包含实际统计的字段
+func (p *chProgress) format(resultBytes int64) string {
+	return fmt.Sprintf(`{"read_rows":"%d","written_rows":"%d","total_rows_to_read":"%d","result_rows":"%d","result_bytes":"%d","elapsed_ns":"%d"}`,
+		p.readRows.Load(), p.writtenRows.Load(), p.totalRows.Load(), p.resultRows.Load(), resultBytes, time.Since(p.start).Nanoseconds())
+}
+
+// progressResponseWriter send_progress_in_http_headers=1 时按 http_headers_progress_interval_ms 发送 X-ClickHouse-Progress。
+// net/http 只能一次写出全部响应头，所以第一次有进度时接管连接，和 clickhouse 一样先写出状态行，
+// 在结果开始之前逐个写出进度头。之后查询出错时状态码已经是 200，改为发送 X-ClickHouse-Exception-Code。
+// 查询结束时才写出的响应头(wait_end_of_query=1 或没有结果)带 X-ClickHouse-Summary，
+// 否则结果开始时查询还没有结束，X-ClickHouse-Summary 作为 trailer 在结果之后发送
+type progressResponseWriter struct {
+	wr       http.ResponseWriter
+	progress *chProgress
+	header   http.Header
+	// sent 接管连接时已经写出的响应头
+	sent http.Header
+	// hijack 请求体已经读完，可以接管连接
+	hijack bool
+	// http11 可以使用 chunked 和 trailer
+	http11   bool
+	mu       sync.Mutex
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	last     string
+	started  bool
+	chunked  bool
+	trailer  bool
+	closed   bool
+	done     chan struct{}
+	interval time.Duration
+}
+
+func newProgressResponseWriter(wr http.ResponseWriter, r *http.Request, progress *chProgress, interval time.Duration) *progressResponseWriter {
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	pw := &progressResponseWriter{wr: wr, progress: progress, header: wr.Header().Clone(), sent: wr.Header().Clone(),
+		hijack: r.ProtoAtLeast(1, 1), http11: r.ProtoAtLeast(1, 1), done: make(chan struct{}), interval: interval}
+	go pw.run()
+	return pw
+}
+
+// KeepBody 请求体在查询执行时还要读取(INSERT ... FORMAT)，不能接管连接，只发送 X-ClickHouse-Summary
+func (pw *progressResponseWriter) KeepBody() {
+	pw.mu.Lock()
+	pw.hijack = false
+	pw.mu.Unlock()
+}
+
+func (pw *progressResponseWriter) run() {
+	ticker := time.NewTicker(pw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pw.done:
+			return
+		case <-ticker.C:
+			pw.progress.Poll()
+			pw.mu.Lock()
+			if !pw.started {
+				pw.sendProgress()
+			}
+			pw.mu.Unlock()
+		}
+	}
+}
+
+// sendProgress 进度变化时写出一个 X-ClickHouse-Progress，第一次写出时接管连接
+func (pw *progressResponseWriter) sendProgress() {
+	if pw.progress.ReadRows() == 0 && pw.progress.WrittenRows() == 0 {
+		return
+	}
+	progress := pw.progress.String()
+	// 只比较行数，不比较耗时
+	key := progress[:strings.Index(progress, `"elapsed_ns"`)]
+	if key == pw.last {
+		return
+	}
+	if pw.conn == nil {
+		if !pw.hijack {
+			return
+		}
+		hijacker, ok := pw.wr.(http.Hijacker)
+		if !ok {
+			pw.hijack = false
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			pw.hijack = false
+			return
+		}
+		pw.conn, pw.rw = conn, rw
+		_, _ = rw.WriteString("HTTP/1.1 200 OK\r\n")
+		_ = pw.sent.Write(rw)
+	}
+	pw.last = key
+	_, _ = fmt.Fprintf(pw.rw, "X-ClickHouse-Progress: %s\r\n", progress)
+	_ = pw.rw.Flush()
+}
+
+func (pw *progressResponseWriter) Header() http.Header {
+	return pw.header
+}
+
+func (pw *progressResponseWriter) Write(p []byte) (int, error) {
+	pw.WriteHeader(200)
+	var n int
+	var err error
+	switch {
+	case pw.conn == nil:
+		n, err = pw.wr.Write(p)
+	case len(p) == 0:
+	case pw.chunked:
+		_, _ = fmt.Fprintf(pw.rw, "%x\r\n", len(p))
+		n, err = pw.rw.Write(p)
+		_, _ = pw.rw.WriteString("\r\n")
+	default:
+		n, err = pw.rw.Write(p)
+	}
+	pw.progress.resultBytes.Add(int64(n))
+	return n, err
+}
+
+// WriteHeader wait_end_of_query=1 时由缓存在查询结束后调用，此时 Content-Length 就是结果的大小
+func (pw *progressResponseWriter) WriteHeader(status int) {
+	pw.writeHeader(status, false)
+}
+
+func (pw *progressResponseWriter) writeHeader(status int, finished bool) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.started {
+		return
+	}
+	pw.started = true
+	resultBytes := pw.progress.resultBytes.Load()
+	length, err := strconv.ParseInt(pw.header.Get("Content-Length"), 10, 64)
+	if err == nil {
+		resultBytes = length
+		finished = true
+	}
+	if pw.conn == nil {
+		header := pw.wr.Header()
+		for k, v := range pw.header {
+			header[k] = v
+		}
+		// 出错的请求不发送 X-ClickHouse-Summary
+		switch {
+		case status != 200:
+		case finished:
+			header.Set("X-ClickHouse-Summary", pw.progress.format(resultBytes))
+		case pw.http11:
+			header.Set("Trailer", "X-ClickHouse-Summary")
+			pw.trailer = true
+		}
+		pw.wr.WriteHeader(status)
+		return
+	}
+	header := http.Header{}
+	for k, v := range pw.header {
+		if _, ok := pw.sent[k]; !ok {
+			header[k] = v
+		}
+	}
+	if status != 200 {
+		header.Set("X-ClickHouse-Exception-Code", strconv.Itoa(progressExceptionCode))
+		header.Del("Content-Length")
+		finished = false
+	}
+	switch {
+	case finished:
+		header.Set("X-ClickHouse-Summary", pw.progress.format(resultBytes))
+	case header.Get("Content-Length") == "":
+		header.Set("Transfer-Encoding", "chunked")
+		pw.chunked = true
+		if status == 200 {
+			header.Set("Trailer", "X-ClickHouse-Summary")
+			pw.trailer = true
+		}
+	}
+	header.Set("Connection", "close")
+	_ = header.Write(pw.rw)
+	_, _ = pw.rw.WriteString("\r\n")
+}
+
+// Close 请求结束时写出还没有写出的响应头或 trailer，接管连接时关闭连接
+func (pw *progressResponseWriter) Close() {
+	pw.writeHeader(200, true)
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.closed {
+		return
+	}
+	pw.closed = true
+	close(pw.done)
+	summary := pw.progress.String()
+	if pw.conn == nil {
+		if pw.trailer {
+			pw.wr.Header().Set("X-ClickHouse-Summary", summary)
+		}
+		return
+	}
+	switch {
+	case pw.trailer:
+		_, _ = fmt.Fprintf(pw.rw, "0\r\nX-ClickHouse-Summary: %s\r\n\r\n", summary)
+	case pw.chunked:
+		_, _ = pw.rw.WriteString("0\r\n\r\n")
+	}
+	_ = pw.rw.Flush()
+	_ = pw.conn.Close()
+}
+
+// progressFormatReader 统计写入的行数
+type progressFormatReader struct {
+	ClickhouseFormatReader
+	progress *chProgress
+}
+
+func (r *progressFormatReader) Read(values []driver.Value) error {
+	err := r.ClickhouseFormatReader.Read(values)
+	if err == nil {
+		r.progress.AddWrittenRows(1)
+	}
+	return err
+}
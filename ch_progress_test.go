@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestBufferedResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	progress := newChProgress()
+	pw := newProgressResponseWriter(rec, httptest.NewRequest("GET", "/", nil), progress, time.Millisecond)
+	bw := newBufferedResponseWriter(pw, 16)
+	bw.WriteHeader(200)
+	for i := 0; i < 10; i++ {
+		_, _ = fmt.Fprintf(bw, "row %d\n", i)
+	}
+	if bw.file == nil {
+		t.Fatal("expected buffer to spill to disk")
+	}
+	name := bw.file.Name()
+	progress.AddResultRows(10)
+	bw.Flush()
+	pw.Close()
+	if rec.Body.Len() != 60 || rec.Header().Get("Content-Length") != "60" {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+	if len(rec.Header().Values("X-ClickHouse-Progress")) != 0 ||
+		!strings.Contains(rec.Header().Get("X-ClickHouse-Summary"), `"result_rows":"10","result_bytes":"60"`) {
+		t.Errorf("unexpected progress headers %v", rec.Header())
+	}
+	if bw.file != nil || fileExists(name) {
+		t.Error("expected spill file to be removed")
+	}
+
+	// 出错时丢弃已经缓存的结果
+	rec = httptest.NewRecorder()
+	bw = newBufferedResponseWriter(rec, 4)
+	_, _ = fmt.Fprint(bw, "partial result")
+	writeStreamError(bw, "Error: %s", "boom")
+	bw.Flush()
+	if rec.Code != 500 || rec.Body.String() != "Error: boom" {
+		t.Errorf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func TestProgressHeaders(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE big AS SELECT range AS a FROM range(50000000)"); err != nil {
+		t.Fatal(err)
+	}
+	c := &ChServer{conn: db, pgServer: &PgServer{}, sessions: newChSessionManager(db), queries: newQueryRegistry()}
+	server := httptest.NewServer(http.HandlerFunc(c.ServeHTTP))
+	defer server.Close()
+	query := func(query, settings string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/?send_progress_in_http_headers=1&http_headers_progress_interval_ms=5"+settings, strings.NewReader(query))
+		req.Header.Set("token", AuthToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// 进度头在结果之前发送，读取的行数来自 duckdb，查询结束的 X-ClickHouse-Summary 在结果之后作为 trailer 发送
+	resp := query("SELECT sum(a * a % 7) FROM big", "")
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	progress := resp.Header.Values("X-ClickHouse-Progress")
+	if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != "99999998" || len(progress) == 0 {
+		t.Fatalf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if !strings.Contains(progress[len(progress)-1], `"total_rows_to_read":"5000000`) || strings.Contains(progress[0], `"read_rows":"0"`) {
+		t.Errorf("unexpected progress %v", progress)
+	}
+	if resp.Header.Get("X-ClickHouse-Summary") != "" || !strings.Contains(resp.Trailer.Get("X-ClickHouse-Summary"), `"result_rows":"1"`) {
+		t.Errorf("unexpected summary %v %v", resp.Header, resp.Trailer)
+	}
+
+	// wait_end_of_query=1 时查询结束后才写出剩余的响应头，X-ClickHouse-Summary 在响应头中
+	resp = query("SELECT count(*) FROM big WHERE a % 3 = 0", "&wait_end_of_query=1")
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != "16666667" || len(resp.Header.Values("X-ClickHouse-Progress")) == 0 ||
+		!strings.Contains(resp.Header.Get("X-ClickHouse-Summary"), `"result_rows":"1"`) || strings.Contains(resp.Header.Get("X-ClickHouse-Summary"), `"read_rows":"0"`) {
+		t.Errorf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	// 进度头发出后出错，状态码已经是 200，用 X-ClickHouse-Exception-Code 表示
+	resp = query("SELECT sum(a) // (a - 49999999) FROM big GROUP BY a ORDER BY 1", "&wait_end_of_query=1&max_execution_time=0.3")
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("X-ClickHouse-Exception-Code") != "1001" || !strings.Contains(string(body), "Timeout exceeded") {
+		t.Errorf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp.Header.Get("X-ClickHouse-Summary") != "" || resp.Trailer.Get("X-ClickHouse-Summary") != "" {
+		t.Errorf("failed query must not send a summary %v %v", resp.Header, resp.Trailer)
+	}
+}
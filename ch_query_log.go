@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// queryLogMaxExceptionLength 记录的错误信息长度上限
+const queryLogMaxExceptionLength = 4096
+
+// queryLogWriter 统计一条语句输出的字节数并截取错误信息，语句结束时写入 query_log
+type queryLogWriter struct {
+	wr        http.ResponseWriter
+	bytes     int64
+	failed    bool
+	exception []byte
+}
+
+func (lw *queryLogWriter) Header() http.Header {
+	return lw.wr.Header()
+}
+
+func (lw *queryLogWriter) Write(p []byte) (int, error) {
+	if lw.failed {
+		lw.appendException(p)
+	} else {
+		lw.bytes += int64(len(p))
+	}
+	return lw.wr.Write(p)
+}
+
+func (lw *queryLogWriter) WriteHeader(status int) {
+	if status >= 400 && !lw.failed {
+		lw.failed = true
+		lw.exception = lw.exception[:0]
+	}
+	lw.wr.WriteHeader(status)
+}
+
+// fail 已经输出结果后出错，错误信息和结果混在一起，单独记录
+func (lw *queryLogWriter) fail(message string) {
+	lw.failed = true
+	lw.exception = lw.exception[:0]
+	lw.appendException([]byte(message))
+}
+
+func (lw *queryLogWriter) appendException(p []byte) {
+	if n := queryLogMaxExceptionLength - len(lw.exception); n > 0 {
+		if len(p) > n {
+			p = p[:n]
+		}
+		lw.exception = append(lw.exception, p...)
+	}
+}
+
+// logStatement 返回记录语句的 writer，语句结束时调用返回的函数写入 query_log 和指标。
+// 多条语句共用一个请求的进度，按语句开始时的进度计算差值
+func (c *ChServer) logStatement(query string, settings *QuerySettings, wr http.ResponseWriter) (http.ResponseWriter, func()) {
+	if c.queryLog == nil && c.metrics == nil {
+		return wr, func() {}
+	}
+	start := time.Now()
+	resultRows, writtenRows := settings.Progress.ResultRows(), settings.Progress.WrittenRows()
+	lw := &queryLogWriter{wr: wr}
+	return lw, func() {
+		entry := &queryLogEntry{
+			EventTime:   time.Now(),
+			QueryID:     settings.QueryID,
+			User:        settings.User,
+			Protocol:    "http",
+			Query:       query,
+			Duration:    time.Since(start),
+			ResultRows:  settings.Progress.ResultRows() - resultRows,
+			WrittenRows: settings.Progress.WrittenRows() - writtenRows,
+			ResultBytes: lw.bytes,
+		}
+		if lw.failed {
+			entry.Exception = string(lw.exception)
+			if entry.Exception == "" {
+				entry.Exception = "Unknown error"
+			}
+		}
+		c.metrics.ObserveQuery(entry)
+		c.queryLog.Record(entry)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// reportLine /report 请求体中的一个事件，Line 为 JSON 数组中的序号或者 NDJSON 的行号，从 1 开始
+type reportLine struct {
+	Line int
+	Body string
+	Err  error
+}
+
+// reportResult 批量 /report 中一个事件的结果
+type reportResult struct {
+	Line   int    `json:"line"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// splitReportBody 把请求体拆分为事件：JSON 数组的每个元素，或者 NDJSON 的每个非空行。
+// 只有一个 JSON 对象时 batch 为 false，和以前一样只返回状态码
+func splitReportBody(body string) ([]reportLine, bool) {
+	trimmed := strings.TrimSpace(body)
+	if strings.HasPrefix(trimmed, "[") {
+		return splitReportArray(trimmed), true
+	}
+	var lines []reportLine
+	for i, line := range strings.Split(body, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, reportLine{Line: i + 1, Body: line})
+		}
+	}
+	// 格式化过的单个对象有多行
+	if len(lines) <= 1 || json.Valid([]byte(trimmed)) {
+		return []reportLine{{Line: 1, Body: body}}, false
+	}
+	return lines, true
+}
+
+// splitReportArray JSON 数组语法错误时，之前的元素仍然有效，之后无法拆分的内容记为一个错误
+func splitReportArray(body string) []reportLine {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	_, _ = decoder.Token()
+	var lines []reportLine
+	invalid := func(err error) []reportLine {
+		rest := strings.TrimLeft(body[min(int(decoder.InputOffset()), len(body)):], ", \t\r\n")
+		return append(lines, reportLine{Line: len(lines) + 1, Body: rest, Err: fmt.Errorf("invalid json array: %w", err)})
+	}
+	for decoder.More() {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return invalid(err)
+		}
+		lines = append(lines, reportLine{Line: len(lines) + 1, Body: string(raw)})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return invalid(err)
+	}
+	if decoder.More() {
+		return invalid(fmt.Errorf("unexpected data after the array"))
+	}
+	return lines
+}
+
+// writeReportResults 全部成功时返回 200，部分成功时返回 207，全部失败时返回 400，有写入错误时返回 500
+func writeReportResults(wr http.ResponseWriter, results []reportResult, insertFailed bool) {
+	accepted, duplicates := 0, 0
+	for _, r := range results {
+		switch r.Status {
+		case "ok":
+			accepted++
+		case "duplicate":
+			accepted++
+			duplicates++
+		}
+	}
+	status := 200
+	switch {
+	case accepted == len(results):
+	case accepted > 0:
+		status = 207
+	case insertFailed:
+		status = 500
+	default:
+		status = 400
+	}
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	wr.WriteHeader(status)
+	body := map[string]any{
+		"accepted": accepted,
+		"rejected": len(results) - accepted,
+		"results":  results,
+	}
+	// 重复的事件也算作接受，duplicates 只在有重复时返回
+	if duplicates > 0 {
+		body["duplicates"] = duplicates
+	}
+	_ = json.NewEncoder(wr).Encode(body)
+}
+
+// ReplayDeadLetters /report/replay 重新写入死信，business_id 参数只重放一个表，limit 参数为最多重放的条数
+func (c *ChServer) ReplayDeadLetters(r *http.Request, settings *QuerySettings, wr http.ResponseWriter) {
+	if r.Method != http.MethodPost {
+		wr.WriteHeader(405)
+		fmt.Fprint(wr, "replay requires POST")
+		return
+	}
+	if settings.Readonly > 0 {
+		wr.WriteHeader(403)
+		fmt.Fprint(wr, "Error replaying dead letters: readonly mode")
+		return
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil {
+			wr.WriteHeader(400)
+			fmt.Fprintf(wr, "Invalid limit: %s", err)
+			return
+		}
+	}
+	results, err := c.reports.Replay(r.Context(), r.URL.Query().Get("business_id"), limit)
+	if err != nil {
+		wr.WriteHeader(500)
+		fmt.Fprintf(wr, "Error replaying dead letters: %s", err)
+		return
+	}
+	replayed := 0
+	for _, r := range results {
+		if r.Status == "ok" {
+			replayed++
+		}
+	}
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_ = json.NewEncoder(wr).Encode(map[string]any{
+		"replayed": replayed,
+		"failed":   len(results) - replayed,
+		"results":  results,
+	})
+}
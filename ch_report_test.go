@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestReportBatch(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	c := &ChServer{conn: db, pgServer: &PgServer{}, reports: newReportBuffers(db, ReportOptions{FlushInterval: 10 * time.Millisecond}, nil)}
+	defer c.reports.Close()
+
+	report := func(body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(body))
+		req.Header.Set("token", AuthToken)
+		req.Header.Set("business_id", "events")
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	for _, c := range []struct {
+		body   string
+		code   int
+		result string
+	}{
+		{`{"a":1}`, 200, ``},
+		{"{\n  \"a\": 2\n}", 200, ``},
+		{`{"a":`, 400, `body data is not json format: unexpected EOF`},
+		{`[{"a":3},1,{"a":4}]`, 207, `{"accepted":2,"rejected":1,"results":[{"line":1,"status":"ok"},{"line":2,"status":"error","error":"body data is not a json object"},{"line":3,"status":"ok"}]}`},
+		{`[{"a":5},{"a"`, 207, `{"accepted":1,"rejected":1,"results":[{"line":1,"status":"ok"},{"line":2,"status":"error","error":"invalid json array: unexpected EOF"}]}`},
+		{"{\"a\":6}\n\n{\"a\":\n{\"a\":7}\n", 207, `{"accepted":2,"rejected":1,"results":[{"line":1,"status":"ok"},{"line":3,"status":"error","error":"body data is not json format: unexpected EOF"},{"line":4,"status":"ok"}]}`},
+		{"x\nnull", 400, `{"accepted":0,"rejected":2,"results":[{"line":1,"status":"error","error":"body data is not json format: invalid character 'x' looking for beginning of value"},{"line":2,"status":"error","error":"body data is not a json object"}]}`},
+	} {
+		if code, result := report(c.body); code != c.code || result != c.result {
+			t.Errorf("%q: got %d %s", c.body, code, result)
+		}
+	}
+	var count, sum int
+	if err = db.QueryRow("SELECT count(*), sum(a) FROM events").Scan(&count, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if count != 7 || sum != 28 {
+		t.Errorf("unexpected rows %d %d", count, sum)
+	}
+}
+
+func TestReportDeadLetters(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	policies := ReportTypePolicies{}
+	_ = policies.ForbidWidening("events")
+	reports := newReportBuffers(db, ReportOptions{FlushInterval: 10 * time.Millisecond, TypePolicies: policies, DeadLetters: true}, nil)
+	if err = reports.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer reports.Close()
+	c := &ChServer{conn: db, pgServer: &PgServer{}, reports: reports}
+
+	post := func(path, businessID, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("token", AuthToken)
+		req.Header.Set("business_id", businessID)
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	post("/report", "events", `{"n":1}`)
+	post("/report", "events", `[{"n":"x"},{"n":2},{"n"`)
+	post("/report", "", `{"n":3}`)
+	letters := func() string {
+		var s string
+		if err := db.QueryRow(`SELECT string_agg(concat_ws('|', business_id, payload, attempts), ',' ORDER BY id) FROM duckserver.dead_letters`).Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if got := letters(); got != `events|{"n"|0,events|{"n":"x"}|0,|{"n":3}|0` {
+		t.Errorf("unexpected dead letters %s", got)
+	}
+
+	// 修复表结构后重放，仍然失败的死信增加重试次数
+	if _, err = db.Exec("ALTER TABLE events ALTER COLUMN n TYPE VARCHAR"); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := post("/report/replay?business_id=events", "", ""); code != 200 || !strings.HasPrefix(body, `{"failed":1,"replayed":1,`) {
+		t.Errorf("unexpected replay %d %s", code, body)
+	}
+	if got := letters(); got != `events|{"n"|1,|{"n":3}|0` {
+		t.Errorf("unexpected dead letters after replay %s", got)
+	}
+	var values string
+	if err = db.QueryRow(`SELECT string_agg(n, ',' ORDER BY n) FROM events`).Scan(&values); err != nil {
+		t.Fatal(err)
+	}
+	if values != "1,2,x" {
+		t.Errorf("unexpected values %s", values)
+	}
+}
+
+func TestReportDedup(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	keys := ReportDedupKeys{}
+	for _, key := range []string{"events=$.data.report_id", "clicks=header:Idempotency-Key"} {
+		if err = keys.Set(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys.Set("events=report_id") == nil {
+		t.Error("expected invalid dedup key error")
+	}
+	c := &ChServer{conn: db, pgServer: &PgServer{}, reports: newReportBuffers(db, ReportOptions{FlushInterval: 10 * time.Millisecond, DedupKeys: keys}, nil)}
+	defer c.reports.Close()
+
+	post := func(businessID, idempotencyKey, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(body))
+		req.Header.Set("token", AuthToken)
+		req.Header.Set("business_id", businessID)
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	for _, c := range []struct {
+		table, key, body string
+		code             int
+		result           string
+	}{
+		{"events", "", `{"n":1,"data":"{\"report_id\":\"a\"}"}`, 200, ``},
+		{"events", "", `{"n":2,"data":"{\"report_id\":\"a\"}"}`, 200, ``},
+		{"events", "", `[{"n":3,"data":{"report_id":"b"}},{"n":4,"data":{"report_id":"b"}},{"n":5}]`, 200, `{"accepted":3,"duplicates":1,"rejected":0,"results":[{"line":1,"status":"ok"},{"line":2,"status":"duplicate"},{"line":3,"status":"ok"}]}`},
+		{"clicks", "k1", `{"n":1}`, 200, ``},
+		{"clicks", "k1", `{"n":2}`, 200, ``},
+		{"clicks", "k2", `{"n":3}`, 200, ``},
+		{"clicks", "", `{"n":4}`, 200, ``},
+	} {
+		if code, result := post(c.table, c.key, c.body); code != c.code || result != c.result {
+			t.Errorf("%s %q: got %d %s", c.table, c.body, code, result)
+		}
+	}
+	for table, want := range map[string]string{"events": "1,3,5", "clicks": "1,3,4"} {
+		var values string
+		if err = db.QueryRow(`SELECT string_agg(n, ',' ORDER BY n) FROM ` + table).Scan(&values); err != nil {
+			t.Fatal(err)
+		}
+		if values != want {
+			t.Errorf("unexpected %s rows %s", table, values)
+		}
+	}
+
+	// 不等待写入时，后台写入失败的事件同样删除去重键
+	if key, duplicate := c.reports.Dedup("clicks", "{}", func(string) string { return "k3" }, 0, false); duplicate {
+		t.Fatal("unexpected duplicate k3")
+	} else if errs := c.reports.AddMany(context.Background(), "clicks", []map[string]any{{}}, []string{"{}"}, []string{key}, false); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c.reports.dedup.Seen("clicks", "k3") {
+		t.Error("expected k3 to be forgotten after the failed flush")
+	}
+
+	d := newReportDedup(20*time.Millisecond, 0)
+	if d.Seen("t", "k") || !d.Seen("T", "k") {
+		t.Error("expected k to be seen once")
+	}
+	d.Forget("t", "k")
+	if d.Seen("t", "k") {
+		t.Error("expected k to be forgotten")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if d.Seen("t", "k") {
+		t.Error("expected k to expire")
+	}
+
+	// 超过 maxKeys 时丢弃最早的键
+	d = newReportDedup(time.Hour, 4)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if d.Seen("t", key) {
+			t.Errorf("unexpected duplicate %s", key)
+		}
+	}
+	if d.Seen("t", "a") || !d.Seen("t", "e") || len(d.current)+len(d.previous) > 4 {
+		t.Errorf("unexpected dedup keys %v %v", d.current, d.previous)
+	}
+}
@@ -8,15 +8,19 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/apache/arrow/go/v14/arrow/array"
 	"github.com/marcboeker/go-duckdb"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/pbkdf2"
@@ -36,17 +40,26 @@ type ChServer struct {
 	connector driver.Connector
 	pgServer  *PgServer
 	authCache sync.Map
+	sessions  *chSessionManager
+	queries   *queryRegistry
+	queryLog  *queryLog
+	metrics   *serverMetrics
+	reports   *reportBuffers
+	// adminUsers 可以取消其他用户查询的用户
+	adminUsers map[string]bool
 }
 
 /*
-testInsertFormatRegexp 用于匹配带format关键字的INSERT语句。
-testInsertValuesQueryRegexp 用于匹配包含VALUES的INSERT语句。
-testInsertRegexp 用于匹配单独的INSERT关键字。
+testInsertFormatRegexp 用于匹配带format关键字的INSERT语句，数据跟在语句后面。
+testInsertQueryRegexp 用于匹配自带数据的INSERT语句，如INSERT ... VALUES和INSERT ... SELECT。
+testInsertRegexp 用于匹配INSERT开头的语句。
+testRowQueryRegexp 用于匹配产生结果的语句。
 */
 
-var testInsertFormatRegexp = regexp.MustCompile(`(?i)^\s*INSERT\s+INTO.*?format\s+\S+[\s;]*$`)
-var testInsertValuesQueryRegexp = regexp.MustCompile(`(?i)^\s*INSERT\s+INTO.*VALUES.*[\s;]*$`)
-var testInsertRegexp = regexp.MustCompile(`(?i)^\s*INSERT$`)
+var testInsertFormatRegexp = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+[\w."]+\s*(\([^()]*\))?\s*(SETTINGS\s.*?)?FORMAT\s+\S+[\s;]*$`)
+var testInsertQueryRegexp = regexp.MustCompile(`(?is)^\s*INSERT\s.*?\b(VALUES|SELECT|WITH|FROM)\b`)
+var testInsertRegexp = regexp.MustCompile(`(?i)^\s*INSERT\b`)
+var testRowQueryRegexp = regexp.MustCompile(`(?i)^[\s(]*(SELECT|WITH|SHOW|DESCRIBE|DESC|EXPLAIN|SUMMARIZE|FROM|VALUES|CALL|PIVOT|UNPIVOT)\b`)
 
 func getSHA256Sum(key []byte) []byte {
 	h := sha256.New()
@@ -87,42 +100,80 @@ func (c *ChServer) Auth(user, password string) error {
 
 func (c *ChServer) ServeHTTP(wr http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	var user string
 	if c.pgServer.enableAuth {
-		user, password, ok := r.BasicAuth()
+		var password string
+		var ok bool
+		user, password, ok = r.BasicAuth()
 		if !ok {
 			user = r.URL.Query().Get("user")
 			password = r.URL.Query().Get("password")
 		}
 		if user == "" {
+			c.metrics.AuthFailed("http", "password")
 			wr.WriteHeader(401)
 			_, _ = fmt.Fprintf(wr, "User not specified")
 			return
 		}
 		if password == "" {
+			c.metrics.AuthFailed("http", "password")
 			wr.WriteHeader(401)
 			_, _ = fmt.Fprintf(wr, "Password not specified")
 			return
 		}
 		err := c.Auth(user, password)
 		if err != nil {
+			c.metrics.AuthFailed("http", "password")
 			wr.WriteHeader(401)
 			_, _ = fmt.Fprintf(wr, "Unauthorized: %s", err)
 			return
 		}
 	}
 
-	fmt.Println("uri ", r.RequestURI)
+	logrus.Debugf("clickhouse http %s %s", r.Method, r.URL.Path)
 	//use simple auth check
 	token := r.Header.Get("token")
 	if token != AuthToken {
+		c.metrics.AuthFailed("http", "token")
 		wr.WriteHeader(401)
 		return
 	}
 
-	if r.RequestURI == "/report" {
+	settings, err := parseQuerySettings(r.URL.Query())
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid settings: %s", err)
+		return
+	}
+
+	if r.URL.Path == "/report/replay" {
+		c.ReplayDeadLetters(r, settings, wr)
+		return
+	}
+	if r.URL.Path == "/report" {
 		businessID := r.Header.Get("business_id")
 		d, _ := io.ReadAll(r.Body)
-		c.MustExecuteQuery(r.Context(), businessID, string(d), wr)
+		c.MustExecuteQuery(r.Context(), businessID, string(d), r, settings, wr)
+		return
+	}
+	settings.User = user
+	settings.Progress = newChProgress()
+	settings.ClientAddress = r.RemoteAddr
+	wr.Header().Set("X-ClickHouse-Query-Id", settings.QueryID)
+	var pw *progressResponseWriter
+	if settings.SendProgressInHttpHeaders {
+		pw = newProgressResponseWriter(wr, r, settings.Progress, settings.HttpHeadersProgressInterval)
+		defer pw.Close()
+		wr = pw
+	}
+	if settings.WaitEndOfQuery {
+		bw := newBufferedResponseWriter(wr, settings.HttpResponseBufferSize)
+		defer bw.Flush()
+		wr = bw
+	}
+
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		c.ExternalQuery(r, settings, wr)
 		return
 	}
 
@@ -131,7 +182,11 @@ func (c *ChServer) ServeHTTP(wr http.ResponseWriter, r *http.Request) {
 		d, _ := io.ReadAll(r.Body)
 		query += " "
 		query += string(d)
-		c.SelectQuery(r.Context(), query, wr)
+		// 和 clickhouse 一样，GET 请求只能执行只读语句
+		if settings.Readonly == 0 {
+			settings.Readonly = 2
+		}
+		c.RunQuery(r.Context(), query, settings, wr)
 	}
 	if r.Method == http.MethodPost {
 		query := r.URL.Query().Get("query")
@@ -139,64 +194,408 @@ func (c *ChServer) ServeHTTP(wr http.ResponseWriter, r *http.Request) {
 			query += "\n"
 		}
 		rd := bufio.NewReader(r.Body)
+		// INSERT ... FORMAT 的数据紧跟在语句后面，逐行读取直到能判断语句类型
+		var readErr error
 		for {
-			if testSelectQueryRegexp.MatchString(query) {
-				d, _ := io.ReadAll(rd)
-				query += string(d)
-				c.SelectQuery(r.Context(), query, wr)
-				return
-			}
 			if testInsertFormatRegexp.MatchString(query) {
-				c.InsertFormat(r.Context(), query, rd, wr)
+				if pw != nil {
+					pw.KeepBody()
+				}
+				wr, logged := c.logStatement(query, settings, wr)
+				defer logged()
+				c.InsertFormat(r.Context(), query, settings, rd, wr)
 				return
 			}
-
-			//处理其他情况，不是插入语句，或者是插入insert values类似sql
-			if query != "" && (!testInsertRegexp.MatchString(query) || testInsertValuesQueryRegexp.MatchString(query)) {
+			if strings.TrimSpace(query) != "" && (!testInsertRegexp.MatchString(query) || testInsertQueryRegexp.MatchString(query)) {
 				d, _ := io.ReadAll(rd)
 				query += string(d)
-				c.ExecuteQuery(r.Context(), query, wr)
+				c.RunQuery(r.Context(), query, settings, wr)
 				return
 			}
-			line, err := rd.ReadString('\n')
-			query += strings.ReplaceAll(line, "\n", " ")
-			if err != nil {
+			if readErr != nil {
 				break
 			}
+			var line string
+			line, readErr = rd.ReadString('\n')
+			query += line
 		}
-		if testSelectQueryRegexp.MatchString(query) {
-			c.SelectQuery(r.Context(), query, wr)
-			return
+		c.RunQuery(r.Context(), query, settings, wr)
+	}
+}
+
+// bufferedResponseWriter wait_end_of_query=1 时先缓存整个响应，出错时可以返回正确的状态码。
+// 超过 http_response_buffer_size 后转存到临时文件
+type bufferedResponseWriter struct {
+	wr     http.ResponseWriter
+	header http.Header
+	status int
+	buf    bytes.Buffer
+	limit  int64
+	file   *os.File
+	size   int64
+	err    error
+}
+
+func newBufferedResponseWriter(wr http.ResponseWriter, limit int64) *bufferedResponseWriter {
+	return &bufferedResponseWriter{wr: wr, header: http.Header{}, status: 200, limit: limit}
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.file == nil && int64(b.buf.Len()+len(p)) > b.limit {
+		b.file, b.err = os.CreateTemp("", "duckserver-response-*")
+		if b.err != nil {
+			return 0, b.err
 		}
-		if !testInsertRegexp.MatchString(query) || testInsertValuesQueryRegexp.MatchString(query) {
-			c.ExecuteQuery(r.Context(), query, wr)
-			return
+		_, b.err = b.file.Write(b.buf.Bytes())
+		b.buf.Reset()
+	}
+	var n int
+	if b.file != nil && b.err == nil {
+		n, b.err = b.file.Write(p)
+	} else if b.file == nil {
+		n, _ = b.buf.Write(p)
+	}
+	b.size += int64(n)
+	return n, b.err
+}
+
+// WriteHeader 出错时丢弃已经缓存的部分结果
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if status >= 400 {
+		b.reset()
+		b.header.Del("Content-Length")
+	}
+	b.status = status
+}
+
+func (b *bufferedResponseWriter) reset() {
+	b.buf.Reset()
+	if b.file != nil {
+		removeTempFile(b.file)
+		b.file = nil
+	}
+	b.size = 0
+	b.err = nil
+}
+
+func (b *bufferedResponseWriter) Flush() {
+	defer b.reset()
+	if b.err != nil {
+		err := b.err
+		b.reset()
+		b.status = 500
+		_, _ = fmt.Fprintf(b, "Error buffering response: %s", err)
+	}
+	for k, v := range b.header {
+		if k == "Transfer-Encoding" {
+			continue
+		}
+		b.wr.Header()[k] = v
+	}
+	b.wr.Header().Set("Content-Length", strconv.FormatInt(b.size, 10))
+	b.wr.WriteHeader(b.status)
+	if b.file == nil {
+		_, _ = b.wr.Write(b.buf.Bytes())
+		return
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err == nil {
+		_, _ = io.Copy(b.wr, b.file)
+	}
+}
+
+// writeStreamError 结果已经开始输出后出错，只能把错误追加到响应中；缓存模式下仍然可以改为错误状态码，multiquery 时停止执行后续语句
+func writeStreamError(wr http.ResponseWriter, format string, args ...any) {
+	if lw, ok := wr.(*queryLogWriter); ok {
+		lw.fail(fmt.Sprintf(format, args...))
+		writeStreamError(lw.wr, format, args...)
+		return
+	}
+	switch wr.(type) {
+	case *bufferedResponseWriter, *multiQueryWriter:
+		wr.WriteHeader(500)
+	}
+	_, _ = fmt.Fprintf(wr, format, args...)
+}
+
+// chQuery 一条语句执行时使用的连接和设置
+type chQuery struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	finish   func()
+	conn     *sql.Conn
+	settings *QuerySettings
+	sessions *chSessionManager
+	session  *chSession
+	// args {name:Type} 占位符绑定的参数
+	args []any
+	// external 已经创建的外部数据临时表
+	external []*chExternalTable
+	// searchPath 设置 database 之前的 search_path
+	searchPath *string
+}
+
+// beginQuery 按设置准备上下文和连接：查询按 query_id 登记以便取消，max_execution_time 转为 context 的超时，
+// database 设置为 search_path，带 session_id 时使用 session 固定的连接
+func (c *ChServer) beginQuery(ctx context.Context, settings *QuerySettings, query string) (*chQuery, error) {
+	q := &chQuery{settings: settings, sessions: c.sessions}
+	ctx, finish, err := c.queries.Begin(ctx, &runningQuery{
+		ID:       settings.QueryID,
+		User:     settings.User,
+		Protocol: "http",
+		Query:    query,
+		Address:  settings.ClientAddress,
+		Progress: settings.Progress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.finish = finish
+	if settings.MaxExecutionTime > 0 {
+		q.ctx, q.cancel = context.WithTimeout(ctx, settings.MaxExecutionTime)
+	} else {
+		q.ctx, q.cancel = context.WithCancel(ctx)
+	}
+	if settings.SessionID != "" {
+		q.session, err = c.sessions.Acquire(q.ctx, settings.User, settings.SessionID, settings.SessionTimeout, settings.SessionCheck)
+		if err == nil {
+			q.conn = q.session.conn
+		}
+	} else {
+		q.conn, err = c.conn.Conn(q.ctx)
+	}
+	if err != nil {
+		q.cancel()
+		q.finish()
+		return nil, err
+	}
+	if settings.Database != "" {
+		// 保存原来的 search_path，Close 时恢复，session 中 USE 或 SET 的值不会丢失
+		var searchPath string
+		err = q.conn.QueryRowContext(q.ctx, "SELECT current_setting('search_path')").Scan(&searchPath)
+		if err == nil {
+			q.searchPath = &searchPath
+			_, err = q.conn.ExecContext(q.ctx, "SET search_path = "+quoteSqlString(settings.Database))
+		}
+		if err != nil {
+			q.Close()
+			return nil, err
+		}
+	}
+	if settings.SendProgressInHttpHeaders {
+		if err = q.watchProgress(); err != nil {
+			q.Close()
+			return nil, err
+		}
+	}
+	for _, t := range settings.External {
+		if err = t.load(q); err != nil {
+			q.Close()
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+var explainAnalyzeRegexp = regexp.MustCompile(`(?is)^[\s(]*EXPLAIN\s+ANALY[SZ]E\s+(.*)$`)
+var useStatementRegexp = regexp.MustCompile(`(?i)^\s*USE\s`)
+
+// checkReadonly readonly 模式下在查询的连接上准备语句，按 duckdb 的语句类型只允许 SELECT、EXPLAIN 和 USE，
+// 不看语句开头的关键字，例如 WITH ... INSERT、CALL 和 COPY ... TO 都会被拒绝。不允许时写入响应并返回 false
+func (q *chQuery) checkReadonly(query string, wr http.ResponseWriter) bool {
+	if q.settings.Readonly == 0 {
+		return true
+	}
+	var typ int
+	err := q.conn.Raw(func(driverConn any) error {
+		var err error
+		typ, err = duckdbStatementType(driverConn.(driver.Conn), query)
+		// EXPLAIN ANALYZE 会执行语句
+		for err == nil && typ == duckdbStatementExplain {
+			m := explainAnalyzeRegexp.FindStringSubmatch(query)
+			if m == nil {
+				break
+			}
+			query = m[1]
+			typ, err = duckdbStatementType(driverConn.(driver.Conn), query)
 		}
+		return err
+	})
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
+		return false
 	}
+	if typ == duckdbStatementSelect || typ == duckdbStatementExplain || typ == duckdbStatementSet && useStatementRegexp.MatchString(query) {
+		return true
+	}
+	wr.WriteHeader(403)
+	_, _ = fmt.Fprintf(wr, "Cannot execute query in readonly mode")
+	return false
 }
 
-var testSelectQueryRegexp = regexp.MustCompile(`(?i)^\s*SELECT.*$`)
-var selectFormatRegexp = regexp.MustCompile(`(?i)^\s*SELECT.* format (\S*?)[\s;]*$`)
-var formatCleanRegexp = regexp.MustCompile(`(?i)^\s*(SELECT.* )(format \S*?)[\s;]*$`)
+// defaultSchema INSERT 语句没有指定 schema 时使用的 schema
+func (q *chQuery) defaultSchema() string {
+	if q.settings.Database != "" {
+		return q.settings.Database
+	}
+	return "main"
+}
+
+// err 超时和取消导致的中断返回 clickhouse 风格的错误
+func (q *chQuery) err(err error) error {
+	switch {
+	case errors.Is(q.ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("Timeout exceeded: maximum: %s", q.settings.MaxExecutionTime)
+	case errors.Is(q.ctx.Err(), context.Canceled):
+		return errors.New("Query was cancelled")
+	}
+	return err
+}
+
+// watchProgress 打开连接上的 duckdb 进度统计，由 progressResponseWriter 定期读取
+func (q *chQuery) watchProgress() error {
+	for _, stmt := range []string{"SET enable_progress_bar = true", "SET enable_progress_bar_print = false"} {
+		if _, err := q.conn.ExecContext(q.ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return q.conn.Raw(func(driverConn any) error {
+		source, err := newDuckdbProgress(driverConn.(driver.Conn))
+		if err == nil {
+			q.settings.Progress.Watch(source)
+		}
+		return err
+	})
+}
+
+func (q *chQuery) Close() {
+	q.settings.Progress.Unwatch()
+	for _, t := range q.external {
+		t.drop(q)
+	}
+	if q.searchPath != nil {
+		_, _ = q.conn.ExecContext(context.Background(), "SET search_path = "+quoteSqlString(*q.searchPath))
+	}
+	if q.session != nil {
+		q.sessions.Release(q.session)
+	} else {
+		_ = q.conn.Close()
+	}
+	q.cancel()
+	q.finish()
+}
+
+func quoteSqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+var selectFormatRegexp = regexp.MustCompile(`(?is)^(.*?)\s+FORMAT\s+([A-Za-z][A-Za-z0-9_]*)[\s;]*$`)
 var limitRewriteRegexp = regexp.MustCompile(`(?i)LIMIT\s+(\d+)\s*,\s*(\d+)`)
+var describeRewriteRegexp = regexp.MustCompile(`(?i)^(\s*)DESC\s`)
+
+// selectStatementRegexp 可以直接作为子查询的语句，SHOW、DESCRIBE 等需要包一层 SELECT * FROM (...)，EXPLAIN 和 CALL 不能作为子查询
+var selectStatementRegexp = regexp.MustCompile(`(?i)^[\s(]*(SELECT|WITH|FROM|VALUES)\b`)
+var noSubqueryRegexp = regexp.MustCompile(`(?i)^[\s(]*(EXPLAIN|CALL)\b`)
+
+// RunQuery 按语句类型执行：产生结果的语句按格式输出，其他语句执行后返回空结果。
+// 多条语句需要 multiquery=1
+func (c *ChServer) RunQuery(ctx context.Context, query string, settings *QuerySettings, wr http.ResponseWriter) {
+	statements := splitStatements(query)
+	if len(statements) == 0 {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Empty query")
+		return
+	}
+	if len(statements) > 1 {
+		if !settings.MultiQuery {
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "Multi-statements are not allowed, set multiquery=1 to enable them")
+			return
+		}
+		c.MultiQuery(ctx, statements, settings, wr)
+		return
+	}
+	c.runStatement(ctx, statements[0], settings, wr)
+}
+
+func (c *ChServer) runStatement(ctx context.Context, query string, settings *QuerySettings, wr http.ResponseWriter) {
+	wr, logged := c.logStatement(query, settings, wr)
+	defer logged()
+	if killQueryRegexp.MatchString(query) {
+		c.KillQuery(ctx, query, settings, wr)
+		return
+	}
+	if backendSignalRegexp.MatchString(query) {
+		c.SignalBackends(ctx, query, settings, wr)
+		return
+	}
+	if testRowQueryRegexp.MatchString(query) {
+		c.SelectQuery(ctx, query, settings, wr)
+		return
+	}
+	c.ExecuteQuery(ctx, query, settings, wr)
+}
 
-func (c *ChServer) SelectQuery(ctx context.Context, query string, wr http.ResponseWriter) {
+func (c *ChServer) SelectQuery(ctx context.Context, query string, settings *QuerySettings, wr http.ResponseWriter) {
 	//quick fix for datagrip
 	query = strings.TrimSpace(query)
 	query = strings.ReplaceAll(query, "version()", "'23.3.1.2823'")
 	query = strings.Replace(query, "select table", `select "table"`, 1)
 	logrus.Debugf("Executing ch query: %s", query)
-	query = strings.ReplaceAll(query, "\n", " ")
 	query = limitRewriteRegexp.ReplaceAllString(query, "LIMIT $2 OFFSET $1")
-	if !testSelectQueryRegexp.MatchString(query) {
+	query = describeRewriteRegexp.ReplaceAllString(query, "${1}DESCRIBE ")
+	if !testRowQueryRegexp.MatchString(query) {
 		wr.WriteHeader(400)
 		_, _ = fmt.Fprintf(wr, "Invalid query")
 		return
 	}
-	format := "TabSeparated"
-	if m := selectFormatRegexp.FindStringSubmatch(query); len(m) > 1 {
-		format = m[1]
-		query = formatCleanRegexp.ReplaceAllString(query, "$1")
+	settings = settings.Clone()
+	query, err := settings.ApplyClause(query)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid settings: %s", err)
+		return
+	}
+	format := settings.DefaultFormat
+	if m := selectFormatRegexp.FindStringSubmatch(query); len(m) > 2 {
+		format = m[2]
+		query = m[1]
+	}
+	query, args, err := bindQueryParams(query, settings.Params)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid query parameters: %s", err)
+		return
+	}
+	if settings.MaxResultRows > 0 && !noSubqueryRegexp.MatchString(query) {
+		query = limitResultRows(query, settings)
+	}
+	q, err := c.beginQuery(ctx, settings, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error starting query: %s", err)
+		return
+	}
+	defer q.Close()
+	q.args = args
+	query = c.queries.expandSystemViews(query)
+	if !q.checkReadonly(query, wr) {
+		return
+	}
+	if blockFormater := GetClickhouseBlockOutputFormat(format); blockFormater != nil {
+		c.SelectBlocks(q, query, format, blockFormater, wr)
+		return
+	}
+	if copyOptions := GetClickhouseCopyOutputFormat(format); copyOptions != "" {
+		c.SelectCopy(q, query, format, copyOptions, wr)
+		return
 	}
 	formater := GetClickhouseOutputFormat(format)
 	if formater == nil {
@@ -204,10 +603,10 @@ func (c *ChServer) SelectQuery(ctx context.Context, query string, wr http.Respon
 		_, _ = fmt.Fprintf(wr, "Unknown format %s", format)
 		return
 	}
-	rows, err := c.conn.QueryContext(ctx, query)
+	rows, err := q.conn.QueryContext(q.ctx, query, q.args...)
 	if err != nil {
 		wr.WriteHeader(500)
-		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
 		return
 	}
 	defer rows.Close()
@@ -219,7 +618,7 @@ func (c *ChServer) SelectQuery(ctx context.Context, query string, wr http.Respon
 		columnTypes[i] = col.DatabaseTypeName()
 	}
 	//gz := gzip.NewWriter(wr)
-	fmter, err := formater(columnNames, columnTypes, wr)
+	fmter, err := formater(columnNames, columnTypes, wr, settings.Format)
 	if err != nil {
 		wr.WriteHeader(500)
 		_, _ = fmt.Fprintf(wr, "Error creating format: %s", err)
@@ -234,81 +633,289 @@ func (c *ChServer) SelectQuery(ctx context.Context, query string, wr http.Respon
 	for i := range values {
 		valuePointers[i] = &values[i]
 	}
+	var rowCount int64
 	for rows.Next() {
+		rowCount++
+		settings.Progress.AddResultRows(1)
+		if settings.MaxResultRows > 0 && rowCount > settings.MaxResultRows {
+			writeStreamError(wr, "Limit for result exceeded, max rows: %d", settings.MaxResultRows)
+			return
+		}
 		err = rows.Scan(valuePointers...)
 		if err != nil {
-			_, _ = fmt.Fprintf(wr, "Error scanning row: %s", err)
+			writeStreamError(wr, "Error scanning row: %s", err)
 			return
 		}
 		err = fmter.Write(values)
 		if err != nil {
-			_, _ = fmt.Fprintf(wr, "Error writing row: %s", err)
+			writeStreamError(wr, "Error writing row: %s", err)
 			return
 		}
 	}
+	if err = rows.Err(); err != nil {
+		writeStreamError(wr, "Error executing query: %s", q.err(err))
+		return
+	}
 	err = fmter.Close()
 }
 
-func (c *ChServer) ExecuteQuery(ctx context.Context, query string, wr http.ResponseWriter) {
-	_, err := c.conn.ExecContext(ctx, query)
+// limitResultRows max_result_rows：break 模式直接截断，throw 模式多取一行用于判断是否超出
+func limitResultRows(query string, settings *QuerySettings) string {
+	limit := settings.MaxResultRows
+	if settings.ResultOverflowMode == "throw" {
+		limit++
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", strings.TrimRight(query, "; \t\n"), limit)
+}
+
+// SelectBlocks 通过 duckdb 的 arrow 接口按 chunk 读取结果，供列式格式整块写出，避免逐行 Scan。
+// 结果是流式的，每个 chunk 读到后立即写出；max_result_rows 的 throw 模式边读边计数，超出时中止
+func (c *ChServer) SelectBlocks(q *chQuery, query, format string, formater ClickhouseBlockWriterFactory, wr http.ResponseWriter) {
+	err := q.conn.Raw(func(driverConn any) error {
+		// EXPLAIN 和 CALL 不能作为子查询，结果很小，使用 go-duckdb 一次读取
+		var reader array.RecordReader
+		var err error
+		if noSubqueryRegexp.MatchString(query) {
+			var ar *duckdb.Arrow
+			if ar, err = duckdb.NewArrowFromConn(driverConn.(driver.Conn)); err == nil {
+				reader, err = ar.QueryContext(q.ctx, query, q.args...)
+			}
+		} else {
+			reader, err = queryDuckdbArrow(q.ctx, driverConn.(driver.Conn), query, q.args)
+		}
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
+			return nil
+		}
+		defer reader.Release()
+		fmter, err := formater(reader.Schema(), wr)
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error creating format: %s", err)
+			return nil
+		}
+		throw := q.settings.MaxResultRows > 0 && q.settings.ResultOverflowMode == "throw"
+		var rowCount int64
+		started := false
+		start := func() {
+			if !started {
+				started = true
+				wr.Header().Set("Transfer-Encoding", "chunked")
+				wr.Header().Set("x-clickhouse-format", format)
+				wr.Header().Set("Content-Type", GetClickhouseFormatContentType(format))
+				wr.WriteHeader(200)
+			}
+		}
+		for reader.Next() {
+			rec := reader.Record()
+			rowCount += rec.NumRows()
+			if throw && rowCount > q.settings.MaxResultRows {
+				// 还没有输出时可以返回错误状态码
+				if !started {
+					wr.WriteHeader(500)
+					_, _ = fmt.Fprintf(wr, "Limit for result exceeded, max rows: %d", q.settings.MaxResultRows)
+					return nil
+				}
+				writeStreamError(wr, "Limit for result exceeded, max rows: %d", q.settings.MaxResultRows)
+				return nil
+			}
+			start()
+			q.settings.Progress.AddResultRows(rec.NumRows())
+			if err = fmter.WriteBlock(rec); err != nil {
+				writeStreamError(wr, "Error writing block: %s", err)
+				return nil
+			}
+		}
+		if err = reader.Err(); err != nil {
+			if !started {
+				wr.WriteHeader(500)
+				_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
+				return nil
+			}
+			writeStreamError(wr, "Error reading block: %s", q.err(err))
+			return nil
+		}
+		start()
+		return fmter.Close()
+	})
+	if err != nil {
+		logrus.Errorf("select blocks: %s", err)
+	}
+}
+
+// SelectCopy 由 duckdb COPY TO 导出到临时文件，再整体写回客户端
+func (c *ChServer) SelectCopy(q *chQuery, query, format, copyOptions string, wr http.ResponseWriter) {
+	tmp, err := os.CreateTemp("", "duckserver-*")
 	if err != nil {
 		wr.WriteHeader(500)
-		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		_, _ = fmt.Fprintf(wr, "Error creating temp file: %s", err)
 		return
 	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+	query = strings.TrimRight(query, "; \t\n")
+	if !selectStatementRegexp.MatchString(query) {
+		query = "SELECT * FROM (" + query + ")"
+	}
+	_, err = q.conn.ExecContext(q.ctx, fmt.Sprintf("COPY (%s) TO '%s' (%s)", query, tmp.Name(), copyOptions), q.args...)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
+		return
+	}
+	scanFunction := GetClickhouseScanInputFormat(format)
+	if q.settings.MaxResultRows > 0 && q.settings.ResultOverflowMode == "throw" && scanFunction != "" {
+		var rowCount int64
+		err = q.conn.QueryRowContext(q.ctx, fmt.Sprintf("SELECT count(*) FROM %s('%s')", scanFunction, tmp.Name())).Scan(&rowCount)
+		if err == nil && rowCount > q.settings.MaxResultRows {
+			err = fmt.Errorf("Limit for result exceeded, max rows: %d", q.settings.MaxResultRows)
+		}
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprint(wr, err)
+			return
+		}
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error opening result file: %s", err)
+		return
+	}
+	defer f.Close()
+	wr.Header().Set("x-clickhouse-format", format)
+	wr.Header().Set("Content-Type", GetClickhouseFormatContentType(format))
+	if stat, err := f.Stat(); err == nil {
+		wr.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	}
 	wr.WriteHeader(200)
+	_, _ = io.Copy(wr, f)
 }
 
-func (c *ChServer) MustExecuteQuery(ctx context.Context, tableName, query string, wr http.ResponseWriter) {
-	if tableName == "" {
+func (c *ChServer) ExecuteQuery(ctx context.Context, query string, settings *QuerySettings, wr http.ResponseWriter) {
+	settings = settings.Clone()
+	query, err := settings.ApplyClause(query)
+	if err != nil {
 		wr.WriteHeader(400)
-		fmt.Fprint(wr, "businessID is empty on http header")
+		_, _ = fmt.Fprintf(wr, "Invalid settings: %s", err)
 		return
 	}
-	retData, insertValueSql, err := ParseJSONStrToSQLField(tableName, query)
+	query, args, err := bindQueryParams(query, settings.Params)
 	if err != nil {
 		wr.WriteHeader(400)
-		fmt.Fprint(wr, err.Error())
+		_, _ = fmt.Fprintf(wr, "Invalid query parameters: %s", err)
+		return
+	}
+	q, err := c.beginQuery(ctx, settings, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error starting query: %s", err)
+		return
+	}
+	defer q.Close()
+	query = c.queries.expandSystemViews(query)
+	if !q.checkReadonly(query, wr) {
+		return
+	}
+	result, err := q.conn.ExecContext(q.ctx, query, args...)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
 		return
 	}
+	if n, err := result.RowsAffected(); err == nil {
+		settings.Progress.AddWrittenRows(n)
+	}
+	wr.WriteHeader(200)
+}
 
-	for {
-		_, err = c.conn.ExecContext(ctx, insertValueSql)
+// MustExecuteQuery 把 /report 的事件放入表的缓存，由 reportBuffers 批量写入。
+// 请求体可以是一个 JSON 对象、JSON 数组或者 NDJSON，每个事件单独校验，批量时返回每个事件的结果。
+// wait_for_async_insert=0 时不等待写入结果。配置了去重键的表，窗口内重复的事件返回 duplicate，不再写入。
+// report_configs 开启 enrich 时补充接收时间、客户端 IP、User-Agent、时钟偏差和国家
+func (c *ChServer) MustExecuteQuery(ctx context.Context, tableName, query string, r *http.Request, settings *QuerySettings, wr http.ResponseWriter) {
+	if err := c.reports.ValidateTable(tableName); err != nil {
+		// 修改死信的 business_id 后可以重放
+		c.reports.RecordDeadLetters(deadLetter{BusinessID: tableName, Payload: query, Error: err.Error(), ReceivedAt: time.Now()})
+		wr.WriteHeader(400)
+		fmt.Fprint(wr, err)
+		return
+	}
+	request := reportRequest{
+		Received:  time.Now(),
+		ClientIP:  c.reports.ClientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For")),
+		UserAgent: r.Header.Get("User-Agent"),
+	}
+	lines, batch := splitReportBody(query)
+	results := make([]reportResult, len(lines))
+	var rows []map[string]any
+	var raws, keys []string
+	var indexes []int
+	var letters []deadLetter
+	for i, line := range lines {
+		results[i] = reportResult{Line: line.Line, Status: "ok"}
+		err := line.Err
 		if err == nil {
-			wr.WriteHeader(200)
-			return
-		}
-
-		fmt.Println("exec insert sql err:", err.Error())
-
-		tableName, field, _ := ParseSqlErrType(err.Error())
-		if tableName == "" && field == "" {
-			wr.WriteHeader(500)
-			fmt.Fprintf(wr, "parse sql err msg failed for get table and field failed: %s", err.Error())
-			return
+			var row map[string]any
+			if row, err = c.reports.Parse(tableName, line.Body); err == nil {
+				key, duplicate := c.reports.Dedup(tableName, line.Body, r.Header.Get, line.Line, batch)
+				if duplicate {
+					results[i].Status = "duplicate"
+					continue
+				}
+				rows = append(rows, c.reports.Enrich(tableName, row, request))
+				raws = append(raws, line.Body)
+				keys = append(keys, key)
+				indexes = append(indexes, i)
+			}
 		}
-
-		createSql, err := ProduceCreateSql(retData, tableName, field)
 		if err != nil {
-			wr.WriteHeader(500)
-			fmt.Fprintf(wr, "produce create sql failed: %s", err.Error())
-			return
+			results[i].Status, results[i].Error = "error", err.Error()
+			letters = append(letters, deadLetter{BusinessID: tableName, Payload: line.Body, Error: err.Error(), ReceivedAt: time.Now()})
 		}
-
-		fmt.Println("new sql ---", createSql)
-		_, err = c.conn.ExecContext(ctx, createSql)
-		if err != nil {
-			fmt.Println("exec create sql err:", err.Error())
+	}
+	// 写入失败的事件由 reportBuffers 保存到死信
+	c.reports.RecordDeadLetters(letters...)
+	insertFailed := false
+	if len(rows) > 0 {
+		for i, err := range c.reports.AddMany(ctx, tableName, rows, raws, keys, settings.WaitForAsyncInsert) {
+			if err != nil {
+				insertFailed = true
+				results[indexes[i]].Status, results[indexes[i]].Error = "error", fmt.Sprintf("Error inserting report: %s", err)
+			}
+		}
+	}
+	if batch {
+		writeReportResults(wr, results, insertFailed)
+		return
+	}
+	if results[0].Status == "error" {
+		if insertFailed {
 			wr.WriteHeader(500)
-			return
+		} else {
+			wr.WriteHeader(400)
 		}
-
+		fmt.Fprint(wr, results[0].Error)
+		return
 	}
-
+	wr.WriteHeader(200)
 }
 
-func (c *ChServer) InsertFormat(ctx context.Context, query string, rd *bufio.Reader, wr http.ResponseWriter) {
-	var insertFormatRegexp = regexp.MustCompile(`(?i)^\s*INSERT\s+INTO(.*?)format\s+(\S+)[\s;]*$`)
+func (c *ChServer) InsertFormat(ctx context.Context, query string, settings *QuerySettings, rd *bufio.Reader, wr http.ResponseWriter) {
+	var insertFormatRegexp = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO(.*?)format\s+(\S+)[\s;]*$`)
+	settings = settings.Clone()
+	query, err := settings.ApplyClause(query)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid settings: %s", err)
+		return
+	}
+	if settings.Readonly > 0 {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "Cannot execute query in readonly mode")
+		return
+	}
 	groups := insertFormatRegexp.FindStringSubmatch(query)
 	if len(groups) < 3 {
 		wr.WriteHeader(400)
@@ -317,19 +924,30 @@ func (c *ChServer) InsertFormat(ctx context.Context, query string, rd *bufio.Rea
 	}
 	tableExpr := groups[1]
 	format := groups[2]
+	q, err := c.beginQuery(ctx, settings, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error starting query: %s", err)
+		return
+	}
+	defer q.Close()
+	if scanFunction := GetClickhouseScanInputFormat(format); scanFunction != "" {
+		c.InsertScan(q, tableExpr, scanFunction, rd, wr)
+		return
+	}
 	formater := GetClickhouseInputFormat(format)
 	if formater == nil {
 		wr.WriteHeader(400)
 		_, _ = fmt.Fprintf(wr, "Unknown format %s", format)
 		return
 	}
-	schema, table, columns, err := parseTablesAndColumns(tableExpr)
+	schema, table, columns, err := parseTablesAndColumns(tableExpr, q.defaultSchema())
 	if err != nil {
 		wr.WriteHeader(400)
 		_, _ = fmt.Fprintf(wr, "Invalid table expression: %s", err)
 		return
 	}
-	rows, err := c.conn.QueryContext(context.Background(), fmt.Sprintf("SELECT * FROM %s.%s LIMIT 0", schema, table))
+	rows, err := q.conn.QueryContext(q.ctx, fmt.Sprintf("SELECT * FROM %s.%s LIMIT 0", schema, table))
 	if err != nil {
 		wr.WriteHeader(500)
 		_, _ = fmt.Fprintf(wr, "Error getting table description: %s", err)
@@ -367,63 +985,252 @@ func (c *ChServer) InsertFormat(ctx context.Context, query string, rd *bufio.Rea
 			}
 		}
 	}
-	//todo reuse connection
-	conn, err := c.connector.Connect(context.Background())
-	defer conn.Close()
-	appender, err := duckdb.NewAppenderFromConn(conn, schema, table)
+	formatWriter, err := formater(columnNames, columnTypes, rd, settings.Format)
 	if err != nil {
 		wr.WriteHeader(500)
-		_, _ = fmt.Fprintf(wr, "Error creating appender: %s", err)
+		_, _ = fmt.Fprintf(wr, "Error creating formater: %s", err)
 		return
 	}
-	defer appender.Close()
-	formatWriter, err := formater(columnNames, columnTypes, rd)
+	defer formatWriter.Close()
+	if setter, ok := formatWriter.(ColumnDefaultsSetter); ok {
+		defaults, nullable, err := c.columnDefaults(q.ctx, schema, table, columnNames, columnTypes)
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error getting column defaults: %s", err)
+			return
+		}
+		setter.SetColumnDefaults(defaults, nullable)
+	}
+	written := settings.Progress.WrittenRows()
+	err = q.conn.Raw(func(driverConn any) error {
+		// Arrow 输入由 duckdb 的 arrow scan 直接读取
+		if arrowReader, ok := formatWriter.(*ArrowFormatReader); ok {
+			n, err := arrowReader.Insert(q.ctx, driverConn.(driver.Conn), schema, table)
+			settings.Progress.AddWrittenRows(n)
+			return err
+		}
+		return appendRows(q.ctx, driverConn.(driver.Conn), schema, table, columnNames, columnTypes,
+			len(columns) > 0 && len(columns) < len(columnDesc), &progressFormatReader{formatWriter, settings.Progress})
+	})
 	if err != nil {
 		wr.WriteHeader(500)
-		_, _ = fmt.Fprintf(wr, "Error creating formater: %s", err)
+		_, _ = fmt.Fprintf(wr, "Error %s", q.err(err))
 		return
 	}
+	c.metrics.AppendedRows("http", "insert", settings.Progress.WrittenRows()-written)
+	wr.WriteHeader(200)
+}
+
+// columnDefaults 读取目标表的默认值表达式，缺失字段时使用；没有默认值的 NOT NULL 列使用类型的零值
+func (c *ChServer) columnDefaults(ctx context.Context, schema, table string, columnNames, columnTypes []string) ([]func() (driver.Value, error), []bool, error) {
+	rows, err := c.conn.QueryContext(ctx, "SELECT column_name, column_default, is_nullable FROM duckdb_columns() WHERE schema_name = ? AND table_name = ?", schema, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	type columnInfo struct {
+		expr     sql.NullString
+		nullable bool
+	}
+	infos := map[string]columnInfo{}
+	for rows.Next() {
+		var name string
+		var info columnInfo
+		if err = rows.Scan(&name, &info.expr, &info.nullable); err != nil {
+			_ = rows.Close()
+			return nil, nil, err
+		}
+		infos[name] = info
+	}
+	_ = rows.Close()
+	defaults := make([]func() (driver.Value, error), len(columnNames))
+	nullable := make([]bool, len(columnNames))
+	for i, name := range columnNames {
+		info, ok := infos[name]
+		if !ok {
+			info.nullable = true
+		}
+		nullable[i] = info.nullable
+		t, err := parseDuckType(columnTypes[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		query := fmt.Sprintf("SELECT CAST((%s) AS %s)", info.expr.String, t)
+		switch {
+		case info.expr.Valid && strings.Contains(strings.ToLower(info.expr.String), "nextval("):
+			// 序列每行都要取新值
+			defaults[i] = func() (driver.Value, error) {
+				var v any
+				if err := c.conn.QueryRowContext(ctx, query).Scan(&v); err != nil {
+					return nil, err
+				}
+				return t.cast(v)
+			}
+			continue
+		case info.expr.Valid:
+			var v any
+			if err = c.conn.QueryRowContext(ctx, query).Scan(&v); err != nil {
+				return nil, nil, fmt.Errorf("evaluating default of %s: %w", name, err)
+			}
+			if v, err = t.cast(v); err != nil {
+				return nil, nil, err
+			}
+			defaults[i] = constantDefault(v)
+		case info.nullable:
+			defaults[i] = constantDefault(nil)
+		default:
+			defaults[i] = constantDefault(t.zero())
+		}
+	}
+	return defaults, nullable, nil
+}
+
+func constantDefault(v driver.Value) func() (driver.Value, error) {
+	return func() (driver.Value, error) {
+		return v, nil
+	}
+}
+
+var stageTableSeq atomic.Int64
+
+// appendRows 用 appender 写入 reader 读出的所有行。appender 只能写全部列，且不支持 DECIMAL/MAP 等类型，
+// 这些情况下先写入同一连接上的临时表(不支持的列以 VARCHAR 保存)，再转换插入目标表
+func appendRows(ctx context.Context, conn driver.Conn, schema, table string, columnNames, columnTypes []string, partial bool, reader ClickhouseFormatReader) error {
+	types := make([]*duckType, len(columnTypes))
+	staged := partial
+	for i, columnType := range columnTypes {
+		t, err := parseDuckType(columnType)
+		if err != nil {
+			return err
+		}
+		types[i] = t
+		if !t.appendable() {
+			staged = true
+		}
+	}
+	execer := conn.(driver.ExecerContext)
+	appendSchema, appendTable := schema, table
+	if staged {
+		appendSchema, appendTable = "", fmt.Sprintf("duckserver_stage_%d", stageTableSeq.Add(1))
+		columnDefs := make([]string, len(columnNames))
+		for i, name := range columnNames {
+			if types[i].appendable() {
+				columnDefs[i] = quoteIdentifier(name) + " " + types[i].String()
+			} else {
+				columnDefs[i] = quoteIdentifier(name) + " VARCHAR"
+			}
+		}
+		_, err := execer.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (%s)", appendTable, strings.Join(columnDefs, ", ")), nil)
+		if err != nil {
+			return fmt.Errorf("creating stage table: %w", err)
+		}
+		defer execer.ExecContext(context.Background(), "DROP TABLE IF EXISTS temp."+appendTable, nil)
+	}
+	appender, err := duckdb.NewAppenderFromConn(conn, appendSchema, appendTable)
+	if err != nil {
+		return fmt.Errorf("creating appender: %w", err)
+	}
 	values := make([]driver.Value, len(columnNames))
-	var done = false
-	go func() {
-		<-ctx.Done()
-		done = true
-	}()
 	for {
-		if done {
-			wr.WriteHeader(500)
-			_, _ = fmt.Fprintf(wr, "Request cancelled")
-			return
+		if ctx.Err() != nil {
+			_ = appender.Close()
+			return errors.New("request cancelled")
 		}
-		err = formatWriter.Read(values)
+		err = reader.Read(values)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			wr.WriteHeader(500)
-			_, _ = fmt.Fprintf(wr, "Error reading values: %s", err)
-			return
+			_ = appender.Close()
+			return fmt.Errorf("reading values: %w", err)
 		}
-		err = appender.AppendRow(values...)
+		if staged {
+			for i, t := range types {
+				if t.appendable() || values[i] == nil {
+					continue
+				}
+				if values[i], err = formatDuckText(values[i], t, false); err != nil {
+					_ = appender.Close()
+					return fmt.Errorf("reading values: %w", err)
+				}
+			}
+		}
+		if err = appender.AppendRow(values...); err != nil {
+			_ = appender.Close()
+			return fmt.Errorf("appending values: %w", err)
+		}
+	}
+	if err = appender.Close(); err != nil {
+		return fmt.Errorf("flushing appender: %w", err)
+	}
+	if !staged {
+		return nil
+	}
+	columns := make([]string, len(columnNames))
+	selects := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		columns[i] = quoteIdentifier(name)
+		selects[i] = fmt.Sprintf("CAST(%s AS %s)", columns[i], types[i])
+	}
+	target := quoteIdentifier(table)
+	if schema != "" {
+		target = quoteIdentifier(schema) + "." + target
+	}
+	_, err = execer.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM temp.%s",
+		target, strings.Join(columns, ", "), strings.Join(selects, ", "), appendTable), nil)
+	if err != nil {
+		return fmt.Errorf("inserting values: %w", err)
+	}
+	return nil
+}
+
+// InsertScan 把请求体落盘，由 duckdb 表函数(如 read_parquet)按列名直接写入目标表
+func (c *ChServer) InsertScan(q *chQuery, tableExpr, scanFunction string, rd io.Reader, wr http.ResponseWriter) {
+	schema, table, columns, err := parseTablesAndColumns(tableExpr, q.defaultSchema())
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid table expression: %s", err)
+		return
+	}
+	f, err := os.CreateTemp("", "duckserver-*")
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating temp file: %s", err)
+		return
+	}
+	defer removeTempFile(f)
+	if _, err = io.Copy(f, rd); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error reading body: %s", err)
+		return
 	}
-	err = appender.Flush()
+	var query string
+	if len(columns) == 0 {
+		query = fmt.Sprintf("INSERT INTO %s.%s BY NAME SELECT * FROM %s('%s')", schema, table, scanFunction, f.Name())
+	} else {
+		columnList := strings.Join(columns, ", ")
+		query = fmt.Sprintf("INSERT INTO %s.%s (%s) SELECT %s FROM %s('%s')", schema, table, columnList, columnList, scanFunction, f.Name())
+	}
+	result, err := q.conn.ExecContext(q.ctx, query)
 	if err != nil {
 		wr.WriteHeader(500)
-		_, _ = fmt.Fprintf(wr, "Error flushing appender: %s", err)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", q.err(err))
 		return
 	}
+	if n, err := result.RowsAffected(); err == nil {
+		q.settings.Progress.AddWrittenRows(n)
+	}
 	wr.WriteHeader(200)
 }
 
-func parseTablesAndColumns(t string) (string, string, []string, error) {
+func parseTablesAndColumns(t, defaultSchema string) (string, string, []string, error) {
 	t = regexp.MustCompile(`\s+`).ReplaceAllString(t, "")
 	groups := regexp.MustCompile(`^(\w+\.|)(\w+)(\([\w,]+\)|)$`).FindStringSubmatch(t)
 	if len(groups) != 4 {
 		return "", "", nil, fmt.Errorf("invalid table name " + t)
 	}
-	schema := groups[1]
+	schema := strings.TrimSuffix(groups[1], ".")
 	if schema == "" {
-		schema = "main"
+		schema = defaultSchema
 	}
 	table := groups[2]
 	columns := groups[3]
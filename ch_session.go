@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxSessionTimeout 和 clickhouse 的 max_session_timeout 默认值一致
+const maxSessionTimeout = time.Hour
+
+// chSession 同一个 session_id 的请求固定使用同一个 duckdb 连接，SET、临时表和事务可以跨请求使用
+type chSession struct {
+	key      string
+	conn     *sql.Conn
+	timeout  time.Duration
+	lastUsed time.Time
+	busy     bool
+}
+
+type chSessionManager struct {
+	db       *sql.DB
+	mu       sync.Mutex
+	sessions map[string]*chSession
+}
+
+func newChSessionManager(db *sql.DB) *chSessionManager {
+	return &chSessionManager{db: db, sessions: map[string]*chSession{}}
+}
+
+// Acquire 取出 session 并标记为使用中，同一个 session 不能被并发使用
+func (m *chSessionManager) Acquire(ctx context.Context, user, id string, timeout time.Duration, check bool) (*chSession, error) {
+	key := user + "\x00" + id
+	if timeout <= 0 || timeout > maxSessionTimeout {
+		return nil, fmt.Errorf("session_timeout must be in (0, %d] seconds", int(maxSessionTimeout.Seconds()))
+	}
+	m.mu.Lock()
+	session, ok := m.sessions[key]
+	if ok || check {
+		defer m.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("session %s not found", id)
+		}
+		return session.acquire(id, timeout)
+	}
+	// 获取连接可能要等待连接池，不持有 m.mu
+	m.mu.Unlock()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 并发的请求已经创建了这个 session
+	if session, ok = m.sessions[key]; ok {
+		_ = conn.Close()
+		return session.acquire(id, timeout)
+	}
+	session = &chSession{key: key, conn: conn, timeout: timeout, busy: true}
+	m.sessions[key] = session
+	return session, nil
+}
+
+// acquire 调用时持有 chSessionManager.mu
+func (s *chSession) acquire(id string, timeout time.Duration) (*chSession, error) {
+	if s.busy {
+		return nil, fmt.Errorf("session %s is locked by a concurrent client", id)
+	}
+	s.busy = true
+	s.timeout = timeout
+	return s, nil
+}
+
+func (m *chSessionManager) Release(session *chSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session.busy = false
+	session.lastUsed = time.Now()
+}
+
+// Remove 立即关闭 session，用于请求内部使用的临时 session
+func (m *chSessionManager) Remove(user, id string) {
+	key := user + "\x00" + id
+	m.mu.Lock()
+	session, ok := m.sessions[key]
+	delete(m.sessions, key)
+	m.mu.Unlock()
+	if ok {
+		discardConn(session.conn)
+	}
+}
+
+// Run 定期关闭空闲超时的 session
+func (m *chSessionManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.closeAll()
+			return
+		case now := <-ticker.C:
+			m.evict(now)
+		}
+	}
+}
+
+func (m *chSessionManager) evict(now time.Time) {
+	m.mu.Lock()
+	var expired []*chSession
+	for key, session := range m.sessions {
+		if !session.busy && now.Sub(session.lastUsed) > session.timeout {
+			expired = append(expired, session)
+			delete(m.sessions, key)
+		}
+	}
+	m.mu.Unlock()
+	for _, session := range expired {
+		logrus.Debugf("Closing idle clickhouse session %q", session.key)
+		discardConn(session.conn)
+	}
+}
+
+func (m *chSessionManager) closeAll() {
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = map[string]*chSession{}
+	m.mu.Unlock()
+	for _, session := range sessions {
+		discardConn(session.conn)
+	}
+}
+
+// discardConn session 的连接上可能还有临时表、设置和未提交的事务，不能放回连接池
+func discardConn(conn *sql.Conn) {
+	_ = conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+	_ = conn.Close()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestChSessionManager(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	m := newChSessionManager(db)
+	ctx := context.Background()
+
+	session, err := m.Acquire(ctx, "", "s", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = session.conn.ExecContext(ctx, "create temp table tt as select 1 a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Acquire(ctx, "", "s", time.Minute, false); err == nil {
+		t.Error("expected concurrent use of a session to fail")
+	}
+	m.Release(session)
+
+	session, err = m.Acquire(ctx, "", "s", time.Minute, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a int
+	if err = session.conn.QueryRowContext(ctx, "select a from tt").Scan(&a); err != nil || a != 1 {
+		t.Errorf("expected temp table to survive between requests: %v", err)
+	}
+	m.Release(session)
+
+	m.evict(time.Now().Add(2 * time.Minute))
+	if _, err = m.Acquire(ctx, "", "s", time.Minute, true); err == nil {
+		t.Error("expected idle session to be evicted")
+	}
+}
+
+func TestChSessionManagerPoolWait(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	m := newChSessionManager(db)
+	ctx := context.Background()
+
+	first, err := m.Acquire(ctx, "", "a", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 等待连接池的 Acquire 不能阻塞其它 session 的释放和关闭
+	acquired := make(chan error, 1)
+	go func() {
+		session, err := m.Acquire(ctx, "", "b", time.Minute, false)
+		if err == nil {
+			m.Release(session)
+		}
+		acquired <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		m.Release(first)
+		m.Remove("", "a")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("releasing a session blocked on a pending Acquire")
+	}
+	if err = <-acquired; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChSessionSearchPath(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	c := &ChServer{conn: db, pgServer: &PgServer{}, sessions: newChSessionManager(db), queries: newQueryRegistry()}
+	query := func(params, query string) string {
+		req := httptest.NewRequest(http.MethodPost, "/?session_id=s&"+params, strings.NewReader(query))
+		req.Header.Set("token", AuthToken)
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("%s: %d %s", query, rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+	for _, stmt := range []string{"CREATE SCHEMA a", "CREATE SCHEMA b", "CREATE TABLE a.t AS SELECT 'a' v", "CREATE TABLE b.t AS SELECT 'b' v", "USE a"} {
+		query("", stmt)
+	}
+	// database 参数只对本次请求生效，之后恢复 session 中 USE 的 schema
+	if got := query("database=b", "SELECT v FROM t FORMAT TSV"); got != "b\n" {
+		t.Errorf("got %q with database=b", got)
+	}
+	if got := query("", "SELECT v FROM t FORMAT TSV"); got != "a\n" {
+		t.Errorf("got %q after database=b, want the session's schema", got)
+	}
+}
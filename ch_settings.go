@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuerySettings 一次 http 请求的 clickhouse 设置，来自 url 参数和 SQL 中的 SETTINGS 子句
+type QuerySettings struct {
+	Database           string
+	DefaultFormat      string
+	MaxResultRows      int64
+	ResultOverflowMode string
+	MaxExecutionTime   time.Duration
+	Readonly           int
+	QueryID            string
+	SessionID          string
+	SessionTimeout     time.Duration
+	SessionCheck       bool
+	WaitEndOfQuery     bool
+	MultiQuery         bool
+	// WaitForAsyncInsert /report 等待事件从缓存写入表后再返回
+	WaitForAsyncInsert bool
+	// SendProgressInHttpHeaders 在响应头中发送 X-ClickHouse-Progress 和 X-ClickHouse-Summary
+	SendProgressInHttpHeaders   bool
+	HttpHeadersProgressInterval time.Duration
+	// HttpResponseBufferSize wait_end_of_query=1 时缓存在内存中的最大字节数，超出后写入临时文件
+	HttpResponseBufferSize int64
+	Format                 *FormatSettings
+	// Params url 中 param_ 开头的查询参数，用于替换 {name:Type} 占位符
+	Params map[string]string
+	// User 发起请求的用户，不是设置项，session 按用户区分
+	User string
+	// ClientAddress 客户端地址，不是设置项，显示在 system.processes 中
+	ClientAddress string
+	// Progress 请求的执行进度，不是设置项
+	Progress *chProgress
+	// External multipart 上传的外部数据，在查询使用的连接上创建为临时表
+	External []*chExternalTable
+	// Custom 不认识的设置，保留下来但不生效
+	Custom map[string]string
+}
+
+func defaultQuerySettings() *QuerySettings {
+	return &QuerySettings{
+		DefaultFormat:               "TabSeparated",
+		ResultOverflowMode:          "throw",
+		SessionTimeout:              60 * time.Second,
+		WaitForAsyncInsert:          true,
+		HttpHeadersProgressInterval: 100 * time.Millisecond,
+		HttpResponseBufferSize:      defaultResponseBufferSize,
+		Format:                      defaultFormatSettings(),
+		Params:                      map[string]string{},
+		Custom:                      map[string]string{},
+	}
+}
+
+// defaultResponseBufferSize http_response_buffer_size 的默认值
+const defaultResponseBufferSize = 10 << 20
+
+// chNonSettingParams 不属于设置的 url 参数
+var chNonSettingParams = map[string]bool{
+	"query":                   true,
+	"user":                    true,
+	"password":                true,
+	"quota_key":               true,
+	"compress":                true,
+	"decompress":              true,
+	"enable_http_compression": true,
+}
+
+// parseQuerySettings 从 url 参数中读取设置和 param_ 开头的查询参数
+func parseQuerySettings(values url.Values) (*QuerySettings, error) {
+	settings := defaultQuerySettings()
+	for name, value := range values {
+		if chNonSettingParams[name] || len(value) == 0 {
+			continue
+		}
+		if strings.HasPrefix(name, "param_") {
+			settings.Params[strings.TrimPrefix(name, "param_")] = value[0]
+			continue
+		}
+		if err := settings.Set(name, value[0]); err != nil {
+			return nil, err
+		}
+	}
+	if settings.QueryID == "" {
+		settings.QueryID = newQueryID()
+	}
+	return settings, nil
+}
+
+// Clone SETTINGS 子句只对当前语句生效，先复制再修改
+func (s *QuerySettings) Clone() *QuerySettings {
+	c := *s
+	format := *s.Format
+	c.Format = &format
+	c.Custom = make(map[string]string, len(s.Custom))
+	for k, v := range s.Custom {
+		c.Custom[k] = v
+	}
+	return &c
+}
+
+// Set 按 clickhouse 的设置名修改一项设置
+func (s *QuerySettings) Set(name, value string) error {
+	var err error
+	switch name {
+	case "database":
+		s.Database = value
+	case "default_format":
+		if GetClickhouseOutputFormat(value) == nil && GetClickhouseBlockOutputFormat(value) == nil &&
+			GetClickhouseCopyOutputFormat(value) == "" {
+			return fmt.Errorf("unknown format %s", value)
+		}
+		s.DefaultFormat = value
+	case "max_result_rows":
+		s.MaxResultRows, err = strconv.ParseInt(value, 10, 64)
+	case "result_overflow_mode":
+		if value != "throw" && value != "break" {
+			return fmt.Errorf("unexpected value of result_overflow_mode: %s", value)
+		}
+		s.ResultOverflowMode = value
+	case "max_execution_time":
+		s.MaxExecutionTime, err = parseSecondsSetting(value)
+	case "readonly":
+		s.Readonly, err = strconv.Atoi(value)
+	case "query_id":
+		s.QueryID = value
+	case "session_id":
+		s.SessionID = value
+	case "session_timeout":
+		s.SessionTimeout, err = parseSecondsSetting(value)
+	case "session_check":
+		s.SessionCheck = parseBoolSetting(value)
+	case "wait_end_of_query":
+		s.WaitEndOfQuery = parseBoolSetting(value)
+	case "multiquery":
+		s.MultiQuery = parseBoolSetting(value)
+	case "wait_for_async_insert":
+		s.WaitForAsyncInsert = parseBoolSetting(value)
+	case "send_progress_in_http_headers":
+		s.SendProgressInHttpHeaders = parseBoolSetting(value)
+	case "http_headers_progress_interval_ms":
+		var ms int64
+		ms, err = strconv.ParseInt(value, 10, 64)
+		s.HttpHeadersProgressInterval = time.Duration(ms) * time.Millisecond
+	case "http_response_buffer_size":
+		s.HttpResponseBufferSize, err = strconv.ParseInt(value, 10, 64)
+	case "format_csv_null_representation":
+		s.Format.CSVNullRepresentation = value
+	case "format_tsv_null_representation":
+		s.Format.TSVNullRepresentation = value
+	case "format_csv_delimiter":
+		if len(value) != 1 {
+			return fmt.Errorf("format_csv_delimiter must be a single character")
+		}
+		s.Format.CSVDelimiter = rune(value[0])
+	case "input_format_skip_unknown_fields":
+		s.Format.InputSkipUnknownFields = parseBoolSetting(value)
+	case "input_format_null_as_default":
+		s.Format.InputNullAsDefault = parseBoolSetting(value)
+	case "output_format_csv_crlf_end_of_line":
+		s.Format.CSVCRLF = parseBoolSetting(value)
+	case "output_format_tsv_crlf_end_of_line":
+		s.Format.TSVCRLF = parseBoolSetting(value)
+	case "output_format_json_quote_64bit_integers":
+		s.Format.JSONQuote64bitIntegers = parseBoolSetting(value)
+	default:
+		s.Custom[name] = value
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for setting %s: %w", value, name, err)
+	}
+	return nil
+}
+
+// parseBoolSetting clickhouse 的布尔设置可以是 0/1 或 true/false
+func parseBoolSetting(s string) bool {
+	b, err := strconv.ParseBool(s)
+	return err == nil && b
+}
+
+// parseSecondsSetting 秒数设置，可以带小数
+func parseSecondsSetting(s string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+var settingsClauseRegexp = regexp.MustCompile(`(?is)\s+SETTINGS\s+((?:[a-z_][a-z0-9_]*\s*=\s*(?:'(?:[^'\\]|\\.)*'|[^\s,']+)\s*,?\s*)+?)((?:\s+FORMAT\s+\S+)?[\s;]*)$`)
+var settingsItemRegexp = regexp.MustCompile(`(?is)([a-z_][a-z0-9_]*)\s*=\s*('(?:[^'\\]|\\.)*'|[^\s,']+)`)
+
+// ApplyClause 解析并去掉语句末尾的 SETTINGS a = 1, b = 'x'，FORMAT 子句保留在原位置
+func (s *QuerySettings) ApplyClause(query string) (string, error) {
+	m := settingsClauseRegexp.FindStringSubmatchIndex(query)
+	if m == nil {
+		return query, nil
+	}
+	if s.Readonly == 1 {
+		return "", fmt.Errorf("cannot modify settings in readonly mode")
+	}
+	for _, item := range settingsItemRegexp.FindAllStringSubmatch(query[m[2]:m[3]], -1) {
+		// 和 clickhouse 一样，readonly 模式下不能通过 SETTINGS 子句修改 readonly 本身
+		if s.Readonly > 0 && strings.EqualFold(item[1], "readonly") {
+			return "", fmt.Errorf("cannot modify setting readonly in readonly mode")
+		}
+		value := item[2]
+		if strings.HasPrefix(value, "'") {
+			value = unescapeClickhouseString(value[1 : len(value)-1])
+		}
+		if err := s.Set(strings.ToLower(item[1]), value); err != nil {
+			return "", err
+		}
+	}
+	return query[:m[0]] + query[m[4]:m[5]], nil
+}
+
+// newQueryID 客户端没有指定 query_id 时生成一个 uuid
+func newQueryID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow/ipc"
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestQuerySettings(t *testing.T) {
+	settings, err := parseQuerySettings(url.Values{"database": {"s"}, "max_execution_time": {"1.5"}, "query": {"select 1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Database != "s" || settings.MaxExecutionTime != 1500*time.Millisecond || settings.QueryID == "" {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+
+	clause := settings.Clone()
+	query, err := clause.ApplyClause("SELECT 'SETTINGS' FROM t SETTINGS max_result_rows = 10, format_csv_null_representation='\\'N' FORMAT CSV;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "SELECT 'SETTINGS' FROM t FORMAT CSV;" {
+		t.Errorf("unexpected query %q", query)
+	}
+	if clause.MaxResultRows != 10 || clause.Format.CSVNullRepresentation != "'N" {
+		t.Errorf("unexpected settings %+v", clause)
+	}
+	if settings.MaxResultRows != 0 || settings.Format.CSVNullRepresentation != "\\N" {
+		t.Error("SETTINGS clause must not modify the request settings")
+	}
+
+	if _, err = parseQuerySettings(url.Values{"max_result_rows": {"x"}}); err == nil {
+		t.Error("expected invalid value error")
+	}
+}
+
+func TestReadonlyStatements(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE t (a INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	c := &ChServer{conn: db, pgServer: &PgServer{}, sessions: newChSessionManager(db), queries: newQueryRegistry()}
+	serve := func(req *http.Request) int {
+		req.Header.Set("token", AuthToken)
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	query := func(body, readonly string) int {
+		return serve(httptest.NewRequest(http.MethodPost, "/?readonly="+readonly, strings.NewReader(body)))
+	}
+	// readonly 按 duckdb 的语句类型判断，不看语句开头的关键字
+	for body, code := range map[string]int{
+		"SELECT * FROM t":                      200,
+		"WITH x AS (SELECT 1) SELECT * FROM x": 200,
+		"DESCRIBE t":                           200,
+		"EXPLAIN SELECT 1":                     200,
+		"USE main":                             200,
+		"WITH x AS (SELECT 1) INSERT INTO t SELECT * FROM x": 403,
+		"CALL checkpoint()":                        403,
+		"COPY t TO '/dev/null'":                    403,
+		"EXPLAIN ANALYZE INSERT INTO t VALUES (1)": 403,
+		"SET threads = 1":                          403,
+		"DROP TABLE t":                             403,
+	} {
+		if got := query(body, "1"); got != code {
+			t.Errorf("%s: got %d, want %d", body, got, code)
+		}
+	}
+	// SETTINGS 子句不能关闭 readonly，包括 GET 请求默认的 readonly=2
+	if got := serve(httptest.NewRequest(http.MethodGet, "/?query="+url.QueryEscape("INSERT INTO t VALUES (5) SETTINGS readonly=0"), nil)); got != 400 {
+		t.Errorf("GET insert with readonly=0 clause: got %d", got)
+	}
+	if got := query("DROP TABLE t SETTINGS readonly=0", "2"); got != 400 {
+		t.Errorf("drop with readonly=0 clause: got %d", got)
+	}
+	if got := query("SELECT * FROM t SETTINGS readonly=0", "1"); got != 400 {
+		t.Errorf("select with settings clause in readonly=1: got %d", got)
+	}
+	if got := query("SELECT * FROM t SETTINGS max_result_rows=10", "2"); got != 200 {
+		t.Errorf("select with settings clause in readonly=2: got %d", got)
+	}
+	if got := query("INSERT INTO t VALUES (1)", "0"); got != 200 {
+		t.Errorf("insert without readonly: got %d", got)
+	}
+	var count int
+	if err = db.QueryRow("SELECT count(*) FROM t").Scan(&count); err != nil || count != 1 {
+		t.Errorf("unexpected rows %d %v", count, err)
+	}
+}
+
+func TestMaxResultRowsBlocks(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	c := &ChServer{conn: db, pgServer: &PgServer{}, sessions: newChSessionManager(db), queries: newQueryRegistry()}
+	query := func(settings string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/?"+settings, strings.NewReader("SELECT i FROM range(1000000) t(i) FORMAT ArrowStream"))
+		req.Header.Set("token", AuthToken)
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+		return rec
+	}
+	// 列式格式边读边计数，超出限制时中止；还没有输出时返回错误状态码
+	if rec := query("max_result_rows=10000"); !strings.Contains(rec.Body.String(), "Limit for result exceeded, max rows: 10000") {
+		t.Errorf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := query("max_result_rows=1000"); rec.Code != 500 || rec.Body.String() != "Limit for result exceeded, max rows: 1000" {
+		t.Errorf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	rec := query("max_result_rows=10000&result_overflow_mode=break")
+	if rec.Code != 200 {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	reader, err := ipc.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows int64
+	for reader.Next() {
+		rows += reader.Record().NumRows()
+	}
+	reader.Release()
+	if rows != 10000 {
+		t.Errorf("got %d rows", rows)
+	}
+}
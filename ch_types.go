@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+var typesMapping = map[string]string{
+	"BOOLEAN":      "Bool",
+	"TINYINT":      "Int8",
+	"SMALLINT":     "Int16",
+	"INTEGER":      "Int32",
+	"BIGINT":       "Int64",
+	"HUGEINT":      "Int128",
+	"UTINYINT":     "UInt8",
+	"USMALLINT":    "UInt16",
+	"UINTEGER":     "UInt32",
+	"UBIGINT":      "UInt64",
+	"UHUGEINT":     "UInt128",
+	"FLOAT":        "Float32",
+	"DOUBLE":       "Float64",
+	"VARCHAR":      "String",
+	"BLOB":         "String",
+	"UUID":         "UUID",
+	"DATE":         "Date32",
+	"TIMESTAMP_S":  "DateTime",
+	"TIMESTAMP_MS": "DateTime64(3)",
+	"TIMESTAMP":    "DateTime64(6)",
+	"TIMESTAMP_NS": "DateTime64(9)",
+	"TIMESTAMPTZ":  "DateTime64(6, 'UTC')",
+}
+
+// clickhouseTypeName 把 duckdb 类型映射为 clickhouse 类型名，duckdb 的列都可以为 NULL，
+// 标量类型包装为 Nullable，clickhouse 不允许 Nullable(Array/Map/Tuple)
+func clickhouseTypeName(t *duckType, nullable bool) string {
+	var name string
+	switch t.name {
+	case "LIST", "ARRAY":
+		return "Array(" + clickhouseTypeName(t.children[0], true) + ")"
+	case "MAP":
+		return fmt.Sprintf("Map(%s, %s)", clickhouseTypeName(t.children[0], false), clickhouseTypeName(t.children[1], true))
+	case "STRUCT":
+		elements := make([]string, len(t.children))
+		for i, child := range t.children {
+			elements[i] = quoteClickhouseIdentifier(t.names[i]) + " " + clickhouseTypeName(child, true)
+		}
+		return "Tuple(" + strings.Join(elements, ", ") + ")"
+	case "DECIMAL":
+		name = fmt.Sprintf("Decimal(%d, %d)", t.width, t.scale)
+	default:
+		name = typesMapping[t.name]
+		if name == "" {
+			name = "String"
+		}
+	}
+	if nullable {
+		return "Nullable(" + name + ")"
+	}
+	return name
+}
+
+func typesToClickhouseTypes(types []string) []string {
+	clickhouseTypes := make([]string, len(types))
+	for i, typ := range types {
+		t, err := parseDuckType(typ)
+		if err != nil {
+			clickhouseTypes[i] = "Nullable(String)"
+			continue
+		}
+		clickhouseTypes[i] = clickhouseTypeName(t, true)
+	}
+	return clickhouseTypes
+}
+
+// isClickhouseTextUnquoted CSV 中数值和布尔不加引号，其余类型都加双引号
+func isClickhouseTextUnquoted(t *duckType) bool {
+	switch t.name {
+	case "BOOLEAN", "TINYINT", "SMALLINT", "INTEGER", "BIGINT", "HUGEINT", "UTINYINT", "USMALLINT",
+		"UINTEGER", "UBIGINT", "UHUGEINT", "FLOAT", "DOUBLE", "DECIMAL":
+		return true
+	}
+	return false
+}
+
+// isClickhouseComposite 复合类型的文本本身已经带引号和转义
+func isClickhouseComposite(t *duckType) bool {
+	switch t.name {
+	case "LIST", "ARRAY", "MAP", "STRUCT":
+		return true
+	}
+	return false
+}
+
+var clickhouseTimeLayouts = map[string]string{
+	"DATE":         "2006-01-02",
+	"TIMESTAMP_S":  "2006-01-02 15:04:05",
+	"TIMESTAMP_MS": "2006-01-02 15:04:05.000",
+	"TIMESTAMP":    "2006-01-02 15:04:05.000000",
+	"TIMESTAMP_NS": "2006-01-02 15:04:05.000000000",
+	"TIMESTAMPTZ":  "2006-01-02 15:04:05.000000",
+	"TIME":         "15:04:05.999999",
+}
+
+func formatClickhouseFloat(f float64, bitSize int) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, bitSize)
+}
+
+// formatClickhouseText 按 clickhouse 的文本格式输出一个值，quoted 为 true 时字符串等加单引号(用于数组等复合类型内部)
+func formatClickhouseText(v any, t *duckType, quoted bool) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		if quoted {
+			return quoteClickhouseString(val)
+		}
+		return val
+	case []byte:
+		s := string(val)
+		if t.name == "UUID" && len(val) == 16 {
+			h := hex.EncodeToString(val)
+			s = h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+		}
+		if quoted {
+			return quoteClickhouseString(s)
+		}
+		return s
+	case bool:
+		if val {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return formatClickhouseFloat(val, 64)
+	case float32:
+		return formatClickhouseFloat(float64(val), 32)
+	case time.Time:
+		layout, ok := clickhouseTimeLayouts[t.name]
+		if !ok {
+			layout = "2006-01-02 15:04:05"
+		}
+		if quoted {
+			return "'" + val.Format(layout) + "'"
+		}
+		return val.Format(layout)
+	case duckdb.Decimal:
+		return duckDecimalToString(val)
+	case *big.Int:
+		return val.String()
+	case []any:
+		elemType := &duckType{name: "VARCHAR"}
+		if len(t.children) > 0 {
+			elemType = t.children[0]
+		}
+		elements := make([]string, len(val))
+		for i, e := range val {
+			elements[i] = formatClickhouseText(e, elemType, true)
+		}
+		return "[" + strings.Join(elements, ",") + "]"
+	case map[string]any:
+		names := t.names
+		if len(names) != len(val) {
+			names = make([]string, 0, len(val))
+			for name := range val {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		elements := make([]string, len(names))
+		for i, name := range names {
+			fieldType := &duckType{name: "VARCHAR"}
+			if i < len(t.children) {
+				fieldType = t.children[i]
+			}
+			elements[i] = formatClickhouseText(val[name], fieldType, true)
+		}
+		return "(" + strings.Join(elements, ",") + ")"
+	case duckdb.Map:
+		keyType, valueType := &duckType{name: "VARCHAR"}, &duckType{name: "VARCHAR"}
+		if len(t.children) == 2 {
+			keyType, valueType = t.children[0], t.children[1]
+		}
+		elements := make([]string, 0, len(val))
+		for k, e := range val {
+			elements = append(elements, formatClickhouseText(k, keyType, true)+":"+formatClickhouseText(e, valueType, true))
+		}
+		sort.Strings(elements)
+		return "{" + strings.Join(elements, ",") + "}"
+	}
+	s := duckValueToString(v)
+	if quoted && !isClickhouseTextUnquoted(t) {
+		return quoteClickhouseString(s)
+	}
+	return s
+}
+
+var clickhouseEscapes = map[byte]byte{
+	'\b': 'b',
+	'\f': 'f',
+	'\n': 'n',
+	'\r': 'r',
+	'\t': 't',
+	0:    '0',
+	'\'': '\'',
+	'\\': '\\',
+}
+
+var clickhouseUnescapes = map[byte]byte{
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'0':  0,
+	'\'': '\'',
+	'\\': '\\',
+}
+
+// escapeClickhouseString clickhouse TabSeparated 的反斜杠转义
+func escapeClickhouseString(s string) string {
+	needEscape := false
+	for i := 0; i < len(s); i++ {
+		if _, ok := clickhouseEscapes[s[i]]; ok {
+			needEscape = true
+			break
+		}
+	}
+	if !needEscape {
+		return s
+	}
+	sb := strings.Builder{}
+	sb.Grow(len(s) + 8)
+	for i := 0; i < len(s); i++ {
+		if e, ok := clickhouseEscapes[s[i]]; ok {
+			sb.WriteByte('\\')
+			sb.WriteByte(e)
+		} else {
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+func unescapeClickhouseString(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	sb := strings.Builder{}
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		if u, ok := clickhouseUnescapes[s[i]]; ok {
+			sb.WriteByte(u)
+		} else {
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+func quoteClickhouseString(s string) string {
+	return "'" + escapeClickhouseString(s) + "'"
+}
+
+// parseClickhouseLiteral 解析 clickhouse 文本格式中的复合值，数组和元组返回 []any，Map 返回 duckdb.Map，
+// 带引号的字符串去掉引号并反转义，NULL 返回 nil，其余原样返回字符串交给后续类型转换
+func parseClickhouseLiteral(s string) (any, error) {
+	p := &clickhouseLiteralParser{s: s}
+	v, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at position %d in %q", p.s[p.pos:], p.pos, s)
+	}
+	return v, nil
+}
+
+type clickhouseLiteralParser struct {
+	s   string
+	pos int
+}
+
+func (p *clickhouseLiteralParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n') {
+		p.pos++
+	}
+}
+
+func (p *clickhouseLiteralParser) parse() (any, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("unexpected end of %q", p.s)
+	}
+	switch p.s[p.pos] {
+	case '[':
+		return p.parseList(']')
+	case '(':
+		return p.parseList(')')
+	case '{':
+		return p.parseMap()
+	case '\'':
+		return p.parseString()
+	}
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(",:])} \t\n", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	token := p.s[start:p.pos]
+	if token == "NULL" || token == "\\N" {
+		return nil, nil
+	}
+	return token, nil
+}
+
+func (p *clickhouseLiteralParser) parseList(end byte) (any, error) {
+	p.pos++
+	list := make([]any, 0)
+	p.skipSpaces()
+	if p.pos < len(p.s) && p.s[p.pos] == end {
+		p.pos++
+		return list, nil
+	}
+	for {
+		v, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.skipSpaces()
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("unexpected end of %q", p.s)
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case end:
+			p.pos++
+			return list, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d in %q", p.s[p.pos], p.pos, p.s)
+		}
+	}
+}
+
+func (p *clickhouseLiteralParser) parseMap() (any, error) {
+	p.pos++
+	m := duckdb.Map{}
+	p.skipSpaces()
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+		return m, nil
+	}
+	for {
+		k, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.pos >= len(p.s) || p.s[p.pos] != ':' {
+			return nil, fmt.Errorf("expected ':' at position %d in %q", p.pos, p.s)
+		}
+		p.pos++
+		if m[k], err = p.parse(); err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("unexpected end of %q", p.s)
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return m, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d in %q", p.s[p.pos], p.pos, p.s)
+		}
+	}
+}
+
+func (p *clickhouseLiteralParser) parseString() (any, error) {
+	p.pos++
+	start := p.pos
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '\\':
+			p.pos += 2
+		case '\'':
+			v := unescapeClickhouseString(p.s[start:p.pos])
+			p.pos++
+			return v, nil
+		default:
+			p.pos++
+		}
+	}
+	return nil, fmt.Errorf("unterminated string in %q", p.s)
+}
+
+var clickhouseToDuckTypes = map[string]string{
+	"Bool":        "BOOLEAN",
+	"Int8":        "TINYINT",
+	"Int16":       "SMALLINT",
+	"Int32":       "INTEGER",
+	"Int64":       "BIGINT",
+	"Int128":      "HUGEINT",
+	"Int256":      "HUGEINT",
+	"UInt8":       "UTINYINT",
+	"UInt16":      "USMALLINT",
+	"UInt32":      "UINTEGER",
+	"UInt64":      "UBIGINT",
+	"UInt128":     "UHUGEINT",
+	"UInt256":     "UHUGEINT",
+	"Float32":     "FLOAT",
+	"Float64":     "DOUBLE",
+	"String":      "VARCHAR",
+	"FixedString": "VARCHAR",
+	"UUID":        "UUID",
+	"Date":        "DATE",
+	"Date32":      "DATE",
+	"DateTime":    "TIMESTAMP",
+	"DateTime64":  "TIMESTAMP",
+	"IPv4":        "VARCHAR",
+	"IPv6":        "VARCHAR",
+	"Enum8":       "VARCHAR",
+	"Enum16":      "VARCHAR",
+}
+
+// duckTypeFromClickhouse 把 clickhouse 类型名映射为 duckdb 类型，nullable 表示是否为 Nullable(T)
+func duckTypeFromClickhouse(typ string) (t *duckType, nullable bool, err error) {
+	name, args := parseClickhouseTypeName(typ)
+	switch name {
+	case "Nullable":
+		if len(args) != 1 {
+			return nil, false, fmt.Errorf("invalid type %s", typ)
+		}
+		t, _, err = duckTypeFromClickhouse(args[0])
+		return t, true, err
+	case "LowCardinality":
+		if len(args) != 1 {
+			return nil, false, fmt.Errorf("invalid type %s", typ)
+		}
+		return duckTypeFromClickhouse(args[0])
+	case "Array":
+		if len(args) != 1 {
+			return nil, false, fmt.Errorf("invalid type %s", typ)
+		}
+		elem, _, err := duckTypeFromClickhouse(args[0])
+		if err != nil {
+			return nil, false, err
+		}
+		return &duckType{name: "LIST", children: []*duckType{elem}}, false, nil
+	case "Map":
+		if len(args) != 2 {
+			return nil, false, fmt.Errorf("invalid type %s", typ)
+		}
+		t = &duckType{name: "MAP"}
+		for _, arg := range args {
+			child, _, err := duckTypeFromClickhouse(arg)
+			if err != nil {
+				return nil, false, err
+			}
+			t.children = append(t.children, child)
+		}
+		return t, false, nil
+	case "Tuple":
+		t = &duckType{name: "STRUCT"}
+		for i, arg := range args {
+			// 具名元素 `name Type`，不具名的按位置命名
+			fieldName, fieldType := fmt.Sprintf("f%d", i+1), arg
+			if idx := strings.IndexByte(arg, ' '); idx > 0 && !strings.Contains(arg[:idx], "(") {
+				if _, ok := clickhouseToDuckTypes[arg[:idx]]; !ok {
+					fieldName, fieldType = strings.Trim(arg[:idx], "`\""), strings.TrimSpace(arg[idx+1:])
+				}
+			}
+			child, _, err := duckTypeFromClickhouse(fieldType)
+			if err != nil {
+				return nil, false, err
+			}
+			t.names = append(t.names, fieldName)
+			t.children = append(t.children, child)
+		}
+		return t, false, nil
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		precision := map[string]int{"Decimal32": 9, "Decimal64": 18, "Decimal128": 38, "Decimal256": 38}[name]
+		var scale int
+		switch {
+		case name == "Decimal" && len(args) == 2:
+			precision, err = strconv.Atoi(args[0])
+			if err == nil {
+				scale, err = strconv.Atoi(args[1])
+			}
+		case name != "Decimal" && len(args) == 1:
+			scale, err = strconv.Atoi(args[0])
+		default:
+			err = fmt.Errorf("invalid type %s", typ)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		// duckdb 的 DECIMAL 最大精度是 38
+		if precision > 38 {
+			precision = 38
+		}
+		return &duckType{name: "DECIMAL", width: precision, scale: scale}, false, nil
+	case "DateTime", "DateTime64":
+		// 带时区参数的 DateTime 对应 TIMESTAMPTZ
+		if (name == "DateTime" && len(args) == 1) || (name == "DateTime64" && len(args) == 2) {
+			return &duckType{name: "TIMESTAMPTZ"}, false, nil
+		}
+	}
+	duckName, ok := clickhouseToDuckTypes[name]
+	if !ok {
+		return nil, false, fmt.Errorf("unsupported type %s", typ)
+	}
+	return &duckType{name: duckName}, false, nil
+}
@@ -0,0 +1,448 @@
+package main
+
+/*
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdlib.h>
+
+// duckdb.h 中的声明，符号由 go-duckdb 链接的 libduckdb 提供
+struct ArrowArrayStream {
+	void *get_schema;
+	void *get_next;
+	void *get_last_error;
+	void *release;
+	void *private_data;
+};
+typedef struct _duckdb_connection { void *internal_ptr; } *duckdb_connection;
+typedef struct _duckdb_prepared_statement { void *internal_ptr; } *duckdb_prepared_statement;
+typedef struct _duckdb_arrow_stream { void *internal_ptr; } *duckdb_arrow_stream;
+typedef struct _duckdb_arrow_array { void *internal_ptr; } *duckdb_arrow_array;
+typedef struct _duckdb_data_chunk { void *internal_ptr; } *duckdb_data_chunk;
+typedef uint64_t idx_t;
+typedef struct {
+	idx_t __deprecated_column_count;
+	idx_t __deprecated_row_count;
+	idx_t __deprecated_rows_changed;
+	void *__deprecated_columns;
+	char *__deprecated_error_message;
+	void *internal_data;
+} duckdb_result;
+typedef struct { int64_t micros; } duckdb_timestamp;
+typedef enum { DuckDBSuccess = 0, DuckDBError = 1 } duckdb_state;
+typedef struct {
+	double percentage;
+	uint64_t rows_processed;
+	uint64_t total_rows_to_process;
+} duckdb_query_progress_type;
+duckdb_state duckdb_arrow_scan(duckdb_connection connection, const char *table_name, duckdb_arrow_stream arrow);
+duckdb_state duckdb_prepare(duckdb_connection connection, const char *query, duckdb_prepared_statement *out_prepared_statement);
+const char *duckdb_prepare_error(duckdb_prepared_statement prepared_statement);
+int duckdb_prepared_statement_type(duckdb_prepared_statement statement);
+void duckdb_destroy_prepare(duckdb_prepared_statement *prepared_statement);
+duckdb_query_progress_type duckdb_query_progress(duckdb_connection connection);
+void duckdb_interrupt(duckdb_connection connection);
+duckdb_state duckdb_bind_null(duckdb_prepared_statement prepared_statement, idx_t param_idx);
+duckdb_state duckdb_bind_boolean(duckdb_prepared_statement prepared_statement, idx_t param_idx, bool val);
+duckdb_state duckdb_bind_int64(duckdb_prepared_statement prepared_statement, idx_t param_idx, int64_t val);
+duckdb_state duckdb_bind_uint64(duckdb_prepared_statement prepared_statement, idx_t param_idx, uint64_t val);
+duckdb_state duckdb_bind_double(duckdb_prepared_statement prepared_statement, idx_t param_idx, double val);
+duckdb_state duckdb_bind_timestamp(duckdb_prepared_statement prepared_statement, idx_t param_idx, duckdb_timestamp val);
+duckdb_state duckdb_bind_varchar_length(duckdb_prepared_statement prepared_statement, idx_t param_idx, const char *val, idx_t length);
+idx_t duckdb_column_count(duckdb_result *result);
+const char *duckdb_column_name(duckdb_result *result, idx_t col);
+duckdb_state duckdb_execute_prepared_streaming(duckdb_prepared_statement prepared_statement, duckdb_result *out_result);
+const char *duckdb_result_error(duckdb_result *result);
+void duckdb_destroy_result(duckdb_result *result);
+duckdb_data_chunk duckdb_fetch_chunk(duckdb_result result);
+void duckdb_destroy_data_chunk(duckdb_data_chunk *chunk);
+void duckdb_result_arrow_array(duckdb_result result, duckdb_data_chunk chunk, duckdb_arrow_array *out_array);
+
+// arrow C data interface 的 ArrowArray，与 cdata/abi.h 一致
+struct ArrowArray {
+	int64_t length;
+	int64_t null_count;
+	int64_t offset;
+	int64_t n_buffers;
+	int64_t n_children;
+	const void **buffers;
+	struct ArrowArray **children;
+	struct ArrowArray *dictionary;
+	void (*release)(struct ArrowArray *);
+	void *private_data;
+};
+
+static void release_borrowed_array(struct ArrowArray *arr) {
+	arr->release = NULL;
+}
+
+// borrow_arrow_array 复制 ArrowArray 的结构体（不复制数据），release 为空操作，
+// 导入后的内存仍由原数组持有，可以在用完后立即释放，不依赖 go 的 finalizer
+static struct ArrowArray *borrow_arrow_array(struct ArrowArray *src) {
+	struct ArrowArray *dst = malloc(sizeof(struct ArrowArray));
+	*dst = *src;
+	dst->release = release_borrowed_array;
+	dst->private_data = NULL;
+	if (src->n_children > 0) {
+		dst->children = malloc(sizeof(struct ArrowArray *) * src->n_children);
+		for (int64_t i = 0; i < src->n_children; i++) {
+			dst->children[i] = borrow_arrow_array(src->children[i]);
+		}
+	}
+	if (src->dictionary) {
+		dst->dictionary = borrow_arrow_array(src->dictionary);
+	}
+	return dst;
+}
+
+static void free_borrowed_array(struct ArrowArray *arr) {
+	if (arr->n_children > 0) {
+		for (int64_t i = 0; i < arr->n_children; i++) {
+			free_borrowed_array(arr->children[i]);
+		}
+		free(arr->children);
+	}
+	if (arr->dictionary) {
+		free_borrowed_array(arr->dictionary);
+	}
+	free(arr);
+}
+
+// duckdb 不会释放传入的 stream
+static void release_arrow_stream(struct ArrowArrayStream *stream) {
+	if (stream->release) {
+		((void (*)(struct ArrowArrayStream *))stream->release)(stream);
+	}
+}
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/cdata"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// go-duckdb v1.7 没有导出的 C API，这里直接调用 libduckdb
+
+// duckdb_statement_type 中用到的值
+const (
+	duckdbStatementSelect  = 1
+	duckdbStatementExplain = 4
+	duckdbStatementSet     = 20
+)
+
+// duckdbDriverVersion 和 duckdbConnectionType 是 duckdbConnection 依赖的 go-duckdb 版本和内部字段的类型，
+// go.mod 固定了这个版本，升级前必须确认 conn.duckdbCon 没有变化，duckdb_capi_test.go 会检查
+const (
+	duckdbDriverVersion  = "v1.7.0"
+	duckdbConnectionType = "duckdb._Ctype_duckdb_connection"
+)
+
+// duckdbConnection 取出 go-duckdb 连接中的 duckdb_connection，字段不存在或类型不同时返回错误，不会读取其他内存
+func duckdbConnection(conn driver.Conn) (C.duckdb_connection, error) {
+	con := reflect.ValueOf(conn)
+	if con.Kind() == reflect.Pointer {
+		con = con.Elem()
+	}
+	var handle reflect.Value
+	if con.Kind() == reflect.Struct {
+		handle = con.FieldByName("duckdbCon")
+	}
+	if !handle.IsValid() || handle.Type().String() != duckdbConnectionType || handle.Type().PkgPath() != "github.com/marcboeker/go-duckdb" ||
+		handle.Type().Size() != unsafe.Sizeof(C.duckdb_connection(nil)) {
+		return nil, fmt.Errorf("unsupported duckdb connection %T, duckserver requires go-duckdb %s", conn, duckdbDriverVersion)
+	}
+	if handle.IsNil() {
+		return nil, errors.New("duckdb connection is closed")
+	}
+	return *(*C.duckdb_connection)(unsafe.Pointer(handle.UnsafeAddr())), nil
+}
+
+// registerArrowView 用 duckdb_arrow_scan 把 reader 注册为视图，视图只能扫描一次，用完后需要删除。
+// 和新版本 go-duckdb 的 Arrow.RegisterView 实现一样
+func registerArrowView(conn driver.Conn, reader array.RecordReader, name string) (release func(), err error) {
+	con, err := duckdbConnection(conn)
+	if err != nil {
+		return nil, err
+	}
+	stream := C.calloc(1, C.sizeof_struct_ArrowArrayStream)
+	release = func() {
+		C.release_arrow_stream((*C.struct_ArrowArrayStream)(stream))
+		C.free(stream)
+	}
+	cdata.ExportRecordReader(reader, (*cdata.CArrowArrayStream)(stream))
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	if C.duckdb_arrow_scan(con, cName, C.duckdb_arrow_stream(stream)) != C.DuckDBSuccess {
+		release()
+		return nil, errors.New("duckdb_arrow_scan failed")
+	}
+	return release, nil
+}
+
+// duckdbStatementType 在连接上准备语句但不执行，返回 duckdb_statement_type
+func duckdbStatementType(conn driver.Conn, query string) (int, error) {
+	con, err := duckdbConnection(conn)
+	if err != nil {
+		return 0, err
+	}
+	cQuery := C.CString(query)
+	defer C.free(unsafe.Pointer(cQuery))
+	var stmt C.duckdb_prepared_statement
+	defer C.duckdb_destroy_prepare(&stmt)
+	if C.duckdb_prepare(con, cQuery, &stmt) != C.DuckDBSuccess {
+		return 0, errors.New(C.GoString(C.duckdb_prepare_error(stmt)))
+	}
+	return int(C.duckdb_prepared_statement_type(stmt)), nil
+}
+
+// duckdbProgress 读取连接上正在执行的查询的进度，需要先在连接上 SET enable_progress_bar = true。
+// duckdb 的进度是原子变量，可以在其他 goroutine 执行查询时读取
+type duckdbProgress struct {
+	con C.duckdb_connection
+}
+
+func newDuckdbProgress(conn driver.Conn) (*duckdbProgress, error) {
+	con, err := duckdbConnection(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &duckdbProgress{con: con}, nil
+}
+
+// Read 返回已经处理和总共需要处理的行数，连接上没有正在执行的查询时 ok 为 false
+func (p *duckdbProgress) Read() (rows, total int64, ok bool) {
+	progress := C.duckdb_query_progress(p.con)
+	if progress.percentage < 0 {
+		return 0, 0, false
+	}
+	return int64(progress.rows_processed), int64(progress.total_rows_to_process), true
+}
+
+// duckdbArrowReader 用 duckdb 的流式结果逐个 chunk 读取查询结果并转为 arrow record，
+// go-duckdb 的 Arrow.QueryContext 会先把整个结果读入内存
+type duckdbArrowReader struct {
+	refs   atomic.Int64
+	stmt   C.duckdb_prepared_statement
+	result C.duckdb_result
+	schema *arrow.Schema
+	rec    arrow.Record
+	err    error
+	// stop 取消 context 结束时中断查询的回调
+	stop func() bool
+	ctx  context.Context
+}
+
+// queryDuckdbArrow 在连接上流式执行一条可以作为子查询的语句，返回的 reader 必须调用 Release。
+// duckdb 1.0 的 C API 不能取得流式结果的 arrow schema，先用 go-duckdb 执行 LIMIT 0 得到列的 arrow 类型
+func queryDuckdbArrow(ctx context.Context, conn driver.Conn, query string, args []any) (*duckdbArrowReader, error) {
+	con, err := duckdbConnection(conn)
+	if err != nil {
+		return nil, err
+	}
+	ar, err := duckdb.NewArrowFromConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	typed, err := ar.QueryContext(ctx, "SELECT * FROM ("+strings.TrimRight(query, "; \t\n")+") LIMIT 0", args...)
+	if err != nil {
+		return nil, err
+	}
+	schema := typed.Schema()
+	typed.Release()
+
+	r := &duckdbArrowReader{ctx: ctx}
+	r.refs.Add(1)
+	cQuery := C.CString(query)
+	defer C.free(unsafe.Pointer(cQuery))
+	if C.duckdb_prepare(con, cQuery, &r.stmt) != C.DuckDBSuccess {
+		err = errors.New(C.GoString(C.duckdb_prepare_error(r.stmt)))
+		C.duckdb_destroy_prepare(&r.stmt)
+		return nil, err
+	}
+	if err = r.bind(args); err != nil {
+		C.duckdb_destroy_prepare(&r.stmt)
+		return nil, err
+	}
+	r.stop = context.AfterFunc(ctx, func() {
+		C.duckdb_interrupt(con)
+	})
+	if C.duckdb_execute_prepared_streaming(r.stmt, &r.result) != C.DuckDBSuccess {
+		err = r.resultError()
+		r.Release()
+		return nil, err
+	}
+	// 子查询中重复的列名会被改名，列名使用原语句的结果
+	if n := int(C.duckdb_column_count(&r.result)); n != len(schema.Fields()) {
+		r.Release()
+		return nil, fmt.Errorf("result has %d columns, expected %d", n, len(schema.Fields()))
+	}
+	fields := schema.Fields()
+	for i := range fields {
+		fields[i].Name = C.GoString(C.duckdb_column_name(&r.result, C.idx_t(i)))
+	}
+	metadata := schema.Metadata()
+	r.schema = arrow.NewSchema(fields, &metadata)
+	return r, nil
+}
+func (r *duckdbArrowReader) bind(args []any) error {
+	for i, arg := range args {
+		idx := C.idx_t(i + 1)
+		var state C.duckdb_state
+		switch v := arg.(type) {
+		case nil:
+			state = C.duckdb_bind_null(r.stmt, idx)
+		case bool:
+			state = C.duckdb_bind_boolean(r.stmt, idx, C.bool(v))
+		case int8, int16, int32, int64, int:
+			state = C.duckdb_bind_int64(r.stmt, idx, C.int64_t(reflect.ValueOf(v).Int()))
+		case uint8, uint16, uint32, uint64, uint:
+			state = C.duckdb_bind_uint64(r.stmt, idx, C.uint64_t(reflect.ValueOf(v).Uint()))
+		case float32, float64:
+			state = C.duckdb_bind_double(r.stmt, idx, C.double(reflect.ValueOf(v).Float()))
+		case string:
+			cValue := C.CString(v)
+			state = C.duckdb_bind_varchar_length(r.stmt, idx, cValue, C.idx_t(len(v)))
+			C.free(unsafe.Pointer(cValue))
+		case time.Time:
+			state = C.duckdb_bind_timestamp(r.stmt, idx, C.duckdb_timestamp{micros: C.int64_t(v.UTC().UnixMicro())})
+		default:
+			return fmt.Errorf("cannot bind parameter %d of type %T", i+1, arg)
+		}
+		if state != C.DuckDBSuccess {
+			return fmt.Errorf("cannot bind parameter %d", i+1)
+		}
+	}
+	return nil
+}
+
+func (r *duckdbArrowReader) resultError() error {
+	if r.ctx.Err() != nil {
+		return r.ctx.Err()
+	}
+	if msg := C.duckdb_result_error(&r.result); msg != nil {
+		return errors.New(C.GoString(msg))
+	}
+	return nil
+}
+
+func (r *duckdbArrowReader) Schema() *arrow.Schema {
+	return r.schema
+}
+
+// Next 读取下一个 chunk，上一个 record 随之释放
+func (r *duckdbArrowReader) Next() bool {
+	if r.rec != nil {
+		r.rec.Release()
+		r.rec = nil
+	}
+	if r.err != nil {
+		return false
+	}
+	chunk := C.duckdb_fetch_chunk(r.result)
+	if chunk == nil {
+		r.err = r.resultError()
+		return false
+	}
+	defer C.duckdb_destroy_data_chunk(&chunk)
+	arr := C.calloc(1, C.size_t(unsafe.Sizeof(cdata.CArrowArray{})))
+	defer func() {
+		cdata.ReleaseCArrowArray((*cdata.CArrowArray)(arr))
+		C.free(arr)
+	}()
+	C.duckdb_result_arrow_array(r.result, chunk, (*C.duckdb_arrow_array)(unsafe.Pointer(&arr)))
+	// cdata 导入的内存要等 GC 执行 finalizer 才释放，go 堆很小时 GC 很少触发，duckdb 的内存会一直累积，
+	// 这里导入借用的数组并复制到 go 内存，原数组随后立即释放
+	borrowed := C.borrow_arrow_array((*C.struct_ArrowArray)(arr))
+	defer C.free_borrowed_array(borrowed)
+	rec, err := cdata.ImportCRecordBatchWithSchema((*cdata.CArrowArray)(unsafe.Pointer(borrowed)), r.schema)
+	if err != nil {
+		r.err = err
+		return false
+	}
+	defer rec.Release()
+	r.rec, r.err = copyRecord(rec)
+	return r.err == nil
+}
+
+// copyRecord 把 rec 的数据复制到 go 分配的内存
+func copyRecord(rec arrow.Record) (arrow.Record, error) {
+	cols := make([]arrow.Array, rec.NumCols())
+	for i, col := range rec.Columns() {
+		data := copyArrayData(col.Data())
+		cols[i] = array.MakeFromData(data)
+		data.Release()
+	}
+	out := array.NewRecord(rec.Schema(), cols, rec.NumRows())
+	for _, col := range cols {
+		col.Release()
+	}
+	return out, nil
+}
+
+// copyArrayData 逐个复制 buffer，包括子数组和字典
+func copyArrayData(d arrow.ArrayData) *array.Data {
+	buffers := make([]*memory.Buffer, len(d.Buffers()))
+	for i, b := range d.Buffers() {
+		if b != nil {
+			buffers[i] = memory.NewBufferBytes(slices.Clone(b.Bytes()))
+		}
+	}
+	if d.DataType().ID() == arrow.DICTIONARY {
+		dictData := copyArrayData(d.Dictionary())
+		defer dictData.Release()
+		return array.NewDataWithDictionary(d.DataType(), d.Len(), buffers, d.NullN(), d.Offset(), dictData)
+	}
+	children := make([]arrow.ArrayData, len(d.Children()))
+	for i, child := range d.Children() {
+		children[i] = copyArrayData(child)
+	}
+	data := array.NewData(d.DataType(), d.Len(), buffers, children, d.NullN(), d.Offset())
+	for _, child := range children {
+		child.Release()
+	}
+	return data
+}
+
+func (r *duckdbArrowReader) Record() arrow.Record {
+	return r.rec
+}
+
+func (r *duckdbArrowReader) Err() error {
+	return r.err
+}
+
+func (r *duckdbArrowReader) Retain() {
+	r.refs.Add(1)
+}
+
+func (r *duckdbArrowReader) Release() {
+	if r.refs.Add(-1) != 0 {
+		return
+	}
+	if r.rec != nil {
+		r.rec.Release()
+		r.rec = nil
+	}
+	if r.stop != nil {
+		r.stop()
+		r.stop = nil
+	}
+	if r.stmt != nil {
+		C.duckdb_destroy_result(&r.result)
+		C.duckdb_destroy_prepare(&r.stmt)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// TestDuckdbConnection 升级 go-duckdb 后 conn.duckdbCon 变化时在这里失败，而不是在运行时读错内存
+func TestDuckdbConnection(t *testing.T) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		t.Fatal("no build info")
+	}
+	version := ""
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/marcboeker/go-duckdb" {
+			version = dep.Version
+		}
+	}
+	if version != duckdbDriverVersion {
+		t.Fatalf("go-duckdb %q is not supported by duckdb_capi.go, expected %s", version, duckdbDriverVersion)
+	}
+
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn any) error {
+		if _, err := duckdbConnection(driverConn.(driver.Conn)); err != nil {
+			return err
+		}
+		typ, err := duckdbStatementType(driverConn.(driver.Conn), "SELECT 1")
+		if err == nil && typ != duckdbStatementSelect {
+			t.Errorf("unexpected statement type %d", typ)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = duckdbConnection(&struct{ driver.Conn }{}); err == nil {
+		t.Error("expected other connections to be rejected")
+	}
+}
+
+func TestQueryDuckdbArrow(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 结果按 chunk 流式读取，参数按类型绑定
+	query := `SELECT i, 'v' || i AS s, CAST(? AS VARCHAR) AS p, CAST(? AS BIGINT) AS q, CAST(? AS TIMESTAMP) AS ts FROM range(100000) t(i)`
+	reader, err := queryDuckdbArrow(context.Background(), conn, query, []any{"x", int32(5), time.Unix(1, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows, chunks int64
+	for reader.Next() {
+		rec := reader.Record()
+		if rec.NumRows() > 2048 {
+			t.Fatalf("unexpected chunk of %d rows", rec.NumRows())
+		}
+		if chunks == 0 && (rec.Column(2).ValueStr(0) != "x" || rec.Column(3).ValueStr(0) != "5" || !strings.HasPrefix(rec.Column(4).ValueStr(0), "1970-01-01 00:00:01")) {
+			t.Errorf("unexpected first row %v", rec)
+		}
+		rows += rec.NumRows()
+		chunks++
+	}
+	reader.Release()
+	if reader.Err() != nil || rows != 100000 || chunks < 2 {
+		t.Fatalf("read %d rows in %d chunks: %v", rows, chunks, reader.Err())
+	}
+	ar, err := duckdb.NewArrowFromConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ar.QueryContext(context.Background(), query, "x", int32(5), time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expected.Schema().Equal(reader.Schema()) {
+		t.Errorf("schema %s, want %s", reader.Schema(), expected.Schema())
+	}
+	expected.Release()
+
+	// 取消 context 时中断查询
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err = queryDuckdbArrow(ctx, conn, "SELECT i FROM range(1000000000) t(i) WHERE i % 3 = 0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for reader.Next() {
+	}
+	reader.Release()
+	if reader.Err() == nil {
+		t.Error("expected cancelled query to fail")
+	}
+
+	// 重复的列名保持原样
+	reader, err = queryDuckdbArrow(context.Background(), conn, "SELECT 1 AS a, 'x' AS a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := reader.Schema().Fields(); len(fields) != 2 || fields[0].Name != "a" || fields[1].Name != "a" || fields[1].Type.ID() != arrow.STRING {
+		t.Errorf("unexpected schema %s", reader.Schema())
+	}
+	reader.Release()
+
+	// 嵌套类型和字典（ENUM）复制到 go 内存后与 go-duckdb 的结果一致
+	query = `SELECT [i, NULL] l, {'a': i, 'b': 'x' || i} st, (CASE WHEN i % 2 = 0 THEN 'x' END)::ENUM('x', 'y') e, MAP {'k': i} m FROM range(3000) t(i)`
+	var got, want []string
+	reader, err = queryDuckdbArrow(context.Background(), conn, query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for reader.Next() {
+		for _, col := range reader.Record().Columns() {
+			got = append(got, col.String())
+		}
+	}
+	reader.Release()
+	if expected, err = ar.QueryContext(context.Background(), query); err != nil {
+		t.Fatal(err)
+	}
+	for expected.Next() {
+		for _, col := range expected.Record().Columns() {
+			want = append(want, col.String())
+		}
+	}
+	expected.Release()
+	if !slices.Equal(got, want) {
+		t.Errorf("got %.200q, want %.200q", got, want)
+	}
+
+	if _, err = queryDuckdbArrow(context.Background(), conn, "SELECT nosuch", nil); err == nil {
+		t.Error("expected prepare error")
+	}
+}
@@ -3,10 +3,16 @@ package main
 import (
 	"database/sql/driver"
 	"fmt"
+	"github.com/goccy/go-json"
 	"github.com/marcboeker/go-duckdb"
 	"github.com/sirupsen/logrus"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -70,6 +76,643 @@ func getDuckDBConverter(typ string) converter {
 	return converters[typ]
 }
 
+// duckType 是解析后的 duckdb 类型名，如 DECIMAL(18,3)、INTEGER[]、STRUCT(a INTEGER)、MAP(VARCHAR, INTEGER)
+type duckType struct {
+	name     string      // 基础类型名，复合类型为 LIST/STRUCT/MAP
+	width    int         // DECIMAL 精度
+	scale    int         // DECIMAL 标度
+	children []*duckType // LIST 的元素，MAP 的键和值，STRUCT 的字段
+	names    []string    // STRUCT 的字段名
+}
+
+var duckTypeAliases = map[string]string{
+	"TIMESTAMP WITH TIME ZONE": "TIMESTAMPTZ",
+	"INT":                      "INTEGER",
+	"INT4":                     "INTEGER",
+	"INT8":                     "BIGINT",
+	"LONG":                     "BIGINT",
+	"TEXT":                     "VARCHAR",
+	"STRING":                   "VARCHAR",
+	"BOOL":                     "BOOLEAN",
+	"FLOAT8":                   "DOUBLE",
+	"FLOAT4":                   "FLOAT",
+	"REAL":                     "FLOAT",
+	"NUMERIC":                  "DECIMAL",
+	"DATETIME":                 "TIMESTAMP",
+}
+
+var duckTypeCache sync.Map
+
+func parseDuckType(typ string) (*duckType, error) {
+	if t, ok := duckTypeCache.Load(typ); ok {
+		return t.(*duckType), nil
+	}
+	t, err := parseDuckTypeName(strings.TrimSpace(typ))
+	if err != nil {
+		return nil, err
+	}
+	duckTypeCache.Store(typ, t)
+	return t, nil
+}
+
+func parseDuckTypeName(typ string) (*duckType, error) {
+	if strings.HasSuffix(typ, "]") {
+		idx := strings.LastIndexByte(typ, '[')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid type %s", typ)
+		}
+		elem, err := parseDuckTypeName(strings.TrimSpace(typ[:idx]))
+		if err != nil {
+			return nil, err
+		}
+		return &duckType{name: "LIST", children: []*duckType{elem}}, nil
+	}
+	upper := strings.ToUpper(typ)
+	if open := strings.IndexByte(typ, '('); open > 0 && strings.HasSuffix(typ, ")") {
+		name := strings.TrimSpace(upper[:open])
+		if alias, ok := duckTypeAliases[name]; ok {
+			name = alias
+		}
+		args := splitTypeArgs(typ[open+1 : len(typ)-1])
+		t := &duckType{name: name}
+		switch name {
+		case "DECIMAL":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("invalid type %s", typ)
+			}
+			var err1, err2 error
+			t.width, err1 = strconv.Atoi(args[0])
+			t.scale, err2 = strconv.Atoi(args[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid type %s", typ)
+			}
+		case "STRUCT":
+			for _, arg := range args {
+				fieldName, fieldType := splitDuckStructField(arg)
+				child, err := parseDuckTypeName(fieldType)
+				if err != nil {
+					return nil, err
+				}
+				t.names = append(t.names, fieldName)
+				t.children = append(t.children, child)
+			}
+		case "MAP":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("invalid type %s", typ)
+			}
+			for _, arg := range args {
+				child, err := parseDuckTypeName(arg)
+				if err != nil {
+					return nil, err
+				}
+				t.children = append(t.children, child)
+			}
+		}
+		return t, nil
+	}
+	if alias, ok := duckTypeAliases[upper]; ok {
+		upper = alias
+	}
+	if upper == "DECIMAL" {
+		return &duckType{name: upper, width: 18, scale: 3}, nil
+	}
+	return &duckType{name: upper}, nil
+}
+
+// splitDuckStructField 切分 STRUCT 的字段定义 `name TYPE`，字段名可能是 "" 包围的
+func splitDuckStructField(field string) (string, string) {
+	if strings.HasPrefix(field, `"`) {
+		for i := 1; i < len(field); i++ {
+			if field[i] != '"' {
+				continue
+			}
+			if i+1 < len(field) && field[i+1] == '"' {
+				i++
+				continue
+			}
+			return strings.ReplaceAll(field[1:i], `""`, `"`), strings.TrimSpace(field[i+1:])
+		}
+	}
+	idx := strings.IndexByte(field, ' ')
+	if idx < 0 {
+		return field, ""
+	}
+	return field[:idx], strings.TrimSpace(field[idx+1:])
+}
+
+func (t *duckType) String() string {
+	switch t.name {
+	case "LIST":
+		return t.children[0].String() + "[]"
+	case "DECIMAL":
+		return fmt.Sprintf("DECIMAL(%d,%d)", t.width, t.scale)
+	case "MAP":
+		return fmt.Sprintf("MAP(%s, %s)", t.children[0], t.children[1])
+	case "STRUCT":
+		fields := make([]string, len(t.children))
+		for i, child := range t.children {
+			fields[i] = `"` + strings.ReplaceAll(t.names[i], `"`, `""`) + `" ` + child.String()
+		}
+		return "STRUCT(" + strings.Join(fields, ", ") + ")"
+	}
+	return t.name
+}
+
+var duckTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	time.RFC3339Nano,
+	"2006-01-02",
+}
+
+func parseDuckTime(s string) (time.Time, error) {
+	for _, layout := range duckTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as time", s)
+}
+
+type appenderNumber interface {
+	int8 | int16 | int32 | int64 | uint8 | uint16 | uint32 | uint64 | float32 | float64
+}
+
+// castNumber 把任意数值类型转换为 appender 需要的 Go 类型，和 duckdb 的 CAST 一样，
+// 超出目标类型范围时返回错误，浮点数转换为整数时四舍五入
+func castNumber[T appenderNumber](v any, typ string) (driver.Value, error) {
+	switch n := v.(type) {
+	case T:
+		return n, nil
+	case *big.Int:
+		if n.IsInt64() {
+			return numberFromInt[T](n.Int64(), typ)
+		}
+		if n.IsUint64() {
+			return numberFromUint[T](n.Uint64(), typ)
+		}
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return numberFromFloat[T](f, n, typ)
+	case duckdb.Decimal:
+		return numberFromFloat[T](n.Float64(), n.Float64(), typ)
+	case json.Number:
+		return castNumber[T](string(n), typ)
+	case string:
+		var zero T
+		switch any(zero).(type) {
+		case float32, float64:
+			f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+			if err != nil {
+				return nil, err
+			}
+			return numberFromFloat[T](f, n, typ)
+		case uint8, uint16, uint32, uint64:
+			u, err := strconv.ParseUint(strings.TrimSpace(n), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return numberFromUint[T](u, typ)
+		default:
+			i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return numberFromInt[T](i, typ)
+		}
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return numberFromInt[T](rv.Int(), typ)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return numberFromUint[T](rv.Uint(), typ)
+	case reflect.Float32, reflect.Float64:
+		return numberFromFloat[T](rv.Float(), v, typ)
+	case reflect.Bool:
+		if rv.Bool() {
+			return T(1), nil
+		}
+		return T(0), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to %s", v, typ)
+}
+
+func numberOutOfRange(v any, typ string) error {
+	return fmt.Errorf("conversion error: value %v is out of range for the destination type %s", v, typ)
+}
+
+// numberFromInt 转换后能转换回原来的值时没有溢出
+func numberFromInt[T appenderNumber](i int64, typ string) (driver.Value, error) {
+	n := T(i)
+	switch any(n).(type) {
+	case float32, float64:
+	case uint8, uint16, uint32, uint64:
+		if i < 0 || uint64(n) != uint64(i) {
+			return nil, numberOutOfRange(i, typ)
+		}
+	default:
+		if int64(n) != i {
+			return nil, numberOutOfRange(i, typ)
+		}
+	}
+	return n, nil
+}
+
+func numberFromUint[T appenderNumber](u uint64, typ string) (driver.Value, error) {
+	n := T(u)
+	switch any(n).(type) {
+	case float32, float64:
+	case uint8, uint16, uint32, uint64:
+		if uint64(n) != u {
+			return nil, numberOutOfRange(u, typ)
+		}
+	default:
+		if int64(n) < 0 || uint64(n) != u {
+			return nil, numberOutOfRange(u, typ)
+		}
+	}
+	return n, nil
+}
+
+// numberFromFloat v 为原始值，用于错误信息
+func numberFromFloat[T appenderNumber](f float64, v any, typ string) (driver.Value, error) {
+	var zero T
+	var lo, hi float64
+	switch any(zero).(type) {
+	case float64:
+		return T(f), nil
+	case float32:
+		if !math.IsInf(f, 0) && math.Abs(f) > math.MaxFloat32 {
+			return nil, numberOutOfRange(v, typ)
+		}
+		return T(f), nil
+	case int8:
+		lo, hi = math.MinInt8, math.MaxInt8+1
+	case int16:
+		lo, hi = math.MinInt16, math.MaxInt16+1
+	case int32:
+		lo, hi = math.MinInt32, math.MaxInt32+1
+	case int64:
+		lo, hi = math.MinInt64, 1<<63
+	case uint8:
+		hi = math.MaxUint8 + 1
+	case uint16:
+		hi = math.MaxUint16 + 1
+	case uint32:
+		hi = math.MaxUint32 + 1
+	case uint64:
+		hi = 1 << 64
+	}
+	f = math.Round(f)
+	// NaN 的比较都为 false
+	if !(f >= lo && f < hi) {
+		return nil, numberOutOfRange(v, typ)
+	}
+	return T(f), nil
+}
+
+// castToDuckType 把解码出来的值转换为 appender 对 typ 类型列所需的 Go 类型
+func castToDuckType(v any, typ string) (driver.Value, error) {
+	t, err := parseDuckType(typ)
+	if err != nil {
+		return nil, err
+	}
+	return t.cast(v)
+}
+
+func (t *duckType) cast(v any) (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch t.name {
+	case "LIST":
+		if text, ok := v.(string); ok {
+			// clickhouse 文本格式中的数组 [1,2,'a']
+			parsed, err := parseClickhouseLiteral(text)
+			if err != nil {
+				return nil, err
+			}
+			v = parsed
+		}
+		list, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot convert %T to %s", v, t)
+		}
+		res := make([]any, len(list))
+		for i, e := range list {
+			var err error
+			if res[i], err = t.children[0].cast(e); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case "STRUCT":
+		if text, ok := v.(string); ok {
+			parsed, err := parseClickhouseLiteral(text)
+			if err != nil {
+				return nil, err
+			}
+			v = parsed
+		}
+		res := make(map[string]any, len(t.names))
+		switch fields := v.(type) {
+		case []any:
+			if len(fields) != len(t.names) {
+				return nil, fmt.Errorf("expected %d fields for %s, got %d", len(t.names), t, len(fields))
+			}
+			for i, name := range t.names {
+				var err error
+				if res[name], err = t.children[i].cast(fields[i]); err != nil {
+					return nil, err
+				}
+			}
+		case map[string]any:
+			for i, name := range t.names {
+				var err error
+				if res[name], err = t.children[i].cast(fields[name]); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("cannot convert %T to %s", v, t)
+		}
+		return res, nil
+	case "MAP":
+		if text, ok := v.(string); ok {
+			parsed, err := parseClickhouseLiteral(text)
+			if err != nil {
+				return nil, err
+			}
+			v = parsed
+		}
+		res := duckdb.Map{}
+		switch entries := v.(type) {
+		case duckdb.Map:
+			for k, e := range entries {
+				if err := t.castMapEntry(res, k, e); err != nil {
+					return nil, err
+				}
+			}
+		case map[string]any:
+			for k, e := range entries {
+				if err := t.castMapEntry(res, k, e); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("cannot convert %T to %s", v, t)
+		}
+		return res, nil
+	case "DECIMAL":
+		return castDecimal(v, t)
+	case "HUGEINT", "UHUGEINT":
+		switch n := v.(type) {
+		case *big.Int:
+			return n, nil
+		case duckdb.Decimal:
+			return new(big.Int).Quo(n.Value, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n.Scale)), nil)), nil
+		}
+		i, ok := new(big.Int).SetString(strings.TrimSpace(duckValueToString(v)), 10)
+		if !ok {
+			return nil, fmt.Errorf("cannot convert %v to %s", v, t)
+		}
+		return i, nil
+	case "TINYINT":
+		return castNumber[int8](v, t.name)
+	case "SMALLINT":
+		return castNumber[int16](v, t.name)
+	case "INTEGER":
+		return castNumber[int32](v, t.name)
+	case "BIGINT":
+		return castNumber[int64](v, t.name)
+	case "UTINYINT":
+		return castNumber[uint8](v, t.name)
+	case "USMALLINT":
+		return castNumber[uint16](v, t.name)
+	case "UINTEGER":
+		return castNumber[uint32](v, t.name)
+	case "UBIGINT":
+		return castNumber[uint64](v, t.name)
+	case "FLOAT":
+		return castNumber[float32](v, t.name)
+	case "DOUBLE":
+		return castNumber[float64](v, t.name)
+	case "BOOLEAN":
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(b))
+		}
+		n, err := castNumber[int64](v, t.name)
+		if err != nil {
+			return nil, err
+		}
+		return n.(int64) != 0, nil
+	case "VARCHAR":
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case []byte:
+			return string(s), nil
+		case json.Number:
+			return string(s), nil
+		case map[string]any, []any:
+			// 嵌套的 json 写入字符串列时保留为 json 文本
+			b, err := json.Marshal(s)
+			return string(b), err
+		}
+		return duckValueToString(v), nil
+	case "BLOB":
+		switch s := v.(type) {
+		case []byte:
+			return s, nil
+		case string:
+			return []byte(s), nil
+		}
+	case "DATE", "TIMESTAMP", "TIMESTAMP_S", "TIMESTAMP_MS", "TIMESTAMP_NS", "TIMESTAMPTZ":
+		switch s := v.(type) {
+		case string:
+			return parseDuckTime(strings.TrimSpace(s))
+		case time.Time:
+			return s, nil
+		}
+		// 数值按 unix 时间戳(秒)处理，和 clickhouse 一致
+		f, err := castNumber[float64](v, t.name)
+		if err != nil {
+			return nil, err
+		}
+		sec, frac := math.Modf(f.(float64))
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+	return v, nil
+}
+
+func (t *duckType) castMapEntry(m duckdb.Map, k, v any) error {
+	key, err := t.children[0].cast(k)
+	if err != nil {
+		return err
+	}
+	if m[key], err = t.children[1].cast(v); err != nil {
+		return err
+	}
+	return nil
+}
+
+// castDecimal 按列的精度把数值转换为 duckdb.Decimal，字符串和 json.Number 不经过 float 避免丢失精度
+func castDecimal(v any, t *duckType) (driver.Value, error) {
+	var r *big.Rat
+	switch n := v.(type) {
+	case duckdb.Decimal:
+		r = new(big.Rat).SetFrac(n.Value, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n.Scale)), nil))
+	case *big.Int:
+		r = new(big.Rat).SetInt(n)
+	case float32:
+		r = new(big.Rat)
+		if r.SetFloat64(float64(n)) == nil {
+			return nil, fmt.Errorf("cannot convert %v to %s", v, t)
+		}
+	case float64:
+		r = new(big.Rat)
+		if r.SetFloat64(n) == nil {
+			return nil, fmt.Errorf("cannot convert %v to %s", v, t)
+		}
+	default:
+		var ok bool
+		r, ok = new(big.Rat).SetString(strings.TrimSpace(duckValueToString(v)))
+		if !ok {
+			return nil, fmt.Errorf("cannot convert %v to %s", v, t)
+		}
+	}
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(t.scale)), nil)))
+	// 四舍五入到列的小数位数
+	half := big.NewRat(1, 2)
+	if scaled.Sign() < 0 {
+		half.Neg(half)
+	}
+	scaled.Add(scaled, half)
+	value := new(big.Int).Quo(scaled.Num(), scaled.Denom())
+	return duckdb.Decimal{Width: uint8(t.width), Scale: uint8(t.scale), Value: value}, nil
+}
+
+// zero 返回类型的默认值，对应 clickhouse 中缺失字段的默认值
+func (t *duckType) zero() driver.Value {
+	switch t.name {
+	case "LIST":
+		return []any{}
+	case "STRUCT":
+		res := make(map[string]any, len(t.names))
+		for i, name := range t.names {
+			res[name] = t.children[i].zero()
+		}
+		return res
+	case "MAP":
+		return duckdb.Map{}
+	case "VARCHAR":
+		return ""
+	case "BLOB":
+		return []byte{}
+	case "BOOLEAN":
+		return false
+	case "DATE", "TIMESTAMP", "TIMESTAMP_S", "TIMESTAMP_MS", "TIMESTAMP_NS", "TIMESTAMPTZ":
+		return time.Unix(0, 0).UTC()
+	case "DECIMAL":
+		return duckdb.Decimal{Width: uint8(t.width), Scale: uint8(t.scale), Value: big.NewInt(0)}
+	case "HUGEINT", "UHUGEINT":
+		return big.NewInt(0)
+	}
+	if zero, err := t.cast(int64(0)); err == nil {
+		return zero
+	}
+	return nil
+}
+
+// appendable go-duckdb 的 appender 不支持 DECIMAL、MAP、HUGEINT 等类型
+func (t *duckType) appendable() bool {
+	switch t.name {
+	case "BOOLEAN", "TINYINT", "SMALLINT", "INTEGER", "BIGINT", "UTINYINT", "USMALLINT", "UINTEGER", "UBIGINT",
+		"FLOAT", "DOUBLE", "VARCHAR", "BLOB", "UUID", "DATE", "TIMESTAMP", "TIMESTAMP_S", "TIMESTAMP_MS", "TIMESTAMP_NS", "TIMESTAMPTZ":
+		return true
+	case "LIST", "STRUCT":
+		for _, child := range t.children {
+			if !child.appendable() {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// formatDuckText 把值格式化为 duckdb 能从 VARCHAR 转换为 t 的文本，nested 表示处于 LIST/MAP/STRUCT 内部
+func formatDuckText(v any, t *duckType, nested bool) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "NULL", nil
+	case []any:
+		elements := make([]string, len(val))
+		for i, e := range val {
+			var err error
+			if elements[i], err = formatDuckText(e, t.children[0], true); err != nil {
+				return "", err
+			}
+		}
+		return "[" + strings.Join(elements, ", ") + "]", nil
+	case map[string]any:
+		elements := make([]string, len(t.names))
+		for i, name := range t.names {
+			text, err := formatDuckText(val[name], t.children[i], true)
+			if err != nil {
+				return "", err
+			}
+			key, err := quoteDuckText(name)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = key + ": " + text
+		}
+		return "{" + strings.Join(elements, ", ") + "}", nil
+	case duckdb.Map:
+		elements := make([]string, 0, len(val))
+		for k, e := range val {
+			key, err := formatDuckText(k, t.children[0], true)
+			if err != nil {
+				return "", err
+			}
+			text, err := formatDuckText(e, t.children[1], true)
+			if err != nil {
+				return "", err
+			}
+			elements = append(elements, key+"="+text)
+		}
+		sort.Strings(elements)
+		return "{" + strings.Join(elements, ", ") + "}", nil
+	case time.Time:
+		return val.Format("2006-01-02 15:04:05.999999999Z07:00"), nil
+	case *big.Int:
+		return val.String(), nil
+	case []byte:
+		v = string(val)
+	}
+	s := duckValueToString(v)
+	if nested {
+		return quoteDuckText(s)
+	}
+	return s, nil
+}
+
+// quoteDuckText duckdb 字符串转嵌套类型时用单引号或双引号包围元素，不支持转义
+func quoteDuckText(s string) (string, error) {
+	if !strings.ContainsRune(s, '\'') {
+		return "'" + s + "'", nil
+	}
+	if !strings.ContainsRune(s, '"') {
+		return `"` + s + `"`, nil
+	}
+	return "", fmt.Errorf("cannot represent %q in nested value", s)
+}
+
 func duckDecimalToString(value duckdb.Decimal) string {
 	str := value.Value.String()
 	if value.Scale == 0 {
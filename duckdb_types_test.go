@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestCastNumberRange(t *testing.T) {
+	for _, c := range []struct {
+		v    any
+		typ  string
+		want driver.Value
+	}{
+		{int64(255), "UTINYINT", uint8(255)},
+		{json.Number("-128"), "TINYINT", int8(-128)},
+		{2.5, "INTEGER", int32(3)},
+		{uint64(1 << 63), "UBIGINT", uint64(1 << 63)},
+		{big.NewInt(-1), "DOUBLE", float64(-1)},
+		{true, "UTINYINT", uint8(1)},
+	} {
+		got, err := castToDuckType(c.v, c.typ)
+		if err != nil || got != c.want {
+			t.Errorf("cast %v to %s: got %v %v", c.v, c.typ, got, err)
+		}
+	}
+	for _, c := range []struct {
+		v   any
+		typ string
+	}{
+		{int64(300), "UTINYINT"},
+		{int64(-1), "UINTEGER"},
+		{json.Number("128"), "TINYINT"},
+		{uint64(1 << 63), "BIGINT"},
+		{1e10, "INTEGER"},
+		{-0.6, "USMALLINT"},
+		{1e40, "FLOAT"},
+		{new(big.Int).Lsh(big.NewInt(1), 64), "UBIGINT"},
+	} {
+		if got, err := castToDuckType(c.v, c.typ); err == nil {
+			t.Errorf("cast %v to %s: expected out of range error, got %v", c.v, c.typ, got)
+		}
+	}
+}
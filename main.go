@@ -2,7 +2,11 @@ package main
 
 import (
 	"flag"
+	"net"
 	_ "net/http/pprof"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -20,6 +24,50 @@ func main() {
 	logLevel := flag.String("log_level", "trace", "Log level")
 	hack := flag.Bool("hack", true, "hack")
 	auth := flag.Bool("auth", false, "enable auth")
+	adminUsers := map[string]bool{}
+	flag.Func("admin_users", "Comma separated users that may kill queries of other users when auth is enabled, can be repeated", func(s string) error {
+		for _, user := range strings.Split(s, ",") {
+			if user = strings.TrimSpace(user); user != "" {
+				adminUsers[user] = true
+			}
+		}
+		return nil
+	})
+	queryLog := flag.Bool("query_log", true, "Record executed statements into system.query_log")
+	queryLogSample := flag.Float64("query_log_sample", 1, "Fraction of successful statements recorded into system.query_log")
+	queryLogTTL := flag.Duration("query_log_ttl", 30*24*time.Hour, "Delete system.query_log records older than this, 0 keeps them forever")
+	queryLogFlushInterval := flag.Duration("query_log_flush_interval", 7500*time.Millisecond, "Interval of flushing system.query_log")
+	reportBufferRows := flag.Int("report_buffer_rows", 10000, "Flush /report buffer of a table when it holds this many events")
+	reportBufferBytes := flag.Int("report_buffer_bytes", 16<<20, "Flush /report buffer of a table when it holds this many bytes")
+	reportFlushInterval := flag.Duration("report_flush_interval", time.Second, "Flush /report buffer of a table at most this long after its first event")
+	reportMaxDepth := flag.Int("report_max_depth", 5, "Store /report objects nested deeper than this as JSON text, 0 means unlimited")
+	reportMaxColumns := flag.Int("report_max_columns", 1000, "Reject /report events that would grow a table beyond this many columns, 0 means unlimited")
+	reportDeadLetters := flag.Bool("report_dead_letters", true, "Save /report events that cannot be inserted into duckserver.dead_letters")
+	reportTypePolicies := ReportTypePolicies{}
+	flag.Func("report_pin_type", "Pin the type of a /report column as table.column=TYPE, can be repeated", reportTypePolicies.Pin)
+	flag.Func("report_no_widen", "Never widen column types of this /report table, can be repeated", reportTypePolicies.ForbidWidening)
+	flag.Func("report_nested", "Map nested objects of a /report table as table=flatten|struct|json, can be repeated", reportTypePolicies.SetNested)
+	var reportBusinessID *regexp.Regexp
+	flag.Func("report_business_id_pattern", "Reject /report business_id headers that do not match this regexp (default "+reportBusinessIDPattern+")", func(s string) (err error) {
+		reportBusinessID, err = regexp.Compile(s)
+		return err
+	})
+	reportKeyMode := reportKeySanitize
+	flag.Func("report_key_mode", "Rename invalid or reserved /report keys (sanitize) or reject the event (reject) (default sanitize)", func(s string) (err error) {
+		reportKeyMode, err = ParseReportKeyMode(s)
+		return err
+	})
+	reportDedupKeys := ReportDedupKeys{}
+	flag.Func("report_dedup", "Drop /report retries of a table by table=header:Idempotency-Key or table=$.json.path, can be repeated", reportDedupKeys.Set)
+	reportDedupDuration := flag.Duration("report_dedup_window", reportDedupWindow, "Remember /report dedup keys for at least this long")
+	reportDedupMaxKeys := flag.Int("report_dedup_max_keys", reportDedupMaxKeys, "Remember at most this many /report dedup keys, the window gets shorter when it is reached")
+	reportConfigReloadInterval := flag.Duration("report_config_reload", reportConfigReload, "Reload duckserver.report_configs in the background at this interval")
+	var reportTrustedProxies []*net.IPNet
+	flag.Func("report_trusted_proxies", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For is used as the /report client IP", func(s string) (err error) {
+		reportTrustedProxies, err = ParseTrustedProxies(s)
+		return err
+	})
+	reportGeoIP := flag.String("report_geoip_db", "", "MaxMind-format country database for the /report country enrichment")
 	flag.Parse()
 	switch *logLevel {
 	case "trace":
@@ -35,14 +83,41 @@ func main() {
 	}
 	server := PgServer{}
 	defer server.CloseConn()
-	server.Start(serverOptions{
+	err := server.Start(serverOptions{
 		DbPath:  *dbPath,
 		Listen:  *pgListen,
 		UseHack: *hack,
 		ClickhouseOptions: ClickhouseOptions{
-			Enabled: true,
-			Listen:  *chListen,
+			Enabled:    true,
+			Listen:     *chListen,
+			AdminUsers: adminUsers,
+		},
+		QueryLog: QueryLogOptions{
+			Enabled:       *queryLog,
+			SampleRate:    *queryLogSample,
+			TTL:           *queryLogTTL,
+			FlushInterval: *queryLogFlushInterval,
+		},
+		Report: ReportOptions{
+			BufferMaxRows:     *reportBufferRows,
+			BufferMaxBytes:    *reportBufferBytes,
+			FlushInterval:     *reportFlushInterval,
+			TypePolicies:      reportTypePolicies,
+			MaxDepth:          *reportMaxDepth,
+			MaxColumns:        *reportMaxColumns,
+			DeadLetters:       *reportDeadLetters,
+			BusinessIDPattern: reportBusinessID,
+			KeyMode:           reportKeyMode,
+			DedupKeys:         reportDedupKeys,
+			DedupWindow:       *reportDedupDuration,
+			DedupMaxKeys:      *reportDedupMaxKeys,
+			ConfigReload:      *reportConfigReloadInterval,
+			TrustedProxies:    reportTrustedProxies,
+			GeoIPPath:         *reportGeoIP,
 		},
 		Auth: *auth,
 	})
+	if err != nil {
+		logrus.Errorf("start server error: %v", err)
+	}
 }
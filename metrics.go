@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// metricsScrapeTimeout 抓取时查询 duckdb_memory() 的超时时间
+const metricsScrapeTimeout = 3 * time.Second
+
+// serverMetrics 两种协议共用的 prometheus 指标。标签的取值固定：
+// protocol 为 http 或 postgresql，kind 和 system.query_log 的 query_kind 一致，status 为 ok 或 error
+type serverMetrics struct {
+	registry      *prometheus.Registry
+	pgConnections prometheus.Gauge
+	authFailures  *prometheus.CounterVec
+	queries       *prometheus.CounterVec
+	queryDuration *prometheus.HistogramVec
+	resultRows    *prometheus.CounterVec
+	resultBytes   *prometheus.CounterVec
+	appendedRows  *prometheus.CounterVec
+	reportDDL     *prometheus.CounterVec
+	reportDups    prometheus.Counter
+}
+
+func newServerMetrics(db *sql.DB) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		pgConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "duckserver_pg_connections",
+			Help: "Number of authenticated postgresql connections.",
+		}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "duckserver_auth_failures_total",
+			Help: "Authentication failures by protocol and method.",
+		}, []string{"protocol", "method"}),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "duckserver_queries_total",
+			Help: "Executed statements by protocol, kind and status.",
+		}, []string{"protocol", "kind", "status"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "duckserver_query_duration_seconds",
+			Help:    "Statement latency by protocol and kind.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"protocol", "kind"}),
+		resultRows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "duckserver_result_rows_total",
+			Help: "Rows sent to clients by protocol.",
+		}, []string{"protocol"}),
+		resultBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "duckserver_result_bytes_total",
+			Help: "Bytes of results sent to clients by protocol.",
+		}, []string{"protocol"}),
+		appendedRows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "duckserver_appended_rows_total",
+			Help: "Rows loaded through the DuckDB appender by protocol and source.",
+		}, []string{"protocol", "source"}),
+		reportDDL: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "duckserver_report_ddl_total",
+			Help: "Schema changes made automatically by /report, by operation.",
+		}, []string{"operation"}),
+		reportDups: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "duckserver_report_duplicates_total",
+			Help: "/report events acknowledged without inserting because their dedup key was seen in the window.",
+		}),
+	}
+	m.registry.MustRegister(m.pgConnections, m.authFailures, m.queries, m.queryDuration,
+		m.resultRows, m.resultBytes, m.appendedRows, m.reportDDL, m.reportDups,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if db != nil {
+		m.registry.MustRegister(&duckdbMemoryCollector{db: db, desc: prometheus.NewDesc(
+			"duckserver_duckdb_memory_bytes", "DuckDB memory usage by tag from duckdb_memory().", []string{"tag", "kind"}, nil)})
+	}
+	return m
+}
+
+// Handler /metrics，和 /ping 一样不做认证
+func (m *serverMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *serverMetrics) ObserveQuery(e *queryLogEntry) {
+	if m == nil {
+		return
+	}
+	kind := queryKind(e.Query)
+	status := "ok"
+	if e.Exception != "" {
+		status = "error"
+	}
+	m.queries.WithLabelValues(e.Protocol, kind, status).Inc()
+	m.queryDuration.WithLabelValues(e.Protocol, kind).Observe(e.Duration.Seconds())
+	m.resultRows.WithLabelValues(e.Protocol).Add(float64(e.ResultRows))
+	m.resultBytes.WithLabelValues(e.Protocol).Add(float64(e.ResultBytes))
+}
+
+func (m *serverMetrics) AuthFailed(protocol, method string) {
+	if m != nil {
+		m.authFailures.WithLabelValues(protocol, method).Inc()
+	}
+}
+
+func (m *serverMetrics) PgConnected(delta float64) {
+	if m != nil {
+		m.pgConnections.Add(delta)
+	}
+}
+
+func (m *serverMetrics) AppendedRows(protocol, source string, n int64) {
+	if m != nil {
+		m.appendedRows.WithLabelValues(protocol, source).Add(float64(n))
+	}
+}
+
+func (m *serverMetrics) ReportDDL(operation string) {
+	if m != nil {
+		m.reportDDL.WithLabelValues(operation).Inc()
+	}
+}
+
+func (m *serverMetrics) ReportDuplicates() {
+	if m != nil {
+		m.reportDups.Inc()
+	}
+}
+
+// duckdbMemoryCollector 抓取时查询 duckdb_memory()，kind 为 memory 或 temporary_storage
+type duckdbMemoryCollector struct {
+	db   *sql.DB
+	desc *prometheus.Desc
+}
+
+func (c *duckdbMemoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *duckdbMemoryCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsScrapeTimeout)
+	defer cancel()
+	rows, err := c.db.QueryContext(ctx, "SELECT tag, memory_usage_bytes, temporary_storage_bytes FROM duckdb_memory()")
+	if err != nil {
+		logrus.Warnf("collect duckdb memory error: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		var memory, temporary int64
+		if err = rows.Scan(&tag, &memory, &temporary); err != nil {
+			logrus.Warnf("collect duckdb memory error: %v", err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(memory), tag, "memory")
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(temporary), tag, "temporary_storage")
+	}
+}
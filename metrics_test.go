@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	c := &ChServer{conn: db, pgServer: &PgServer{}, metrics: newServerMetrics(db)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", c.ServeHTTP)
+	c.registerAdminHandlers(mux)
+
+	query := func(body string, token string) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("token", token)
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	query("SELECT * FROM range(3)", AuthToken)
+	query("SELECT * FROM missing_table", AuthToken)
+	query("SELECT 1", "wrong")
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected /metrics status %d", rec.Code)
+	}
+	scrape := rec.Body.String()
+	for _, line := range []string{
+		`duckserver_queries_total{kind="Select",protocol="http",status="ok"} 1`,
+		`duckserver_queries_total{kind="Select",protocol="http",status="error"} 1`,
+		`duckserver_query_duration_seconds_count{kind="Select",protocol="http"} 2`,
+		`duckserver_result_rows_total{protocol="http"} 3`,
+		`duckserver_auth_failures_total{method="token",protocol="http"} 1`,
+		`duckserver_pg_connections 0`,
+		`duckserver_duckdb_memory_bytes{kind="memory",tag="BASE_TABLE"}`,
+	} {
+		if !strings.Contains(scrape, line) {
+			t.Errorf("scrape does not contain %s", line)
+		}
+	}
+}
@@ -42,7 +42,7 @@ func (c *PgConn) ScramSha256Auth(user string) error {
 		return err
 	} else {
 		if saslInitialMsg, err := ParseSASLInitialResponseMessage(msg); err != nil {
-			return nil
+			return err
 		} else {
 			if saslInitialMsg.Mechanism != "SCRAM-SHA-256" {
 				logrus.Errorf("invalid mechanism: %s", saslInitialMsg.Mechanism)
@@ -77,7 +77,7 @@ func (c *PgConn) ScramSha256Auth(user string) error {
 	})
 	if err != nil {
 		logrus.Infof("error: %v", err)
-		return c.SendErrorResponse(fmt.Sprintf("password authentication failed for user %s", user))
+		return c.authFailed(user)
 	}
 	conversation := scramServer.NewConversation()
 
@@ -85,7 +85,7 @@ func (c *PgConn) ScramSha256Auth(user string) error {
 	resp, err := conversation.Step(string(saslInitialData))
 	if err != nil {
 		logrus.Infof("error: %v", err)
-		return c.SendErrorResponse(fmt.Sprintf("password authentication failed for user %s", user))
+		return c.authFailed(user)
 	}
 	if err := c.wire.WriteMessage(NewMessage('R', append(cint32(11), []byte(resp)...))); err != nil {
 		return err
@@ -94,12 +94,12 @@ func (c *PgConn) ScramSha256Auth(user string) error {
 		return err
 	} else {
 		if saslFinalMsg, err := ParseSASLResponseMessage(msg); err != nil {
-			return nil
+			return err
 		} else {
 			resp, err := conversation.Step(string(saslFinalMsg.Data))
 			if err != nil {
 				logrus.Infof("error: %v", err)
-				return c.SendErrorResponse(fmt.Sprintf("password authentication failed for user %s", user))
+				return c.authFailed(user)
 			}
 			if err = c.wire.WriteMessage(NewMessage('R', append(cint32(12), []byte(resp)...))); err != nil {
 				return err
@@ -109,6 +109,13 @@ func (c *PgConn) ScramSha256Auth(user string) error {
 	return c.wire.WriteAuthOK()
 }
 
+// authFailed 通知客户端认证失败，返回的错误使连接关闭
+func (c *PgConn) authFailed(user string) error {
+	message := fmt.Sprintf("password authentication failed for user %s", user)
+	_ = c.SendErrorResponse(message)
+	return errors.New(message)
+}
+
 func computeHMAC(key, msg []byte) []byte {
 	mac := hmac.New(sha256.New, key)
 	mac.Write(msg)
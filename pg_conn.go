@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/binary"
 	"encoding/csv"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/marcboeker/go-duckdb"
 	"github.com/sirupsen/logrus"
@@ -43,9 +45,13 @@ type PgConn struct {
 	db      *sql.DB
 	stmts   map[string]*stmtDesc
 	portal  map[string]portal
-	cancel  context.CancelFunc
+	user    string
 	keyData [8]byte
 	inError bool
+	// progress 正在执行的查询的进度，显示在 system.processes 中
+	progress *chProgress
+	// queryErr 正在执行的查询返回的错误，写入 query_log
+	queryErr string
 }
 
 func newPgConn(conn net.Conn, server *PgServer) *PgConn {
@@ -105,8 +111,23 @@ func (c *PgConn) Run() {
 		logrus.Debugf("receive startup: %v", startup)
 		if err = c.Auth(startup.Parameters["user"]); err != nil {
 			logrus.Debugf("auth error: %v", err)
+			c.server.metrics.AuthFailed("postgresql", "scram-sha-256")
 			return
 		}
+		c.user = startup.Parameters["user"]
+		c.server.backends.Store(c.keyData, c)
+		c.server.metrics.PgConnected(1)
+		c.server.queries.Connect(&pgBackend{
+			PID:             c.pid(),
+			Key:             c.keyData,
+			User:            c.user,
+			Address:         c.wire.conn.RemoteAddr().String(),
+			ApplicationName: startup.Parameters["application_name"],
+			Database:        startup.Parameters["database"],
+			Terminate: func() {
+				_ = c.wire.conn.Close()
+			},
+		})
 		if err = c.SendBackendKeyData(); err != nil {
 			logrus.Debugf("send backend key data error: %v", err)
 			return
@@ -254,6 +275,7 @@ func (c *PgConn) RunStmt(ctx context.Context, stmt driver.Stmt, values []driver.
 			return c.SendErrorResponse(err.Error())
 		}
 		rowCount++
+		c.progress.AddResultRows(1)
 	}
 	for {
 		if err := rows.Next(rowValues); err != nil {
@@ -264,6 +286,7 @@ func (c *PgConn) RunStmt(ctx context.Context, stmt driver.Stmt, values []driver.
 			}
 		} else {
 			rowCount++
+			c.progress.AddResultRows(1)
 			if err := c.SendRowData(rowValues); err != nil {
 				return c.SendErrorResponse(err.Error())
 			}
@@ -306,12 +329,15 @@ func (c *PgConn) SimpleQuery(query string) error {
 	if strings.HasPrefix("show transaction_read_only", query) {
 		query = "select 0"
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	c.cancel = cancel
-	defer func() {
-		cancel()
-		c.cancel = nil
-	}()
+	if name, pidQuery, ok := parseBackendSignal(query); ok {
+		return c.SignalBackends(name, pidQuery)
+	}
+	ctx, finish, err := c.beginQuery(query)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	defer finish()
+	query = c.server.queries.expandSystemViews(query)
 	stmt, err := c.conn.Prepare(query)
 	if err != nil {
 		if strings.Contains(err.Error(), "No statement to prepare") {
@@ -325,6 +351,66 @@ func (c *PgConn) SimpleQuery(query string) error {
 	return c.RunStmt(ctx, stmt, nil, true, query)
 }
 
+// beginQuery 按 backend key 登记查询，CancelRequest、pg_cancel_backend 和 KILL QUERY 通过取消返回的 context 中断查询
+// 查询结束时写入 query_log
+func (c *PgConn) beginQuery(query string) (context.Context, func(), error) {
+	c.progress = newChProgress()
+	c.queryErr = ""
+	q := &runningQuery{
+		ID:         newQueryID(),
+		User:       c.user,
+		Protocol:   "postgresql",
+		Query:      query,
+		Address:    c.wire.conn.RemoteAddr().String(),
+		PID:        c.pid(),
+		Progress:   c.progress,
+		BackendKey: c.keyData,
+	}
+	ctx, finish, err := c.server.queries.Begin(context.Background(), q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, func() {
+		finish()
+		entry := &queryLogEntry{
+			EventTime:   time.Now(),
+			QueryID:     q.ID,
+			User:        q.User,
+			Protocol:    q.Protocol,
+			Query:       q.Query,
+			Duration:    time.Since(q.Start),
+			ResultRows:  q.Progress.ResultRows(),
+			WrittenRows: q.Progress.WrittenRows(),
+			ResultBytes: q.Progress.ResultBytes(),
+			Exception:   c.queryErr,
+		}
+		c.server.metrics.ObserveQuery(entry)
+		c.server.queryLog.Record(entry)
+	}, nil
+}
+
+// pid 和 postgresql 一样用 BackendKeyData 的前 4 个字节作为连接的 pid
+func (c *PgConn) pid() int32 {
+	return int32(binary.BigEndian.Uint32(c.keyData[:4]) & 0x7fffffff)
+}
+
+// SignalBackends 执行 SELECT pg_cancel_backend(pid) / pg_terminate_backend(pid) [FROM ...]
+func (c *PgConn) SignalBackends(name, pidQuery string) error {
+	results, err := c.server.queries.signalBackends(context.Background(), c.db, name, pidQuery)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	if err = c.SendRowDescriptionWithColumnNameAndTypes([][2]string{{name, "BOOLEAN"}}); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if err = c.SendRowData([]driver.Value{result}); err != nil {
+			return err
+		}
+	}
+	return c.SendCommandComplete(fmt.Sprintf("SELECT %d", len(results)))
+}
+
 func (c *PgConn) SendParameterDescription(numInput int) error {
 	if numInput == 0 {
 		return nil
@@ -386,6 +472,7 @@ func (c *PgConn) SendRowDescription(columnNames []string, firstRowValues []drive
 func (c *PgConn) SendErrorResponse(errStr string) error {
 	logrus.Errorf("send error response: %s", errStr)
 	c.inError = true
+	c.queryErr = errStr
 	data := make([]byte, 0)
 	data = append(data, 'S')
 	data = append(data, cstr("ERROR")...)
@@ -416,6 +503,7 @@ func (c *PgConn) SendRowData(values []driver.Value) error {
 			data = append(data, pgVal.val...)
 		}
 	}
+	c.progress.AddResultBytes(int64(len(data)))
 	return c.wire.WriteMessage(NewMessage(DataRow, data))
 }
 
@@ -512,16 +600,17 @@ func (c *PgConn) Execute(portalName string, maxRows int32) error {
 	if !ok {
 		return c.SendErrorResponse(fmt.Sprintf("portal %s not found", portalName))
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	c.cancel = cancel
-	defer func() {
-		cancel()
-		c.cancel = nil
-	}()
+	ctx, finish, err := c.beginQuery(p.stmt.query)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	defer finish()
 	// work around for bad performance of using prepared statement with many input args, use simple query instead
 	// todo reduce cgo call in duckdb driver
-	if p.stmt.numInput > maxInputArgsUsePrepared {
-		query := bindValues(p.stmt.query, p.values)
+	// 引用了 system.processes 或 pg_stat_activity 时也要重新准备，预先准备的语句只能看到空视图
+	bound := bindValues(p.stmt.query, p.values)
+	query := c.server.queries.expandSystemViews(bound)
+	if p.stmt.numInput > maxInputArgsUsePrepared || query != bound {
 		stmt, err := c.conn.Prepare(query)
 		if err != nil {
 			return c.SendErrorResponse(err.Error())
@@ -581,20 +670,14 @@ func (c *PgConn) CopyIn(sql string) error {
 	}
 	cr := csv.NewReader(&copyReader{wire: c.wire})
 	v := make([]driver.Value, len(columnTypes))
-	ctx, cancel := context.WithCancel(context.Background())
-	c.cancel = cancel
-	defer func() {
-		cancel()
-		c.cancel = nil
-	}()
-	var canceled bool
-	go func() {
-		<-ctx.Done()
-		canceled = true
-	}()
+	ctx, finish, err := c.beginQuery(sql)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	defer finish()
 	rowCount := 0
 	for {
-		if canceled {
+		if ctx.Err() != nil {
 			return c.SendCopyFail()
 		}
 		row, err := cr.Read()
@@ -614,10 +697,12 @@ func (c *PgConn) CopyIn(sql string) error {
 			return c.SendErrorResponse(err.Error())
 		}
 		rowCount++
+		c.progress.AddWrittenRows(1)
 	}
 	if err := appender.Flush(); err != nil {
 		return c.SendErrorResponse(err.Error())
 	}
+	c.server.metrics.AppendedRows("postgresql", "copy", int64(rowCount))
 	return c.SendCommandComplete(fmt.Sprintf("COPY %d", rowCount))
 }
 
@@ -20,12 +20,16 @@ import (
 type ClickhouseOptions struct {
 	Enabled bool
 	Listen  string
+	// AdminUsers 开启认证时可以 KILL 其他用户查询的用户
+	AdminUsers map[string]bool
 }
 
 type serverOptions struct {
 	DbPath            string
 	Listen            string
 	ClickhouseOptions ClickhouseOptions
+	QueryLog          QueryLogOptions
+	Report            ReportOptions
 	UseHack           bool
 	Auth              bool
 }
@@ -34,6 +38,10 @@ type PgServer struct {
 	Connector  *duckdb.Connector
 	conn       *sql.DB
 	backends   sync.Map
+	queries    *queryRegistry
+	queryLog   *queryLog
+	metrics    *serverMetrics
+	reports    *reportBuffers
 	enableAuth bool
 }
 
@@ -71,6 +79,9 @@ from information_schema.columns;`,
 		`create view if not exists system.functions as
 select proname as name, prokind = 'a' as is_aggregate
 from pg_proc;`,
+		// 没有行的视图只提供表结构，查询时由 expandSystemViews 替换为正在执行的查询的快照
+		`create view if not exists system.processes as ` + renderRelation(processesColumns, nil),
+		`create view if not exists pg_stat_activity as ` + renderRelation(pgStatActivityColumns, nil),
 		`SET memory_limit = '500MB';`,
 	}
 	for _, stmt := range statements {
@@ -95,6 +106,16 @@ func (s *PgServer) Start(options serverOptions) error {
 	logrus.Infof("Open DuckDB database at %s", options.DbPath)
 	s.Connector = duckConnector
 	s.conn = sql.OpenDB(s.Connector)
+	s.queries = newQueryRegistry()
+	s.metrics = newServerMetrics(s.conn)
+	s.reports = newReportBuffers(s.conn, options.Report, s.metrics)
+	if err = s.reports.Start(); err != nil {
+		return err
+	}
+	s.queryLog = newQueryLog(s.conn, options.QueryLog)
+	if err = s.queryLog.Start(); err != nil {
+		return err
+	}
 
 	if options.Auth {
 		s.enableAuth = true
@@ -103,6 +124,9 @@ func (s *PgServer) Start(options serverOptions) error {
 	}
 
 	s.StartClickhouseHttp(options.ClickhouseOptions)
+	// 缓存的 /report 事件和 query_log 在 FORCE CHECKPOINT 之前写入
+	s.reports.Close()
+	s.queryLog.Close()
 
 	defer func() {
 		_, err = s.conn.ExecContext(context.Background(), "FORCE CHECKPOINT;")
@@ -146,11 +170,16 @@ func (s *PgServer) GetPassword(user string) (string, error) {
 }
 
 func (s *PgServer) StartClickhouseHttp(options ClickhouseOptions) {
-	chServer := ChServer{conn: sql.OpenDB(s.Connector), connector: s.Connector, pgServer: s}
+	chDB := sql.OpenDB(s.Connector)
+	chServer := ChServer{conn: chDB, connector: s.Connector, pgServer: s, sessions: newChSessionManager(chDB), queries: s.queries, queryLog: s.queryLog, metrics: s.metrics, reports: s.reports, adminUsers: options.AdminUsers}
+	sessionCtx, stopSessions := context.WithCancel(context.Background())
+	defer stopSessions()
+	go chServer.sessions.Run(sessionCtx)
 	logrus.Infof("Listening clickhouse http protocol on %s", options.Listen)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", chServer.ServeHTTP)
+	chServer.registerAdminHandlers(mux)
 
 	server := &http.Server{
 		Addr:    options.Listen,
@@ -181,14 +210,16 @@ func (s *PgServer) StartClickhouseHttp(options ClickhouseOptions) {
 }
 
 func (s *PgServer) Close(key [8]byte) {
-	s.backends.Delete(key)
+	if _, ok := s.backends.LoadAndDelete(key); ok {
+		s.metrics.PgConnected(-1)
+	}
+	s.queries.Disconnect(key)
 }
 
+// CancelRequest 取消 backend key 对应的连接上正在执行的查询
 func (s *PgServer) CancelRequest(key [8]byte) {
-	if backend, ok := s.backends.Load(key); ok {
-		if backend.(*PgConn).cancel != nil {
-			backend.(*PgConn).cancel()
-		}
+	if _, ok := s.backends.Load(key); ok {
+		s.queries.CancelBackend(key)
 	}
 }
 
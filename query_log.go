@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+)
+
+type QueryLogOptions struct {
+	Enabled bool
+	// SampleRate 成功的语句按比例记录，出错的语句总是记录
+	SampleRate    float64
+	TTL           time.Duration
+	FlushInterval time.Duration
+}
+
+const (
+	// queryLogQueueSize 等待写入的记录数上限，写入跟不上时丢弃新的记录，不阻塞查询
+	queryLogQueueSize = 10000
+	// queryLogBatchSize 攒够这么多条记录时不等 FlushInterval 直接写入
+	queryLogBatchSize = 1000
+	// queryLogMaxQueryLength 记录的语句长度上限，和 clickhouse 的 log_queries_cut_to_length 一样
+	queryLogMaxQueryLength = 100000
+	// queryLogCleanupInterval 按 TTL 删除过期记录的间隔
+	queryLogCleanupInterval = time.Hour
+)
+
+const queryLogTableDDL = `create table if not exists system.query_log
+(
+    type              varchar,
+    event_time        timestamptz,
+    query_id          varchar,
+    "user"            varchar,
+    protocol          varchar,
+    query_kind        varchar,
+    normalized_query  varchar,
+    query_duration_ms bigint,
+    result_rows       bigint,
+    written_rows      bigint,
+    result_bytes      bigint,
+    exception_code    integer,
+    exception         varchar
+);`
+
+// clickhouse 的错误码
+const (
+	exceptionCodeTimeout   = 159
+	exceptionCodeReadonly  = 164
+	exceptionCodeCancelled = 394
+	exceptionCodeUnknown   = 1001
+)
+
+// queryLogEntry 一条语句的执行记录，语句在写入时才归一化，不占用查询的时间
+type queryLogEntry struct {
+	EventTime   time.Time
+	QueryID     string
+	User        string
+	Protocol    string
+	Query       string
+	Duration    time.Duration
+	ResultRows  int64
+	WrittenRows int64
+	ResultBytes int64
+	Exception   string
+}
+
+// queryLog 把两种协议执行的语句异步批量写入 system.query_log
+type queryLog struct {
+	options QueryLogOptions
+	db      *sql.DB
+	entries chan *queryLogEntry
+	dropped atomic.Int64
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+func newQueryLog(db *sql.DB, options QueryLogOptions) *queryLog {
+	if !options.Enabled {
+		return nil
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = 7500 * time.Millisecond
+	}
+	return &queryLog{options: options, db: db, entries: make(chan *queryLogEntry, queryLogQueueSize)}
+}
+
+// Start 创建 system.query_log 并开始后台写入
+func (l *queryLog) Start() error {
+	if l == nil {
+		return nil
+	}
+	_, err := l.db.ExecContext(context.Background(), "create schema if not exists system;"+queryLogTableDDL)
+	if err != nil {
+		return err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	l.stop = stop
+	l.done = make(chan struct{})
+	go l.run(ctx)
+	return nil
+}
+
+// Close 写入剩余的记录后返回
+func (l *queryLog) Close() {
+	if l == nil || l.stop == nil {
+		return
+	}
+	l.stop()
+	<-l.done
+}
+
+// Record 按采样比例放入队列，队列满时丢弃
+func (l *queryLog) Record(e *queryLogEntry) {
+	if l == nil {
+		return
+	}
+	if e.Exception == "" && l.options.SampleRate < 1 && rand.Float64() >= l.options.SampleRate {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+func (l *queryLog) run(ctx context.Context) {
+	defer close(l.done)
+	flushTicker := time.NewTicker(l.options.FlushInterval)
+	defer flushTicker.Stop()
+	cleanupInterval := queryLogCleanupInterval
+	if l.options.TTL > 0 && l.options.TTL < cleanupInterval {
+		cleanupInterval = l.options.TTL
+	}
+	cleanupTicker := time.NewTicker(cleanupInterval)
+	defer cleanupTicker.Stop()
+	batch := make([]*queryLogEntry, 0, queryLogBatchSize)
+	flush := func() {
+		if n := l.dropped.Swap(0); n > 0 {
+			logrus.Warnf("query log queue is full, %d entries dropped", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := l.flush(batch); err != nil {
+			logrus.Warnf("write query log error: %v", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e := <-l.entries:
+			batch = append(batch, e)
+			if len(batch) >= queryLogBatchSize {
+				flush()
+			}
+		case <-flushTicker.C:
+			flush()
+		case <-cleanupTicker.C:
+			l.cleanup()
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-l.entries:
+					batch = append(batch, e)
+					continue
+				default:
+				}
+				break
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (l *queryLog) flush(batch []*queryLogEntry) error {
+	conn, err := l.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "system", "query_log")
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			typ, code, exception := "QueryFinish", int32(0), any(nil)
+			if e.Exception != "" {
+				typ, code, exception = "ExceptionWhileProcessing", exceptionCode(e.Exception), e.Exception
+			}
+			normalized := normalizeQuery(e.Query)
+			err = appender.AppendRow(typ, e.EventTime, e.QueryID, e.User, e.Protocol, queryKind(normalized), normalized,
+				e.Duration.Milliseconds(), e.ResultRows, e.WrittenRows, e.ResultBytes, code, exception)
+			if err != nil {
+				_ = appender.Close()
+				return err
+			}
+		}
+		return appender.Close()
+	})
+}
+
+// cleanup 删除超过 TTL 的记录
+func (l *queryLog) cleanup() {
+	if l.options.TTL <= 0 {
+		return
+	}
+	_, err := l.db.ExecContext(context.Background(), "DELETE FROM system.query_log WHERE event_time < ?", time.Now().Add(-l.options.TTL))
+	if err != nil {
+		logrus.Warnf("clean up query log error: %v", err)
+	}
+}
+
+// exceptionCode 按错误信息对应到 clickhouse 的错误码
+func exceptionCode(exception string) int32 {
+	switch {
+	case strings.Contains(exception, "Query was cancelled"):
+		return exceptionCodeCancelled
+	case strings.Contains(exception, "Timeout exceeded"):
+		return exceptionCodeTimeout
+	case strings.Contains(exception, "readonly mode"):
+		return exceptionCodeReadonly
+	default:
+		return exceptionCodeUnknown
+	}
+}
+
+var normalizeNumberRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]*)?([eE][-+]?[0-9]+)?`)
+var normalizeListRegexp = regexp.MustCompile(`\?(\s*,\s*\?)+`)
+
+// normalizeQuery 和 clickhouse 的 normalizeQuery 类似，字面量替换为 ?，连续的 ? 列表合并为 ?..，去掉注释并合并空白
+func normalizeQuery(query string) string {
+	var sb strings.Builder
+	space := false
+	emit := func(token string) {
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteString(token)
+	}
+	for i := 0; i < len(query) && sb.Len() <= queryLogMaxQueryLength; {
+		ch := query[i]
+		switch {
+		case ch == '\'':
+			i = skipQuoted(query, i)
+			emit("?")
+		case ch == '"' || ch == '`':
+			end := skipQuoted(query, i)
+			emit(query[i:end])
+			i = end
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(query)
+			}
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(query)
+			}
+			space = true
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+			space = true
+		case ch >= '0' && ch <= '9' && (i == 0 || !isIdentByte(query[i-1])):
+			i += len(normalizeNumberRegexp.FindString(query[i:]))
+			emit("?")
+		default:
+			emit(query[i : i+1])
+			i++
+		}
+	}
+	normalized := normalizeListRegexp.ReplaceAllString(sb.String(), "?..")
+	if len(normalized) > queryLogMaxQueryLength {
+		normalized = normalized[:queryLogMaxQueryLength]
+	}
+	return normalized
+}
+
+var queryKinds = map[string]string{
+	"SELECT": "Select", "WITH": "Select", "SHOW": "Select", "DESCRIBE": "Select", "DESC": "Select",
+	"EXPLAIN": "Select", "SUMMARIZE": "Select", "FROM": "Select", "VALUES": "Select", "PIVOT": "Select",
+	"UNPIVOT": "Select", "CALL": "Select", "INSERT": "Insert", "COPY": "Insert", "CREATE": "Create",
+	"DROP": "Drop", "ALTER": "Alter", "RENAME": "Rename", "DELETE": "Delete", "UPDATE": "Update",
+	"SET": "Set", "RESET": "Set", "KILL": "Kill", "BEGIN": "Transaction", "COMMIT": "Transaction",
+	"ROLLBACK": "Transaction", "USE": "Use",
+}
+
+var firstWordRegexp = regexp.MustCompile(`^[\s(]*([A-Za-z]+)`)
+
+// queryKind clickhouse query_log 的 query_kind，按语句的第一个关键字区分
+func queryKind(query string) string {
+	m := firstWordRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return "Other"
+	}
+	if kind, ok := queryKinds[strings.ToUpper(m[1])]; ok {
+		return kind
+	}
+	return "Other"
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM t WHERE s = 'a''b' AND a IN (1, 2.5, 3e2) -- c": "SELECT * FROM t WHERE s = ? AND a IN (?..)",
+		"insert into \"t1\"\n  values (1,'x')":                         `insert into "t1" values (?..)`,
+		"SELECT /* hint */ col1 FROM t2 LIMIT 10":                      "SELECT col1 FROM t2 LIMIT ?",
+	}
+	for query, expected := range cases {
+		if got := normalizeQuery(query); got != expected {
+			t.Errorf("normalizeQuery(%q) = %q, expected %q", query, got, expected)
+		}
+	}
+	if queryKind("(SELECT 1)") != "Select" || queryKind("insert into t values (?)") != "Insert" || queryKind("VACUUM") != "Other" {
+		t.Error("unexpected query kind")
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	l := newQueryLog(db, QueryLogOptions{Enabled: true, SampleRate: 0, FlushInterval: time.Hour})
+	if err = l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	l.Record(&queryLogEntry{EventTime: time.Now(), QueryID: "ok", Query: "SELECT 1"})
+	l.Record(&queryLogEntry{EventTime: time.Now(), QueryID: "failed", Query: "SELECT x", Exception: "Query was cancelled"})
+	l.Close()
+
+	// 采样比例为 0 时只记录出错的语句，Close 时写入剩余的记录
+	var id, typ string
+	var code int
+	err = db.QueryRow("SELECT query_id, type, exception_code FROM system.query_log").Scan(&id, &typ, &code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "failed" || typ != "ExceptionWhileProcessing" || code != exceptionCodeCancelled {
+		t.Errorf("unexpected query log record: %s %s %d", id, typ, code)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runningQuery 正在执行的查询，clickhouse 和 postgresql 协议共用
+type runningQuery struct {
+	ID       string
+	User     string
+	Protocol string
+	Query    string
+	Address  string
+	Start    time.Time
+	// PID postgresql 连接使用连接的 pid，http 请求由 registry 分配，pg_cancel_backend 按它取消
+	PID int32
+	// Progress 产生和写入的行数
+	Progress *chProgress
+	// BackendKey postgresql 连接的 BackendKeyData，CancelRequest 按它取消
+	BackendKey [8]byte
+	cancel     context.CancelFunc
+	cancelled  atomic.Bool
+}
+
+// State 查询被取消后到真正结束之前显示为 cancelled
+func (q *runningQuery) State() string {
+	if q.cancelled.Load() {
+		return "cancelled"
+	}
+	return "running"
+}
+
+func (q *runningQuery) Cancel() {
+	q.cancelled.Store(true)
+	q.cancel()
+}
+
+// pgBackend 一个 postgresql 连接，没有查询执行时在 pg_stat_activity 中显示为 idle
+type pgBackend struct {
+	PID             int32
+	Key             [8]byte
+	User            string
+	Address         string
+	ApplicationName string
+	Database        string
+	Start           time.Time
+	// Terminate 关闭连接，pg_terminate_backend 使用
+	Terminate func()
+	// 以下字段在查询开始和结束时由 registry 更新
+	queryID     string
+	query       string
+	queryStart  time.Time
+	stateChange time.Time
+	active      bool
+}
+
+// queryRegistry 登记正在执行的查询和 postgresql 连接，按 query_id、pid 和 backend key 取消。
+// 取消查询就是取消它的 context，go-duckdb 在 context 结束时调用 duckdb_interrupt
+type queryRegistry struct {
+	mu       sync.Mutex
+	byID     map[string]*runningQuery
+	byKey    map[[8]byte]*runningQuery
+	backends map[[8]byte]*pgBackend
+	nextPID  atomic.Int32
+}
+
+func newQueryRegistry() *queryRegistry {
+	return &queryRegistry{
+		byID:     map[string]*runningQuery{},
+		byKey:    map[[8]byte]*runningQuery{},
+		backends: map[[8]byte]*pgBackend{},
+	}
+}
+
+// Connect 登记认证完成的 postgresql 连接
+func (r *queryRegistry) Connect(b *pgBackend) {
+	if r == nil {
+		return
+	}
+	b.Start = time.Now()
+	b.stateChange = b.Start
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backends[b.Key] = b
+}
+
+// Disconnect 连接关闭时调用
+func (r *queryRegistry) Disconnect(key [8]byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.backends, key)
+}
+
+// Begin 登记查询，返回的 context 在查询被取消时结束，finish 在查询结束时调用。
+// 和 clickhouse 一样，同一个 query_id 不能同时执行
+func (r *queryRegistry) Begin(ctx context.Context, q *runningQuery) (context.Context, func(), error) {
+	ctx, cancel := context.WithCancel(ctx)
+	if r == nil {
+		return ctx, cancel, nil
+	}
+	q.Start = time.Now()
+	q.cancel = cancel
+	if q.PID == 0 {
+		q.PID = r.nextPID.Add(1)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byID[q.ID]; ok {
+		cancel()
+		return nil, nil, fmt.Errorf("Query with id = %s is already running", q.ID)
+	}
+	r.byID[q.ID] = q
+	if q.BackendKey != [8]byte{} {
+		r.byKey[q.BackendKey] = q
+		if b, ok := r.backends[q.BackendKey]; ok {
+			b.queryID, b.query, b.queryStart, b.stateChange, b.active = q.ID, q.Query, q.Start, q.Start, true
+		}
+	}
+	finish := func() {
+		cancel()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.byID[q.ID] == q {
+			delete(r.byID, q.ID)
+		}
+		if r.byKey[q.BackendKey] == q {
+			delete(r.byKey, q.BackendKey)
+			if b, ok := r.backends[q.BackendKey]; ok {
+				b.stateChange, b.active = time.Now(), false
+			}
+		}
+	}
+	return ctx, finish, nil
+}
+
+// Cancel 取消 query_id 对应的查询
+func (r *queryRegistry) Cancel(id string) bool {
+	r.mu.Lock()
+	q, ok := r.byID[id]
+	r.mu.Unlock()
+	if ok {
+		q.Cancel()
+	}
+	return ok
+}
+
+// CancelBackend 取消 postgresql 连接上正在执行的查询
+func (r *queryRegistry) CancelBackend(key [8]byte) bool {
+	r.mu.Lock()
+	q, ok := r.byKey[key]
+	r.mu.Unlock()
+	if ok {
+		q.Cancel()
+	}
+	return ok
+}
+
+// CancelPID 取消 pid 对应的查询，和 postgresql 一样，pid 存在但没有查询执行时也返回 true
+func (r *queryRegistry) CancelPID(pid int32) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := false
+	for _, q := range r.byID {
+		if q.PID == pid {
+			q.Cancel()
+			found = true
+		}
+	}
+	for _, b := range r.backends {
+		if b.PID == pid {
+			found = true
+		}
+	}
+	return found
+}
+
+// TerminatePID 取消 pid 对应的查询并关闭 postgresql 连接，http 请求只取消查询
+func (r *queryRegistry) TerminatePID(pid int32) bool {
+	found := r.CancelPID(pid)
+	r.mu.Lock()
+	var terminate []func()
+	for _, b := range r.backends {
+		if b.PID == pid && b.Terminate != nil {
+			terminate = append(terminate, b.Terminate)
+		}
+	}
+	r.mu.Unlock()
+	for _, fn := range terminate {
+		fn()
+	}
+	return found
+}
+
+// List 按开始时间排序的正在执行的查询
+func (r *queryRegistry) List() []*runningQuery {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	queries := make([]*runningQuery, 0, len(r.byID))
+	for _, q := range r.byID {
+		queries = append(queries, q)
+	}
+	r.mu.Unlock()
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].Start.Before(queries[j].Start)
+	})
+	return queries
+}
+
+// Backends 按连接时间排序的 postgresql 连接，返回的是副本
+func (r *queryRegistry) Backends() []pgBackend {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	backends := make([]pgBackend, 0, len(r.backends))
+	for _, b := range r.backends {
+		backends = append(backends, *b)
+	}
+	r.mu.Unlock()
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Start.Before(backends[j].Start)
+	})
+	return backends
+}
+
+// wait 等待查询结束，超时返回 false
+func (r *queryRegistry) wait(ctx context.Context, id string, timeout time.Duration) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		r.mu.Lock()
+		_, running := r.byID[id]
+		r.mu.Unlock()
+		if !running {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQueryRegistry(t *testing.T) {
+	r := newQueryRegistry()
+	ctx, finish, err := r.Begin(context.Background(), &runningQuery{ID: "q1", Query: "SELECT 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = r.Begin(context.Background(), &runningQuery{ID: "q1"}); err == nil {
+		t.Error("expected duplicate query_id to be rejected")
+	}
+	if !r.Cancel("q1") || ctx.Err() == nil {
+		t.Error("expected q1 to be cancelled")
+	}
+	finish()
+	if r.Cancel("q1") || len(r.List()) != 0 {
+		t.Error("expected q1 to be removed after finish")
+	}
+
+	key := [8]byte{1, 2, 3}
+	ctx, finish, err = r.Begin(context.Background(), &runningQuery{ID: "q2", BackendKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finish()
+	if r.CancelBackend([8]byte{9}) || !r.CancelBackend(key) || ctx.Err() == nil {
+		t.Error("expected cancellation by backend key")
+	}
+	if !r.wait(context.Background(), "missing", 0) {
+		t.Error("expected wait on a finished query to return immediately")
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+)
+
+type ReportOptions struct {
+	// BufferMaxRows、BufferMaxBytes 一个表缓存的行数或字节数达到上限时立即写入
+	BufferMaxRows  int
+	BufferMaxBytes int
+	// FlushInterval 表的第一行进入缓存后最多等待的时间
+	FlushInterval time.Duration
+	// TypePolicies 按表固定列类型、禁止放宽列类型或者指定嵌套对象的映射方式
+	TypePolicies ReportTypePolicies
+	// MaxDepth 嵌套对象展开的最大层数，MaxColumns 一个表的最大列数，为 0 时不限制
+	MaxDepth   int
+	MaxColumns int
+	// DeadLetters 写入失败的事件保存到 duckserver.dead_letters
+	DeadLetters bool
+	// BusinessIDPattern business_id 必须匹配的格式，为 nil 时使用 reportBusinessIDPattern
+	BusinessIDPattern *regexp.Regexp
+	// KeyMode 不合法的键替换为合法的列名（sanitize）或者拒绝事件（reject）
+	KeyMode string
+	// DedupKeys 按表配置的去重键，DedupWindow 内重复的事件只返回成功，不再写入。
+	// DedupMaxKeys 最多保存的去重键数
+	DedupKeys    ReportDedupKeys
+	DedupWindow  time.Duration
+	DedupMaxKeys int
+	// ConfigReload 重新读取 duckserver.report_configs 的间隔
+	ConfigReload time.Duration
+	// TrustedProxies 可信的代理，只有来自这些地址的 X-Forwarded-For 才会被采用
+	TrustedProxies []*net.IPNet
+	// GeoIPPath 本地的 MaxMind 格式文件，用于补充 _country 列
+	GeoIPPath string
+}
+
+var errReportBuffersClosed = errors.New("server is shutting down")
+var errReportBuffersDisabled = errors.New("report ingestion is not enabled")
+
+// reportEvent 一条等待写入的 /report 事件，done 为 nil 时客户端不等待写入结果。
+// deadLetter 为 true 时写入失败的事件保存到 duckserver.dead_letters，重放的事件为 false。
+// 写入失败时删除去重键 dedupKey，客户端重试时可以再次写入
+type reportEvent struct {
+	row        map[string]any
+	raw        string
+	dedupKey   string
+	received   time.Time
+	deadLetter bool
+	done       chan error
+}
+
+// reportBuffer 一个表的缓存，和 clickhouse 的 Buffer 表类似
+type reportBuffer struct {
+	table  string
+	events []*reportEvent
+	bytes  int
+	timer  *time.Timer
+	// flushes 正在后台写入的批数，为 0 并且没有缓存的事件时从 reportBuffers.tables 中删除
+	flushes int
+	// flushMu 同一个表的写入依次执行
+	flushMu sync.Mutex
+}
+
+// reportBuffers 按表缓存 /report 事件，达到行数、字节数或时间限制时通过 Appender 批量写入，
+// 关闭时写入所有缓存，之后由 Start 执行 FORCE CHECKPOINT
+type reportBuffers struct {
+	db      *sql.DB
+	options ReportOptions
+	metrics *serverMetrics
+	schemas *reportSchemas
+	idents  *reportIdentifiers
+	// dedup 为 nil 时不去重
+	dedup *reportDedup
+	// configs 由 Start 创建，为 nil 时所有 business_id 使用默认的配置
+	configs *reportConfigs
+	// geo 由 Start 打开，为 nil 时不补充 _country 列
+	geo reportGeo
+	// deadLetters 为 nil 时不保存写入失败的事件
+	deadLetters *deadLetters
+	replayMu    sync.Mutex
+	mu          sync.Mutex
+	tables      map[string]*reportBuffer
+	closed      bool
+	flushing    sync.WaitGroup
+	stageSeq    atomic.Int64
+}
+
+func newReportBuffers(db *sql.DB, options ReportOptions, metrics *serverMetrics) *reportBuffers {
+	if options.BufferMaxRows <= 0 {
+		options.BufferMaxRows = 10000
+	}
+	if options.BufferMaxBytes <= 0 {
+		options.BufferMaxBytes = 16 << 20
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = time.Second
+	}
+	b := &reportBuffers{db: db, options: options, metrics: metrics, schemas: newReportSchemas(db, metrics, options),
+		idents: newReportIdentifiers(db, options.BusinessIDPattern, options.KeyMode), tables: map[string]*reportBuffer{}}
+	if options.DeadLetters {
+		b.deadLetters = &deadLetters{db: db}
+	}
+	if len(options.DedupKeys) > 0 {
+		b.dedup = newReportDedup(options.DedupWindow, options.DedupMaxKeys)
+	}
+	return b
+}
+
+// Dedup 返回事件的去重键，窗口内出现过这个键时 duplicate 为 true。
+// header 读取请求头，line 为事件在批量请求中的序号
+func (b *reportBuffers) Dedup(table, body string, header func(string) string, line int, batch bool) (key string, duplicate bool) {
+	if b == nil || b.dedup == nil {
+		return "", false
+	}
+	spec := b.options.DedupKeys.get(table)
+	if spec == "" {
+		return "", false
+	}
+	if key = reportDedupKey(spec, body, header, line, batch); key == "" {
+		return "", false
+	}
+	if b.dedup.Seen(table, key) {
+		b.metrics.ReportDuplicates()
+		return key, true
+	}
+	return key, false
+}
+
+// forgetDedup 删除写入失败的事件的去重键
+func (b *reportBuffers) forgetDedup(table string, events ...*reportEvent) {
+	if b == nil || b.dedup == nil {
+		return
+	}
+	for _, e := range events {
+		if e.dedupKey != "" {
+			b.dedup.Forget(table, e.dedupKey)
+		}
+	}
+}
+
+// RecordDeadLetters 保存没有放入缓存的事件，例如解析失败的事件
+func (b *reportBuffers) RecordDeadLetters(letters ...deadLetter) {
+	if b != nil {
+		b.deadLetters.Record(letters...)
+	}
+}
+
+// Start 创建死信表和 duckserver.report_configs，打开 GeoIP 文件
+func (b *reportBuffers) Start() error {
+	if b == nil {
+		return nil
+	}
+	if b.options.GeoIPPath != "" {
+		geo, err := openMaxmindGeo(b.options.GeoIPPath)
+		if err != nil {
+			return err
+		}
+		b.geo = geo
+	}
+	configs := newReportConfigs(b.db, b.options.ConfigReload)
+	if err := configs.Start(); err != nil {
+		return err
+	}
+	b.configs = configs
+	return b.deadLetters.Start()
+}
+
+// ClientIP 请求的客户端 IP，只信任 TrustedProxies 添加的 X-Forwarded-For
+func (b *reportBuffers) ClientIP(remoteAddr, forwardedFor string) string {
+	if b == nil {
+		return reportClientIP(remoteAddr, "", nil)
+	}
+	return reportClientIP(remoteAddr, forwardedFor, b.options.TrustedProxies)
+}
+
+// policy 合并命令行的类型策略和 report_configs 的配置，配置中的类型优先
+func (b *reportBuffers) policy(table string, config *reportConfig) *ReportTypePolicy {
+	policy := b.options.TypePolicies.get(table)
+	if config == nil {
+		return policy
+	}
+	merged := *policy
+	merged.Pinned = make(map[string]string, len(policy.Pinned)+len(config.Types))
+	for column, typ := range policy.Pinned {
+		merged.Pinned[column] = typ
+	}
+	for column, typ := range config.Types {
+		merged.Pinned[column] = typ
+	}
+	merged.NoDDL = !config.AutoDDL
+	return &merged
+}
+
+// target 事件写入的表，没有配置时为和 business_id 同名的表
+func (b *reportBuffers) target(table string, config *reportConfig) reportTarget {
+	if config == nil {
+		return reportTarget{Table: table}
+	}
+	return config.Target
+}
+
+// ValidateTable 校验 business_id 能否作为表名
+func (b *reportBuffers) ValidateTable(table string) error {
+	if b == nil {
+		return newReportIdentifiers(nil, nil, "").Table(table)
+	}
+	return b.idents.Table(table)
+}
+
+// Parse 解析 /report 的 JSON 事件，按表的策略和 report_configs 的配置映射为一行
+func (b *reportBuffers) Parse(table, body string) (map[string]any, error) {
+	if err := b.ValidateTable(table); err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	if err := unmarshalJSONNumber(body, &data); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, errors.New("body data is not a json object")
+		}
+		return nil, fmt.Errorf("body data is not json format: %w", err)
+	}
+	if data == nil {
+		return nil, errors.New("body data is not a json object")
+	}
+	if b == nil {
+		return flattenReport(data, reportNestedFlatten, 0, 0, newReportIdentifiers(nil, nil, "").Key)
+	}
+	row, err := flattenReport(data, b.options.TypePolicies.get(table).Nested, b.options.MaxDepth, b.options.MaxColumns, b.idents.Key)
+	if err != nil {
+		return nil, err
+	}
+	if config := b.configs.Get(table); config != nil {
+		return config.apply(row, time.Now())
+	}
+	return row, nil
+}
+
+// Add 把事件放入表的缓存。wait 为 true 时等待事件写入后返回写入的结果，
+// 客户端断开时不再等待，但事件仍然会写入
+func (b *reportBuffers) Add(ctx context.Context, table string, row map[string]any, raw string, wait bool) error {
+	return b.AddMany(ctx, table, []map[string]any{row}, []string{raw}, nil, wait)[0]
+}
+
+// AddMany 把一个请求的多个事件放入表的缓存，raws 为事件的原始 JSON，dedupKeys 为 Dedup 返回的去重键，
+// 可以为 nil。返回每个事件的写入结果，不等待时写入失败的事件同样会删除去重键
+func (b *reportBuffers) AddMany(ctx context.Context, table string, rows []map[string]any, raws, dedupKeys []string, wait bool) []error {
+	now := time.Now()
+	events := make([]*reportEvent, len(rows))
+	for i, row := range rows {
+		events[i] = &reportEvent{row: row, raw: raws[i], received: now, deadLetter: true}
+		if dedupKeys != nil {
+			events[i].dedupKey = dedupKeys[i]
+		}
+		if wait {
+			events[i].done = make(chan error, 1)
+		}
+	}
+	return b.enqueue(ctx, table, events, wait)
+}
+
+func (b *reportBuffers) enqueue(ctx context.Context, table string, events []*reportEvent, wait bool) []error {
+	errs := make([]error, len(events))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		b.forgetDedup(table, events...)
+		return errs
+	}
+	if b == nil {
+		return fail(errReportBuffersDisabled)
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return fail(errReportBuffersClosed)
+	}
+	buf, ok := b.tables[table]
+	if !ok {
+		buf = &reportBuffer{table: table}
+		b.tables[table] = buf
+	}
+	for _, event := range events {
+		buf.events = append(buf.events, event)
+		buf.bytes += len(event.raw)
+		if len(buf.events) >= b.options.BufferMaxRows || buf.bytes >= b.options.BufferMaxBytes {
+			b.flushLocked(buf)
+		}
+	}
+	if len(buf.events) > 0 && buf.timer == nil {
+		buf.timer = time.AfterFunc(b.options.FlushInterval, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.flushLocked(buf)
+		})
+	}
+	b.mu.Unlock()
+	if !wait {
+		return errs
+	}
+	for i, event := range events {
+		select {
+		case errs[i] = <-event.done:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+	return errs
+}
+
+// flushLocked 取出缓存的事件在后台写入，调用时持有 b.mu
+func (b *reportBuffers) flushLocked(buf *reportBuffer) {
+	if buf.timer != nil {
+		buf.timer.Stop()
+		buf.timer = nil
+	}
+	if len(buf.events) == 0 {
+		return
+	}
+	events := buf.events
+	buf.events, buf.bytes = nil, 0
+	buf.flushes++
+	b.flushing.Add(1)
+	go func() {
+		defer b.flushing.Done()
+		buf.flushMu.Lock()
+		b.write(buf.table, events)
+		buf.flushMu.Unlock()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		buf.flushes--
+		// 空闲的缓存不再保留，客户端可以使用任意合法的 business_id
+		if buf.flushes == 0 && len(buf.events) == 0 && b.tables[buf.table] == buf {
+			delete(b.tables, buf.table)
+		}
+	}()
+}
+
+// Close 不再接受新的事件，写入所有缓存后返回
+func (b *reportBuffers) Close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.closed = true
+	for _, buf := range b.tables {
+		b.flushLocked(buf)
+	}
+	b.mu.Unlock()
+	b.flushing.Wait()
+	b.configs.Close()
+	if b.geo != nil {
+		_ = b.geo.Close()
+	}
+}
+
+// write 整批写入，失败时逐条重试，只有出错的事件返回错误。
+// 出错的事件先写入死信再通知客户端
+func (b *reportBuffers) write(table string, events []*reportEvent) {
+	rows := make([]map[string]any, len(events))
+	for i, e := range events {
+		rows[i] = e.row
+	}
+	errs := make([]error, len(events))
+	err := b.insert(table, rows)
+	if err != nil && len(events) > 1 {
+		logrus.Warnf("write %d reports into %s error: %v, retrying one by one", len(events), table, err)
+		for i, e := range events {
+			errs[i] = b.insert(table, []map[string]any{e.row})
+		}
+	} else {
+		if err != nil {
+			logrus.Warnf("write report into %s error: %v", table, err)
+		}
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	var letters []deadLetter
+	for i, e := range events {
+		if errs[i] != nil && e.deadLetter {
+			letters = append(letters, deadLetter{BusinessID: table, Payload: e.raw, Error: errs[i].Error(), ReceivedAt: e.received})
+		}
+	}
+	b.deadLetters.Record(letters...)
+	for i, e := range events {
+		if errs[i] != nil {
+			b.forgetDedup(table, e)
+		}
+		if e.done != nil {
+			e.done <- errs[i]
+		}
+	}
+}
+
+// insert 由 reportSchemas 建表、加列或放宽列类型后写入。
+// 写入失败时重新读取表结构，有变化时重试一次
+func (b *reportBuffers) insert(table string, rows []map[string]any) error {
+	ctx := context.Background()
+	config := b.configs.Get(table)
+	target, policy := b.target(table, config), b.policy(table, config)
+	columnNames, columnTypes := reportStageColumns(rows)
+	if len(columnNames) == 0 {
+		return errors.New("report has no columns")
+	}
+	var insertErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		tableTypes, changed, err := b.schemas.Ensure(ctx, target, policy, columnNames, columnTypes)
+		if err != nil {
+			return err
+		}
+		if attempt > 0 && !changed {
+			return insertErr
+		}
+		// VARCHAR 列保留原始的字符串，例如时间不经过 TIMESTAMPTZ 转换。
+		// 字段不同的 STRUCT 不能转换，能容纳事件的 STRUCT、LIST 列使用表中的类型
+		stageTypes := make([]*reportType, len(columnTypes))
+		for i, typ := range columnTypes {
+			stageTypes[i] = parseReportType(typ)
+			tableType := parseReportType(tableTypes[i])
+			if tableType.Name == "VARCHAR" || tableType.nested() && joinReportTypes(tableType, stageTypes[i]).String() == tableType.String() {
+				stageTypes[i] = tableType
+			}
+		}
+		if insertErr = b.append(ctx, target, columnNames, stageTypes, rows); insertErr == nil {
+			b.metrics.AppendedRows("http", "report", int64(len(rows)))
+			return nil
+		}
+		// 缓存的表结构可能已经过期，例如表被删除或者列被修改
+		b.schemas.Invalidate(target)
+	}
+	return insertErr
+}
+
+// append 通过 Appender 写入临时表，再按列名插入目标表
+func (b *reportBuffers) append(ctx context.Context, target reportTarget, columnNames []string, columnTypes []*reportType, rows []map[string]any) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stage := fmt.Sprintf("report_stage_%d", b.stageSeq.Add(1))
+	columnDefs := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		columnDefs[i] = quoteIdentifier(name) + " " + columnTypes[i].String()
+	}
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (%s)", stage, strings.Join(columnDefs, ", "))); err != nil {
+		return fmt.Errorf("creating stage table: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS temp."+stage)
+	err = conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", stage)
+		if err != nil {
+			return fmt.Errorf("creating appender: %w", err)
+		}
+		values := make([]driver.Value, len(columnNames))
+		for _, row := range rows {
+			for i, name := range columnNames {
+				values[i] = reportStageValue(row[name], columnTypes[i])
+			}
+			if err = appender.AppendRow(values...); err != nil {
+				_ = appender.Close()
+				return err
+			}
+		}
+		return appender.Close()
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s BY NAME SELECT * FROM %s", target.quoted(), stage))
+	return err
+}
+
+// reportStageColumns 一批事件的列，类型不同时合并为较宽的类型
+func reportStageColumns(rows []map[string]any) ([]string, []string) {
+	types := map[string]*reportType{}
+	for _, row := range rows {
+		for name, value := range row {
+			typ := reportValueType(name, value)
+			if typ.Name == "NULL" {
+				continue
+			}
+			if current, ok := types[name]; !ok {
+				types[name] = typ
+			} else {
+				types[name] = joinReportTypes(current, typ)
+			}
+		}
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	columnTypes := make([]string, len(names))
+	for i, name := range names {
+		columnTypes[i] = types[name].String()
+	}
+	return names, columnTypes
+}
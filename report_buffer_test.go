@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestReportBuffers(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE events (id VARCHAR, n DOUBLE)"); err != nil {
+		t.Fatal(err)
+	}
+
+	policies := ReportTypePolicies{}
+	if err = policies.ForbidWidening("events"); err != nil {
+		t.Fatal(err)
+	}
+	b := newReportBuffers(db, ReportOptions{BufferMaxRows: 5, FlushInterval: time.Hour, TypePolicies: policies}, nil)
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			row := map[string]any{"id": fmt.Sprint(i), "n": json.Number(fmt.Sprint(i))}
+			if i == 4 {
+				row["n"] = "not a number"
+			}
+			if i%2 == 0 {
+				row["extra"] = "x"
+			}
+			errs[i] = b.Add(context.Background(), "events", row, "{}", true)
+		}(i)
+	}
+	// 达到 BufferMaxRows 后不等 FlushInterval 直接写入，缺少的列自动添加，整批失败时逐条重试，只有类型冲突的事件出错
+	wg.Wait()
+	for i, err := range errs {
+		if (err != nil) != (i == 4) {
+			t.Errorf("event %d: unexpected error %v", i, err)
+		}
+	}
+	// 写入完成后删除空闲的缓存和表结构
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		idle := len(b.tables) == 0
+		b.mu.Unlock()
+		if idle {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("expected the idle buffer to be removed")
+		}
+	}
+	b.schemas.mu.Lock()
+	b.schemas.evict(time.Now().Add(time.Minute))
+	cached := len(b.schemas.tables)
+	b.schemas.mu.Unlock()
+	if cached != 0 {
+		t.Errorf("expected idle schemas to be evicted, got %d", cached)
+	}
+
+	if err = b.Add(context.Background(), "events", map[string]any{"id": "late"}, "{}", false); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if err = b.Add(context.Background(), "events", map[string]any{"id": "closed"}, "{}", false); err != errReportBuffersClosed {
+		t.Errorf("expected closed buffers to reject events, got %v", err)
+	}
+	var count, extra int
+	if err = db.QueryRow("SELECT count(*), count(extra) FROM events").Scan(&count, &extra); err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 || extra != 2 {
+		t.Errorf("unexpected rows: %d %d", count, extra)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+)
+
+// reportConfigsTableDDL 每个 business_id 一行。ignored_fields、required_fields 和 column_renames 的键为展开后的事件字段，
+// type_overrides 和 time_column 为表的列名，enrich 为服务端补充的列（receive_time、client_ip、user_agent、clock_skew、country）。
+// duckdb 不能在有主键的表上更新 LIST 列，所以 business_id 不是主键
+const reportConfigsTableDDL = `CREATE SCHEMA IF NOT EXISTS duckserver;
+CREATE TABLE IF NOT EXISTS duckserver.report_configs (
+	business_id VARCHAR NOT NULL,
+	target_schema VARCHAR,
+	target_table VARCHAR,
+	column_renames MAP(VARCHAR, VARCHAR),
+	required_fields VARCHAR[],
+	ignored_fields VARCHAR[],
+	type_overrides MAP(VARCHAR, VARCHAR),
+	time_column VARCHAR,
+	auto_ddl BOOLEAN DEFAULT true,
+	enrich VARCHAR[]
+);
+ALTER TABLE duckserver.report_configs ADD COLUMN IF NOT EXISTS enrich VARCHAR[];`
+
+// reportConfigReload 默认重新读取 report_configs 的间隔
+const reportConfigReload = 10 * time.Second
+
+// reportTarget 事件写入的表，Schema 为空时使用当前的 schema
+type reportTarget struct {
+	Schema string
+	Table  string
+}
+
+func (t reportTarget) String() string {
+	if t.Schema == "" {
+		return t.Table
+	}
+	return t.Schema + "." + t.Table
+}
+
+func (t reportTarget) quoted() string {
+	if t.Schema == "" {
+		return quoteIdentifier(t.Table)
+	}
+	return quoteIdentifier(t.Schema) + "." + quoteIdentifier(t.Table)
+}
+
+// reportConfig duckserver.report_configs 中一个 business_id 的配置，map 的键为小写
+type reportConfig struct {
+	Target     reportTarget
+	Renames    map[string]string
+	Required   []string
+	Ignored    map[string]bool
+	Types      map[string]string
+	TimeColumn string
+	AutoDDL    bool
+	Enrich     []string
+}
+
+// apply 删除忽略的字段，重命名字段，检查必需的字段，没有时间列时使用接收时间
+func (c *reportConfig) apply(row map[string]any, received time.Time) (map[string]any, error) {
+	for _, field := range c.Required {
+		if !reportRowHas(row, field) {
+			return nil, fmt.Errorf("required field %q is missing", field)
+		}
+	}
+	out := make(map[string]any, len(row)+1)
+	names := map[string]string{}
+	for key, value := range row {
+		lower := strings.ToLower(key)
+		if c.Ignored[lower] {
+			continue
+		}
+		name := key
+		if rename, ok := c.Renames[lower]; ok {
+			name = rename
+		}
+		if other, ok := names[strings.ToLower(name)]; ok {
+			return nil, fmt.Errorf("fields %q and %q map to the same column %q", other, key, name)
+		}
+		names[strings.ToLower(name)] = key
+		out[name] = value
+	}
+	if c.TimeColumn != "" && !reportRowHas(out, c.TimeColumn) {
+		out[c.TimeColumn] = received
+	}
+	return out, nil
+}
+
+func reportRowHas(row map[string]any, name string) bool {
+	for key, value := range row {
+		if value != nil && strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportConfigs 缓存 duckserver.report_configs，后台每隔 reload 重新读取整个表后整体替换，
+// 读取失败时继续使用上一次的配置
+type reportConfigs struct {
+	db      *sql.DB
+	reload  time.Duration
+	configs atomic.Pointer[map[string]*reportConfig]
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newReportConfigs(db *sql.DB, reload time.Duration) *reportConfigs {
+	if reload <= 0 {
+		reload = reportConfigReload
+	}
+	return &reportConfigs{db: db, reload: reload, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start 创建表并读取配置，然后在后台定期重新读取，由 Close 停止
+func (c *reportConfigs) Start() error {
+	if _, err := c.db.ExecContext(context.Background(), reportConfigsTableDDL); err != nil {
+		return err
+	}
+	c.refresh()
+	go c.run()
+	return nil
+}
+
+func (c *reportConfigs) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
+
+func (c *reportConfigs) refresh() {
+	configs, err := c.load()
+	if err != nil {
+		logrus.Warnf("read duckserver.report_configs error: %v", err)
+		return
+	}
+	c.configs.Store(&configs)
+}
+
+func (c *reportConfigs) Close() {
+	if c != nil {
+		close(c.stop)
+		<-c.done
+	}
+}
+
+// Get 返回 business_id 的配置，没有配置时返回 nil
+func (c *reportConfigs) Get(businessID string) *reportConfig {
+	if c == nil {
+		return nil
+	}
+	configs := c.configs.Load()
+	if configs == nil {
+		return nil
+	}
+	return (*configs)[strings.ToLower(businessID)]
+}
+
+func (c *reportConfigs) load() (map[string]*reportConfig, error) {
+	rows, err := c.db.Query(`SELECT business_id, coalesce(target_schema, ''), coalesce(target_table, ''), column_renames,
+		required_fields, ignored_fields, type_overrides, coalesce(time_column, ''), coalesce(auto_ddl, true), enrich
+		FROM duckserver.report_configs ORDER BY business_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	configs := map[string]*reportConfig{}
+	for rows.Next() {
+		var businessID string
+		var renames, required, ignored, types, enrich any
+		config := &reportConfig{Renames: map[string]string{}, Ignored: map[string]bool{}, Types: map[string]string{}}
+		if err = rows.Scan(&businessID, &config.Target.Schema, &config.Target.Table, &renames,
+			&required, &ignored, &types, &config.TimeColumn, &config.AutoDDL, &enrich); err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(businessID)
+		if _, ok := configs[key]; ok {
+			logrus.Warnf("duplicate report config of %s is ignored", businessID)
+			continue
+		}
+		if config.Target.Table == "" {
+			config.Target.Table = businessID
+		}
+		for k, v := range reportConfigMap(renames) {
+			config.Renames[strings.ToLower(k)] = v
+		}
+		config.Required = reportConfigList(required)
+		for _, field := range reportConfigList(ignored) {
+			config.Ignored[strings.ToLower(field)] = true
+		}
+		for k, v := range reportConfigMap(types) {
+			typ, err := checkReportType(v)
+			if err != nil {
+				return nil, fmt.Errorf("type_overrides of %s: %w", businessID, err)
+			}
+			config.Types[strings.ToLower(k)] = typ
+		}
+		for _, item := range reportConfigList(enrich) {
+			switch item = strings.ToLower(item); item {
+			case reportEnrichReceiveTime, reportEnrichClientIP, reportEnrichUserAgent, reportEnrichClockSkew, reportEnrichCountry:
+				config.Enrich = append(config.Enrich, item)
+			default:
+				logrus.Warnf("unknown enrich %q in report config of %s is ignored", item, businessID)
+			}
+		}
+		configs[key] = config
+	}
+	return configs, rows.Err()
+}
+
+func reportConfigMap(value any) map[string]string {
+	out := map[string]string{}
+	if m, ok := value.(duckdb.Map); ok {
+		for k, v := range m {
+			if k != nil && v != nil {
+				out[fmt.Sprint(k)] = fmt.Sprint(v)
+			}
+		}
+	}
+	return out
+}
+
+func reportConfigList(value any) []string {
+	var out []string
+	if list, ok := value.([]any); ok {
+		for _, v := range list {
+			if v != nil {
+				out = append(out, fmt.Sprint(v))
+			}
+		}
+	}
+	return out
+}
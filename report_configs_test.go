@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestReportConfigs(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	b := newReportBuffers(db, ReportOptions{FlushInterval: 10 * time.Millisecond, ConfigReload: time.Millisecond}, nil)
+	if err = b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err = db.Exec(`INSERT INTO duckserver.report_configs VALUES
+		('events', 'analytics', 'ev', MAP {'uid': 'user_id'}, ['uid'], ['debug'], MAP {'n': 'VARCHAR'}, 'received_at', true, NULL),
+		('locked', NULL, NULL, NULL, NULL, NULL, NULL, NULL, false, NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("CREATE TABLE locked (id BIGINT)"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	report := func(table, body string) error {
+		row, err := b.Parse(table, body)
+		if err != nil {
+			return err
+		}
+		return b.Add(context.Background(), table, row, body, true)
+	}
+
+	if err = report("events", `{"uid":"u1","n":1,"debug":"x"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = report("events", `{"n":2}`); err == nil || !strings.Contains(err.Error(), `required field "uid" is missing`) {
+		t.Errorf("unexpected error %v", err)
+	}
+	var columns string
+	if err = db.QueryRow(`SELECT string_agg(column_name || ' ' || data_type, ',' ORDER BY column_name) FROM information_schema.columns
+		WHERE table_schema = 'analytics' AND table_name = 'ev'`).Scan(&columns); err != nil {
+		t.Fatal(err)
+	}
+	if columns != "n VARCHAR,received_at TIMESTAMP WITH TIME ZONE,user_id VARCHAR" {
+		t.Errorf("unexpected columns %s", columns)
+	}
+	var user, n string
+	var received time.Time
+	if err = db.QueryRow(`SELECT user_id, n, received_at FROM analytics.ev`).Scan(&user, &n, &received); err != nil {
+		t.Fatal(err)
+	}
+	if user != "u1" || n != "1" || time.Since(received) > time.Minute {
+		t.Errorf("unexpected row %s %s %v", user, n, received)
+	}
+
+	if err = report("locked", `{"id":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = report("locked", `{"id":2,"extra":true}`); err == nil || !strings.Contains(err.Error(), "auto ddl is disabled") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// 配置的修改在下一次读取后生效
+	if _, err = db.Exec(`UPDATE duckserver.report_configs SET auto_ddl = true WHERE business_id = 'locked'`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err = report("locked", `{"id":3,"extra":true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// type_overrides 中不认识的类型使读取失败，继续使用上一次的配置
+	if _, err = db.Exec(`UPDATE duckserver.report_configs SET type_overrides = MAP {'n': 'VARCHAR); DROP TABLE locked; --'} WHERE business_id = 'events'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.configs.load(); err == nil || !strings.Contains(err.Error(), "type_overrides of events: unknown type") {
+		t.Errorf("unexpected error %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if config := b.configs.Get("events"); config == nil || config.Types["n"] != "VARCHAR" {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if err = report("events", `{"uid":"u2","n":3}`); err != nil {
+		t.Fatal(err)
+	}
+}
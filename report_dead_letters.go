@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const deadLettersTableDDL = `CREATE SCHEMA IF NOT EXISTS duckserver;
+CREATE SEQUENCE IF NOT EXISTS duckserver.dead_letters_id;
+CREATE TABLE IF NOT EXISTS duckserver.dead_letters (
+	id BIGINT DEFAULT nextval('duckserver.dead_letters_id'),
+	business_id VARCHAR,
+	payload VARCHAR,
+	error VARCHAR,
+	received_at TIMESTAMPTZ,
+	attempts INTEGER DEFAULT 0,
+	last_attempt_at TIMESTAMPTZ
+);`
+
+// deadLetterReplayLimit 一次重放的默认条数
+const deadLetterReplayLimit = 1000
+
+// deadLetter 写入失败的 /report 事件，Payload 为事件的原始 JSON
+type deadLetter struct {
+	BusinessID string
+	Payload    string
+	Error      string
+	ReceivedAt time.Time
+}
+
+// deadLetters 保存写入失败的 /report 事件，表结构修复后通过 /report/replay 重新写入
+type deadLetters struct {
+	db *sql.DB
+}
+
+// deadLetterResult 重放一条死信的结果
+type deadLetterResult struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (d *deadLetters) Start() error {
+	if d == nil {
+		return nil
+	}
+	_, err := d.db.ExecContext(context.Background(), deadLettersTableDDL)
+	return err
+}
+
+// Record 写入死信，失败时只记录日志
+func (d *deadLetters) Record(letters ...deadLetter) {
+	if d == nil || len(letters) == 0 {
+		return
+	}
+	if err := d.insert(letters); err != nil {
+		logrus.Errorf("write %d dead letters error: %v", len(letters), err)
+	}
+}
+
+func (d *deadLetters) insert(letters []deadLetter) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO duckserver.dead_letters (business_id, payload, error, received_at) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, l := range letters {
+		if _, err = stmt.Exec(l.BusinessID, l.Payload, l.Error, l.ReceivedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Replay 按 id 顺序重新写入最多 limit 条死信，businessID 不为空时只重放这个表的死信。
+// 写入成功的死信被删除，失败的更新错误信息和重试次数，重放失败不会产生新的死信
+func (b *reportBuffers) Replay(ctx context.Context, businessID string, limit int) ([]deadLetterResult, error) {
+	if b == nil {
+		return nil, errReportBuffersDisabled
+	}
+	if b.deadLetters == nil {
+		return nil, errors.New("dead letters are not enabled")
+	}
+	if limit <= 0 {
+		limit = deadLetterReplayLimit
+	}
+	// 同时重放会重复写入。客户端断开时仍然完成重放并更新死信，否则已经写入的事件会被再次重放
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+	ctx = context.WithoutCancel(ctx)
+	rows, err := b.db.QueryContext(ctx, `SELECT id, business_id, payload, received_at FROM duckserver.dead_letters
+		WHERE ? = '' OR business_id = ? ORDER BY id LIMIT ?`, businessID, businessID, limit)
+	if err != nil {
+		return nil, err
+	}
+	type letter struct {
+		id         int64
+		businessID string
+		payload    string
+		received   sql.NullTime
+	}
+	var letters []letter
+	for rows.Next() {
+		var l letter
+		if err = rows.Scan(&l.id, &l.businessID, &l.payload, &l.received); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 按表分组，一个表的事件一起放入缓存
+	results := make([]deadLetterResult, len(letters))
+	groups := map[string][]int{}
+	var tables []string
+	for i, l := range letters {
+		results[i] = deadLetterResult{ID: l.id, Status: "ok"}
+		if _, ok := groups[l.businessID]; !ok {
+			tables = append(tables, l.businessID)
+		}
+		groups[l.businessID] = append(groups[l.businessID], i)
+	}
+	for _, table := range tables {
+		var events []*reportEvent
+		var indexes []int
+		for _, i := range groups[table] {
+			// Parse 同时校验 business_id
+			row, err := b.Parse(table, letters[i].payload)
+			if err != nil {
+				results[i].Status, results[i].Error = "error", err.Error()
+				continue
+			}
+			// 重放的事件只能补充原来的接收时间
+			row = b.Enrich(table, row, reportRequest{Received: letters[i].received.Time})
+			events = append(events, &reportEvent{row: row, raw: letters[i].payload, received: time.Now(), done: make(chan error, 1)})
+			indexes = append(indexes, i)
+		}
+		for j, err := range b.enqueue(ctx, table, events, true) {
+			if err != nil {
+				results[indexes[j]].Status, results[indexes[j]].Error = "error", err.Error()
+			}
+		}
+	}
+
+	for _, r := range results {
+		if r.Status == "ok" {
+			_, err = b.db.ExecContext(ctx, "DELETE FROM duckserver.dead_letters WHERE id = ?", r.ID)
+		} else {
+			_, err = b.db.ExecContext(ctx, `UPDATE duckserver.dead_letters SET error = ?, attempts = attempts + 1, last_attempt_at = now()
+				WHERE id = ?`, r.Error, r.ID)
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reportDedupWindow 默认的去重时间窗口
+const reportDedupWindow = 10 * time.Minute
+
+// reportDedupMaxKeys 默认最多保存的去重键数
+const reportDedupMaxKeys = 1 << 20
+
+// ReportDedupKeys 按表配置去重键：header:Name 为请求头，$.a.b 为事件中的 JSON 路径
+type ReportDedupKeys map[string]string
+
+// Set 用于 -report_dedup，格式为 table=header:Idempotency-Key 或 table=$.data.report_id
+func (k ReportDedupKeys) Set(s string) error {
+	table, key, ok := strings.Cut(s, "=")
+	table, key = strings.TrimSpace(table), strings.TrimSpace(key)
+	if !ok || table == "" {
+		return fmt.Errorf("invalid dedup key %q, expected table=header:Name or table=$.path", s)
+	}
+	switch {
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+	case strings.HasPrefix(key, "$.") && len(key) > len("$."):
+	default:
+		return fmt.Errorf("invalid dedup key %q, expected header:Name or $.path", key)
+	}
+	k[strings.ToLower(table)] = key
+	return nil
+}
+
+func (k ReportDedupKeys) get(table string) string {
+	return k[strings.ToLower(table)]
+}
+
+// reportDedupKey 取出事件的去重键，没有配置或者事件中没有这个键时返回空字符串。
+// 请求头对整个请求有效，批量时加上事件的序号
+func reportDedupKey(spec, body string, header func(string) string, line int, batch bool) string {
+	if name, ok := strings.CutPrefix(spec, "header:"); ok {
+		key := header(name)
+		if key != "" && batch {
+			key += "#" + strconv.Itoa(line)
+		}
+		return key
+	}
+	path, ok := strings.CutPrefix(spec, "$.")
+	if !ok {
+		return ""
+	}
+	var value any
+	if err := unmarshalJSONNumber(body, &value); err != nil {
+		return ""
+	}
+	// 和展开时一样，字符串形式的 JSON 对象也按路径查找，例如 GaliPaiDC 的 data.report_id
+	for _, name := range strings.Split(path, ".") {
+		data, ok := decodeReportJSONString(value).(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = data[name]
+	}
+	switch v := value.(type) {
+	case nil, map[string]any, []any:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// reportDedup 时间窗口内见过的去重键，保存在内存中，重启后清空。
+// 两代 map 每隔 window 轮换一次，一个键保留 window 到 2*window。
+// 当前一代超过 maxKeys 的一半时提前轮换，最多保存 maxKeys 个键，这时窗口会变短
+type reportDedup struct {
+	window   time.Duration
+	maxKeys  int
+	mu       sync.Mutex
+	current  map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+}
+
+func newReportDedup(window time.Duration, maxKeys int) *reportDedup {
+	if window <= 0 {
+		window = reportDedupWindow
+	}
+	if maxKeys <= 0 {
+		maxKeys = reportDedupMaxKeys
+	}
+	return &reportDedup{window: window, maxKeys: max(maxKeys, 2), current: map[string]struct{}{}, previous: map[string]struct{}{}, rotated: time.Now()}
+}
+
+// Seen 键在窗口内出现过时返回 true，否则记录这个键
+func (d *reportDedup) Seen(table, key string) bool {
+	key = strings.ToLower(table) + "\x00" + key
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now := time.Now(); now.Sub(d.rotated) >= d.window {
+		d.previous, d.current = d.current, map[string]struct{}{}
+		if now.Sub(d.rotated) >= 2*d.window {
+			d.previous = map[string]struct{}{}
+		}
+		d.rotated = now
+	}
+	if _, ok := d.current[key]; ok {
+		return true
+	}
+	if _, ok := d.previous[key]; ok {
+		return true
+	}
+	if len(d.current) >= d.maxKeys/2 {
+		logrus.Warnf("report dedup keys reach the limit %d within %s, dropping the oldest keys", d.maxKeys, time.Since(d.rotated).Round(time.Second))
+		d.previous, d.current = d.current, map[string]struct{}{}
+		d.rotated = time.Now()
+	}
+	d.current[key] = struct{}{}
+	return false
+}
+
+// Forget 事件写入失败时删除键，客户端重试时可以再次写入
+func (d *reportDedup) Forget(table, key string) {
+	key = strings.ToLower(table) + "\x00" + key
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.current, key)
+	delete(d.previous, key)
+}
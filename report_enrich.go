@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// report_configs.enrich 中可以开启的补充列，列名以 _ 开头，和事件中的同名字段冲突时以服务端为准
+const (
+	reportEnrichReceiveTime = "receive_time"
+	reportEnrichClientIP    = "client_ip"
+	reportEnrichUserAgent   = "user_agent"
+	reportEnrichClockSkew   = "clock_skew"
+	reportEnrichCountry     = "country"
+)
+
+// reportRequest 事件所在请求的信息，重放的死信只有接收时间
+type reportRequest struct {
+	Received  time.Time
+	ClientIP  string
+	UserAgent string
+}
+
+// reportGeo 按 IP 查询国家的 ISO 代码，查不到时返回空字符串
+type reportGeo interface {
+	Country(ip net.IP) string
+	Close() error
+}
+
+// maxmindGeo 读取本地的 MaxMind 格式文件，例如 GeoLite2-Country.mmdb
+type maxmindGeo struct {
+	reader *maxminddb.Reader
+}
+
+func openMaxmindGeo(path string) (*maxmindGeo, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database %s: %w", path, err)
+	}
+	return &maxmindGeo{reader: reader}, nil
+}
+
+func (g *maxmindGeo) Country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+func (g *maxmindGeo) Close() error {
+	return g.reader.Close()
+}
+
+// ParseTrustedProxies 解析逗号分隔的 IP 或 CIDR，用于 -report_trusted_proxies
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil && ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// reportClientIP 客户端的 IP。连接来自可信的代理时，从 X-Forwarded-For 的最后一项往前跳过可信的代理，
+// 第一个不可信的地址为客户端，避免客户端伪造 X-Forwarded-For
+func reportClientIP(remoteAddr, forwardedFor string, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if !isTrusted(host) || forwardedFor == "" {
+		return host
+	}
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !isTrusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+var reportUserAgentRules = []struct {
+	kind string
+	name string
+	re   *regexp.Regexp
+}{
+	{"browser", "Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"browser", "Opera", regexp.MustCompile(`OPR/([\d.]+)`)},
+	{"browser", "Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"browser", "Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"browser", "Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"browser", "okhttp", regexp.MustCompile(`okhttp/([\d.]+)`)},
+	{"browser", "Dalvik", regexp.MustCompile(`Dalvik/([\d.]+)`)},
+	{"browser", "CFNetwork", regexp.MustCompile(`CFNetwork/([\d.]+)`)},
+	{"os", "Android", regexp.MustCompile(`Android ([\d.]+)`)},
+	{"os", "iPadOS", regexp.MustCompile(`iPad.*OS ([\d_]+)`)},
+	{"os", "iOS", regexp.MustCompile(`(?:iPhone|CPU) OS ([\d_]+)`)},
+	{"os", "Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"os", "macOS", regexp.MustCompile(`Mac OS X ([\d_.]+)`)},
+	{"os", "Linux", regexp.MustCompile(`Linux()`)},
+}
+
+var reportBotRegexp = regexp.MustCompile(`(?i)bot|crawler|spider|curl/|wget/`)
+
+// reportUserAgent 从 User-Agent 解析浏览器（或者 SDK 的 HTTP 库）、系统和设备类型，版本只保留主版本号
+func reportUserAgent(ua string) (browser, os, device string) {
+	for _, rule := range reportUserAgentRules {
+		if (rule.kind == "browser" && browser != "") || (rule.kind == "os" && os != "") {
+			continue
+		}
+		m := rule.re.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		name := rule.name
+		if version, _, _ := strings.Cut(strings.ReplaceAll(m[1], "_", "."), "."); version != "" {
+			name += " " + version
+		}
+		if rule.kind == "browser" {
+			browser = name
+		} else {
+			os = name
+		}
+	}
+	// 移动端 SDK 的 HTTP 库
+	sdk := strings.HasPrefix(browser, "okhttp") || strings.HasPrefix(browser, "Dalvik") || strings.HasPrefix(browser, "CFNetwork")
+	switch {
+	case ua == "":
+	case reportBotRegexp.MatchString(ua):
+		device = "bot"
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") || strings.HasPrefix(os, "Android") && !strings.Contains(ua, "Mobile") && !sdk:
+		device = "tablet"
+	case sdk || strings.Contains(ua, "Mobile") || strings.HasPrefix(os, "Android") || strings.HasPrefix(os, "iOS"):
+		device = "mobile"
+	default:
+		device = "desktop"
+	}
+	return browser, os, device
+}
+
+// reportClientTime 客户端的时间字段：13 位毫秒、10 位秒的时间戳或者 ISO-8601 字符串
+func reportClientTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		switch {
+		case err != nil:
+		case n >= 1e12 && n < 1e13:
+			return time.UnixMilli(n), true
+		case n >= 1e9 && n < 1e10:
+			return time.Unix(n, 0), true
+		}
+	case string:
+		return parseReportTime(v)
+	}
+	return time.Time{}, false
+}
+
+// reportSetColumn 写入服务端的列，删除事件中只有大小写不同的同名字段
+func reportSetColumn(row map[string]any, name string, value any) {
+	for key := range row {
+		if key != name && strings.EqualFold(key, name) {
+			delete(row, key)
+		}
+	}
+	row[name] = value
+}
+
+// Enrich 按 report_configs.enrich 补充服务端的列，没有配置时原样返回
+func (b *reportBuffers) Enrich(table string, row map[string]any, req reportRequest) map[string]any {
+	if b == nil {
+		return row
+	}
+	config := b.configs.Get(table)
+	if config == nil || len(config.Enrich) == 0 {
+		return row
+	}
+	if req.Received.IsZero() {
+		req.Received = time.Now()
+	}
+	for _, item := range config.Enrich {
+		switch item {
+		case reportEnrichReceiveTime:
+			reportSetColumn(row, "_received_at", req.Received)
+		case reportEnrichClientIP:
+			if req.ClientIP != "" {
+				reportSetColumn(row, "_client_ip", req.ClientIP)
+			}
+		case reportEnrichUserAgent:
+			if req.UserAgent != "" {
+				browser, os, device := reportUserAgent(req.UserAgent)
+				reportSetColumn(row, "_user_agent", req.UserAgent)
+				for column, value := range map[string]string{"_ua_browser": browser, "_ua_os": os, "_ua_device": device} {
+					if value != "" {
+						reportSetColumn(row, column, value)
+					}
+				}
+			}
+		case reportEnrichClockSkew:
+			// 时间列由 report_configs 用接收时间补齐时不计算
+			column := config.TimeColumn
+			if column == "" {
+				column = "time"
+			}
+			for key, value := range row {
+				if strings.EqualFold(key, column) {
+					if t, ok := reportClientTime(value); ok {
+						reportSetColumn(row, "_clock_skew_ms", json.Number(strconv.FormatInt(req.Received.Sub(t).Milliseconds(), 10)))
+					}
+					break
+				}
+			}
+		case reportEnrichCountry:
+			if ip := net.ParseIP(req.ClientIP); ip != nil && b.geo != nil {
+				if country := b.geo.Country(ip); country != "" {
+					reportSetColumn(row, "_country", country)
+				}
+			}
+		}
+	}
+	return row
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+type fakeGeo map[string]string
+
+func (g fakeGeo) Country(ip net.IP) string { return g[ip.String()] }
+func (g fakeGeo) Close() error             { return nil }
+
+func TestReportClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote, forwarded, ip string
+	}{
+		{"1.2.3.4:5000", "", "1.2.3.4"},
+		// 不可信的连接伪造 X-Forwarded-For
+		{"1.2.3.4:5000", "9.9.9.9", "1.2.3.4"},
+		{"10.0.0.1:5000", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.0.0.1:5000", "10.0.0.2", "10.0.0.2"},
+		{"192.168.1.1:80", "unknown, 10.1.1.1", "10.1.1.1"},
+	} {
+		if ip := reportClientIP(c.remote, c.forwarded, trusted); ip != c.ip {
+			t.Errorf("%s %q: got %s", c.remote, c.forwarded, ip)
+		}
+	}
+	if _, err = ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected invalid proxy error")
+	}
+}
+
+func TestReportUserAgent(t *testing.T) {
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (Linux; Android 13; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Mobile Safari/537.36":                  "Chrome 116|Android 13|mobile",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1": "Safari 17|iOS 17|mobile",
+		"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1":          "Safari 16|iPadOS 16|tablet",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0":           "Edge 120|Windows 10|desktop",
+		"Dalvik/2.1.0 (Linux; U; Android 11; Redmi Note 8 Build/RKQ1.201004.002)":                                                                 "Dalvik 2|Android 11|mobile",
+		"okhttp/4.9.0": "okhttp 4||mobile",
+		"curl/8.1.2":   "||bot",
+	} {
+		browser, os, device := reportUserAgent(ua)
+		if got := browser + "|" + os + "|" + device; got != want {
+			t.Errorf("%s: got %s", ua, got)
+		}
+	}
+}
+
+func TestReportEnrich(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	trusted, _ := ParseTrustedProxies("192.0.2.0/24")
+	reports := newReportBuffers(db, ReportOptions{FlushInterval: 10 * time.Millisecond, ConfigReload: time.Millisecond, TrustedProxies: trusted}, nil)
+	if err = reports.Start(); err != nil {
+		t.Fatal(err)
+	}
+	reports.geo = fakeGeo{"203.0.113.7": "DE"}
+	defer reports.Close()
+	if _, err = db.Exec(`INSERT INTO duckserver.report_configs (business_id, enrich) VALUES
+		('events', ['receive_time', 'client_ip', 'user_agent', 'clock_skew', 'country'])`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	c := &ChServer{conn: db, pgServer: &PgServer{}, reports: reports}
+
+	clientTime := time.Now().Add(-time.Minute).UnixMilli()
+	body := `{"id":"90122","time":` + strconv.FormatInt(clientTime, 10) + `,"_Client_IP":"spoofed"}`
+	req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.10:4000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("User-Agent", "okhttp/4.9.0")
+	req.Header.Set("token", AuthToken)
+	req.Header.Set("business_id", "events")
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	var ip, browser, device, country string
+	var skew int64
+	var received time.Time
+	if err = db.QueryRow(`SELECT _client_ip, _ua_browser, _ua_device, _country, _clock_skew_ms, _received_at FROM events`).
+		Scan(&ip, &browser, &device, &country, &skew, &received); err != nil {
+		t.Fatal(err)
+	}
+	if ip != "203.0.113.7" || browser != "okhttp 4" || device != "mobile" || country != "DE" {
+		t.Errorf("unexpected enrichment %s %s %s %s", ip, browser, device, country)
+	}
+	if skew < 59000 || skew > 70000 || time.Since(received) > time.Minute {
+		t.Errorf("unexpected skew %d received %v", skew, received)
+	}
+}
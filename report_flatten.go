@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type GaliPaiDC struct {
+	ID        string `json:"id"`     //用户id，或者设备id
+	Locale    string `json:"locale"` //国家
+	Type      string `json:"type"`   //打点类型
+	TimeStamp int64  `json:"time"`   //打点时间戳-13位-ms级别
+	Data      string `json:"data"`   //业务打点数据，大json
+	//Business  string `json:"business"` //header中获取
+}
+
+// reportFlattener 把 /report 的 JSON 事件映射为一行。
+// 嵌套对象按 nested 展开为 prefix_key 列、STRUCT 或 JSON 文本，数组为 LIST，
+// 超过 maxDepth 层的对象保存为 JSON 文本，maxDepth、maxColumns 为 0 时不限制。
+// 列名和 STRUCT 的字段名经过 key 转换，key 为 nil 时保持原样，忽略大小写后重复的名字返回错误
+type reportFlattener struct {
+	nested     string
+	maxDepth   int
+	maxColumns int
+	key        func(string) (string, error)
+	row        map[string]any
+	columns    map[string]string
+	err        error
+}
+
+func flattenReport(data map[string]any, nested string, maxDepth, maxColumns int, key func(string) (string, error)) (map[string]any, error) {
+	f := &reportFlattener{nested: nested, maxDepth: maxDepth, maxColumns: maxColumns, key: key,
+		row: map[string]any{}, columns: map[string]string{}}
+	f.walk("", data, 1)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if maxColumns > 0 && len(f.row) > maxColumns {
+		return nil, fmt.Errorf("report has %d columns, more than the limit %d", len(f.row), maxColumns)
+	}
+	return f.row, nil
+}
+
+// name 转换键，names 记录已使用的名字，出错时只保留第一个错误
+func (f *reportFlattener) name(key string, names map[string]string) (string, bool) {
+	if f.err != nil {
+		return "", false
+	}
+	name := key
+	if f.key != nil {
+		if name, f.err = f.key(key); f.err != nil {
+			return "", false
+		}
+	}
+	lower := strings.ToLower(name)
+	if other, ok := names[lower]; ok {
+		f.err = fmt.Errorf("keys %q and %q map to the same column %q", other, key, name)
+		return "", false
+	}
+	names[lower] = key
+	return name, true
+}
+
+// set 写入一列
+func (f *reportFlattener) set(key string, value any) {
+	if name, ok := f.name(key, f.columns); ok {
+		f.row[name] = value
+	}
+}
+
+// expand 键在第 depth 层的对象是否继续展开
+func (f *reportFlattener) expand(depth int) bool {
+	return f.maxDepth <= 0 || depth < f.maxDepth
+}
+
+func (f *reportFlattener) walk(prefix string, data map[string]any, depth int) {
+	for key, value := range data {
+		fullKey := key
+		if prefix != "" {
+			fullKey = prefix + "_" + key
+		}
+		switch v := decodeReportJSONString(value).(type) {
+		case nil:
+		case map[string]any:
+			switch {
+			case f.nested == reportNestedJSON || !f.expand(depth):
+				f.set(fullKey, reportJSONText(v))
+			case f.nested == reportNestedStruct:
+				f.set(fullKey, f.structValue(v, depth+1))
+			default:
+				f.walk(fullKey, v, depth+1)
+			}
+		case []any:
+			f.set(fullKey, f.listValue(v, depth))
+		default:
+			f.set(fullKey, v)
+		}
+	}
+}
+
+func (f *reportFlattener) structValue(data map[string]any, depth int) map[string]any {
+	out := make(map[string]any, len(data))
+	names := map[string]string{}
+	for key, value := range data {
+		value = decodeReportJSONString(value)
+		if value == nil {
+			continue
+		}
+		key, ok := f.name(key, names)
+		if !ok {
+			return out
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			if f.expand(depth) {
+				out[key] = f.structValue(v, depth+1)
+			} else {
+				out[key] = reportJSONText(v)
+			}
+		case []any:
+			out[key] = f.listValue(v, depth)
+		default:
+			out[key] = v
+		}
+	}
+	return out
+}
+
+// listValue 数组为 LIST，只有 struct 方式下对象数组为 STRUCT 的 LIST，否则整个数组保存为 JSON 文本
+func (f *reportFlattener) listValue(data []any, depth int) any {
+	out := make([]any, len(data))
+	for i, value := range data {
+		switch v := value.(type) {
+		case map[string]any:
+			if f.nested != reportNestedStruct || !f.expand(depth) {
+				return reportJSONText(data)
+			}
+			out[i] = f.structValue(v, depth+1)
+		case []any:
+			list, ok := f.listValue(v, depth).([]any)
+			if !ok {
+				return reportJSONText(data)
+			}
+			out[i] = list
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+// decodeReportJSONString 字符串形式的 JSON 对象解析一次，其他字符串不尝试解析
+func decodeReportJSONString(value any) any {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	trimmed := strings.TrimSpace(s)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' {
+		return value
+	}
+	var data map[string]any
+	if err := unmarshalJSONNumber(trimmed, &data); err != nil {
+		return value
+	}
+	return data
+}
+
+func reportJSONText(value any) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Sprint(value)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// unmarshalJSONNumber 数字解析为 json.Number，区分整数和小数
+func unmarshalJSONNumber(str string, v any) error {
+	decoder := json.NewDecoder(strings.NewReader(str))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestFlattenReport(t *testing.T) {
+	body := `{"id":1,"ok":true,"tags":["a","b"],"items":[{"n":1}],"data":"{\"ab\":{\"x\":{\"y\":1}},\"v\":null}"}`
+	for _, c := range []struct {
+		nested   string
+		maxDepth int
+		want     map[string]string
+	}{
+		{reportNestedFlatten, 0, map[string]string{"id": "BIGINT", "ok": "BOOLEAN", "tags": "VARCHAR[]", "items": `VARCHAR`, "data_ab_x_y": "BIGINT"}},
+		{reportNestedFlatten, 2, map[string]string{"id": "BIGINT", "ok": "BOOLEAN", "tags": "VARCHAR[]", "items": `VARCHAR`, "data_ab": "VARCHAR"}},
+		{reportNestedStruct, 0, map[string]string{"id": "BIGINT", "ok": "BOOLEAN", "tags": "VARCHAR[]", "items": `STRUCT("n" BIGINT)[]`, "data": `STRUCT("ab" STRUCT("x" STRUCT("y" BIGINT)))`}},
+		{reportNestedStruct, 2, map[string]string{"id": "BIGINT", "ok": "BOOLEAN", "tags": "VARCHAR[]", "items": `STRUCT("n" BIGINT)[]`, "data": `STRUCT("ab" VARCHAR)`}},
+		{reportNestedJSON, 0, map[string]string{"id": "BIGINT", "ok": "BOOLEAN", "tags": "VARCHAR[]", "items": `VARCHAR`, "data": "VARCHAR"}},
+	} {
+		var data map[string]any
+		if err := unmarshalJSONNumber(body, &data); err != nil {
+			t.Fatal(err)
+		}
+		row, err := flattenReport(data, c.nested, c.maxDepth, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(row) != len(c.want) {
+			t.Errorf("%s %d: unexpected row %v", c.nested, c.maxDepth, row)
+		}
+		for name, typ := range c.want {
+			if got := reportValueType(name, row[name]).String(); got != typ {
+				t.Errorf("%s %d: %s is %s, want %s", c.nested, c.maxDepth, name, got, typ)
+			}
+		}
+	}
+
+	var data map[string]any
+	_ = unmarshalJSONNumber(`{"a":{"b":1,"c":2}}`, &data)
+	if _, err := flattenReport(data, reportNestedFlatten, 0, 1, nil); err == nil {
+		t.Error("expected column limit error")
+	}
+}
+
+func TestReportNestedColumns(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	policies := ReportTypePolicies{}
+	if err = policies.SetNested("events=struct"); err != nil {
+		t.Fatal(err)
+	}
+	b := newReportBuffers(db, ReportOptions{BufferMaxRows: 1, TypePolicies: policies, MaxColumns: 4}, nil)
+	defer b.Close()
+	report := func(body string) error {
+		row, err := b.Parse("events", body)
+		if err != nil {
+			return err
+		}
+		return b.Add(context.Background(), "events", row, body, true)
+	}
+	for _, body := range []string{
+		`{"user":{"id":1},"scores":[1,2]}`,
+		`{"user":{"id":2,"name":"b","geo":{"c":"es"}},"scores":[1.5],"items":[{"sku":"x"}]}`,
+		`{"user":{"id":3},"items":[{"sku":"y","qty":2}]}`,
+	} {
+		if err = report(body); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+	}
+	if err = report(`{"a":1,"b":2}`); err == nil {
+		t.Error("expected column limit error")
+	}
+	var columns, values string
+	if err = db.QueryRow("SELECT string_agg(column_name || ' ' || data_type, ',' ORDER BY column_index) FROM duckdb_columns() WHERE table_name = 'events'").Scan(&columns); err != nil {
+		t.Fatal(err)
+	}
+	if columns != `scores DOUBLE[],user STRUCT(id BIGINT, geo STRUCT(c VARCHAR), "name" VARCHAR),items STRUCT(sku VARCHAR, qty BIGINT)[]` {
+		t.Errorf("unexpected columns %s", columns)
+	}
+	if err = db.QueryRow(`SELECT string_agg(concat_ws('|', scores, "user", items), ',' ORDER BY rowid) FROM events`).Scan(&values); err != nil {
+		t.Fatal(err)
+	}
+	if values != `[1.0, 2.0]|{'id': 1, 'geo': NULL, 'name': NULL},[1.5]|{'id': 2, 'geo': {'c': es}, 'name': b}|[{'sku': x, 'qty': NULL}],{'id': 3, 'geo': NULL, 'name': NULL}|[{'sku': y, 'qty': 2}]` {
+		t.Errorf("unexpected values %s", values)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reportBusinessIDPattern 默认的 business_id 格式，business_id 作为表名
+const reportBusinessIDPattern = `^[A-Za-z_][A-Za-z0-9_]{0,62}$`
+
+// 事件中不合法的键的处理方式：sanitize 替换为合法的列名，reject 拒绝事件
+const (
+	reportKeySanitize = "sanitize"
+	reportKeyReject   = "reject"
+)
+
+var reportKeyRegexp = regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}_]*$`)
+var reportKeyInvalidRegexp = regexp.MustCompile(`[^\p{L}\p{N}_]`)
+
+// reportIdentifiers /report 的表名和列名策略。表名和列名在 SQL 中总是用 quoteIdentifier 加双引号，
+// 这里再限制格式并排除 duckdb 的保留字，避免生成难以查询的表和列
+type reportIdentifiers struct {
+	db         *sql.DB
+	businessID *regexp.Regexp
+	keyMode    string
+	once       sync.Once
+	reserved   map[string]bool
+}
+
+func newReportIdentifiers(db *sql.DB, businessID *regexp.Regexp, keyMode string) *reportIdentifiers {
+	if businessID == nil {
+		businessID = regexp.MustCompile(reportBusinessIDPattern)
+	}
+	if keyMode == "" {
+		keyMode = reportKeySanitize
+	}
+	return &reportIdentifiers{db: db, businessID: businessID, keyMode: keyMode}
+}
+
+// isReserved 保留字从 duckdb_keywords() 读取，读取失败时不检查
+func (p *reportIdentifiers) isReserved(name string) bool {
+	p.once.Do(func() {
+		p.reserved = map[string]bool{}
+		if p.db == nil {
+			return
+		}
+		rows, err := p.db.Query("SELECT keyword_name FROM duckdb_keywords() WHERE keyword_category = 'reserved'")
+		if err != nil {
+			logrus.Warnf("read duckdb reserved keywords error: %v", err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var keyword string
+			if rows.Scan(&keyword) == nil {
+				p.reserved[strings.ToLower(keyword)] = true
+			}
+		}
+	})
+	return p.reserved[strings.ToLower(name)]
+}
+
+// Table 校验 business_id
+func (p *reportIdentifiers) Table(businessID string) error {
+	if businessID == "" {
+		return fmt.Errorf("businessID is empty on http header")
+	}
+	if !p.businessID.MatchString(businessID) {
+		return fmt.Errorf("businessID %q does not match %s", businessID, p.businessID)
+	}
+	if p.isReserved(businessID) {
+		return fmt.Errorf("businessID %q is a reserved word", businessID)
+	}
+	return nil
+}
+
+// Key 事件的键转换为列名或者 STRUCT 的字段名。sanitize 时不合法的字符替换为 _，
+// 数字开头时加 _ 前缀，保留字加 _ 后缀
+func (p *reportIdentifiers) Key(key string) (string, error) {
+	if reportKeyRegexp.MatchString(key) && !p.isReserved(key) {
+		return key, nil
+	}
+	if p.keyMode == reportKeyReject {
+		if key != "" && reportKeyRegexp.MatchString(key) {
+			return "", fmt.Errorf("key %q is a reserved word", key)
+		}
+		return "", fmt.Errorf("key %q is not a valid column name", key)
+	}
+	name := reportKeyInvalidRegexp.ReplaceAllString(key, "_")
+	if name == "" || !reportKeyRegexp.MatchString(name) {
+		name = "_" + name
+	}
+	if p.isReserved(name) {
+		name += "_"
+	}
+	return name, nil
+}
+
+// ParseReportKeyMode 用于 -report_key_mode
+func ParseReportKeyMode(mode string) (string, error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case reportKeySanitize, reportKeyReject:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown key mode %q, expected sanitize or reject", mode)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestReportIdentifiers(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	idents := newReportIdentifiers(db, nil, reportKeySanitize)
+	for table, ok := range map[string]bool{"events": true, "_e2": true, "": false, "select": false, "a-b": false, "1a": false, `x"; DROP TABLE y; --`: false} {
+		if err := idents.Table(table); (err == nil) != ok {
+			t.Errorf("table %q: %v", table, err)
+		}
+	}
+	for key, want := range map[string]string{"a": "a", "国家": "国家", "a b": "a_b", "1st": "_1st", "": "_", "select": "select_", `x"y`: "x_y"} {
+		if got, err := idents.Key(key); err != nil || got != want {
+			t.Errorf("key %q: got %q %v", key, got, err)
+		}
+	}
+	reject := newReportIdentifiers(db, nil, reportKeyReject)
+	for _, key := range []string{"a b", "select", ""} {
+		if _, err := reject.Key(key); err == nil {
+			t.Errorf("key %q should be rejected", key)
+		}
+	}
+	if _, err := flattenReport(map[string]any{"a b": 1, "a_b": 2}, reportNestedFlatten, 0, 0, idents.Key); err == nil {
+		t.Error("expected duplicate column error")
+	}
+	if _, err := flattenReport(map[string]any{"s": map[string]any{"A": 1, "a": 2}}, reportNestedStruct, 0, 0, idents.Key); err == nil {
+		t.Error("expected duplicate field error")
+	}
+
+	b := newReportBuffers(db, ReportOptions{FlushInterval: 10 * time.Millisecond}, nil)
+	defer b.Close()
+	body := `{"order":1,"user id":"x'); DROP TABLE t; --","s":{"from":"a"}}`
+	row, err := b.Parse("events", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Add(context.Background(), "events", row, body, true); err != nil {
+		t.Fatal(err)
+	}
+	var order int
+	var user, from string
+	if err = db.QueryRow(`SELECT order_, user_id, s_from FROM events`).Scan(&order, &user, &from); err != nil {
+		t.Fatal(err)
+	}
+	if order != 1 || user != "x'); DROP TABLE t; --" || from != "a" {
+		t.Errorf("unexpected row %d %s %s", order, user, from)
+	}
+
+	// 保留字作为配置的 schema、表和列名时，建表、加列和写入都要加引号，值作为参数绑定
+	configured := newReportBuffers(db, ReportOptions{FlushInterval: 10 * time.Millisecond, ConfigReload: time.Millisecond}, nil)
+	if err = configured.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer configured.Close()
+	if _, err = db.Exec(`INSERT INTO duckserver.report_configs (business_id, target_schema, target_table, column_renames)
+		VALUES ('orders', 'group', 'order', MAP {'uid': 'from'})`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for _, body := range []string{`{"uid":"it's","n":2}`, `{"uid":"x\"; DROP TABLE events; --","where":"w"}`} {
+		row, err := configured.Parse("orders", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = configured.Add(context.Background(), "orders", row, body, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var users, wheres string
+	if err = db.QueryRow(`SELECT string_agg("from", '|' ORDER BY n NULLS LAST), string_agg(where_, '|') FROM "group"."order"`).
+		Scan(&users, &wheres); err != nil {
+		t.Fatal(err)
+	}
+	if users != `it's|x"; DROP TABLE events; --` || wheres != "w" {
+		t.Errorf("unexpected rows %s %s", users, wheres)
+	}
+	if err = db.QueryRow(`SELECT count(*) FROM events`).Scan(&order); err != nil || order != 1 {
+		t.Errorf("unexpected events %d %v", order, err)
+	}
+}
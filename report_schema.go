@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reportSchemaIdle 超过这个时间没有使用的表结构从缓存中删除
+const reportSchemaIdle = 10 * time.Minute
+
+// reportTableSchema 缓存的表结构，mu 保证同一个表的 DDL 依次执行
+type reportTableSchema struct {
+	mu       sync.Mutex
+	lastUsed time.Time
+	loaded   bool
+	exists   bool
+	// columns 小写列名到列类型，duckdb 的列名不区分大小写
+	columns map[string]string
+}
+
+// reportSchemas /report 的表结构管理：从 information_schema.columns 读取表结构，
+// 和事件的列比较后在一个事务里执行所有建表、加列和放宽列类型的语句，不依赖 duckdb 的错误信息
+type reportSchemas struct {
+	db         *sql.DB
+	metrics    *serverMetrics
+	maxColumns int
+	mu         sync.Mutex
+	tables     map[string]*reportTableSchema
+	swept      time.Time
+}
+
+func newReportSchemas(db *sql.DB, metrics *serverMetrics, options ReportOptions) *reportSchemas {
+	return &reportSchemas{db: db, metrics: metrics, maxColumns: options.MaxColumns, tables: map[string]*reportTableSchema{}}
+}
+
+func (s *reportSchemas) table(target reportTarget) *reportTableSchema {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.swept) >= reportSchemaIdle {
+		s.evict(now.Add(-reportSchemaIdle))
+		s.swept = now
+	}
+	key := strings.ToLower(target.String())
+	schema, ok := s.tables[key]
+	if !ok {
+		schema = &reportTableSchema{}
+		s.tables[key] = schema
+	}
+	schema.lastUsed = now
+	return schema
+}
+
+// evict 删除 before 之后没有使用的表结构，正在执行 DDL 的表保留，调用时持有 s.mu
+func (s *reportSchemas) evict(before time.Time) {
+	for key, schema := range s.tables {
+		if schema.lastUsed.Before(before) && schema.mu.TryLock() {
+			delete(s.tables, key)
+			schema.mu.Unlock()
+		}
+	}
+}
+
+// Invalidate 表被外部修改时（例如 DROP TABLE）丢弃缓存，下次重新读取
+func (s *reportSchemas) Invalidate(target reportTarget) {
+	schema := s.table(target)
+	schema.mu.Lock()
+	schema.loaded = false
+	schema.mu.Unlock()
+}
+
+// Ensure 保证表存在并且包含所有的列，names 和 types 一一对应。
+// 返回每一列在表中的类型，以及是否执行了 DDL。使用缓存的表结构执行 DDL 失败时，重新读取表结构再试一次
+func (s *reportSchemas) Ensure(ctx context.Context, target reportTarget, policy *ReportTypePolicy, names, types []string) ([]string, bool, error) {
+	schema := s.table(target)
+	schema.mu.Lock()
+	defer schema.mu.Unlock()
+	cached := schema.loaded
+	changed, err := schema.apply(ctx, s, target, policy, names, types)
+	if err != nil && cached {
+		schema.loaded = false
+		changed, err = schema.apply(ctx, s, target, policy, names, types)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	tableTypes := make([]string, len(names))
+	for i, name := range names {
+		tableTypes[i] = normalizeReportType(schema.columns[strings.ToLower(name)])
+	}
+	return tableTypes, changed, nil
+}
+
+// apply 比较表结构，在一个事务里执行所有 DDL，调用时持有 t.mu
+func (t *reportTableSchema) apply(ctx context.Context, s *reportSchemas, target reportTarget, policy *ReportTypePolicy, names, types []string) (bool, error) {
+	if !t.loaded {
+		if err := t.load(ctx, s.db, target); err != nil {
+			return false, fmt.Errorf("reading schema of %s: %w", target, err)
+		}
+	}
+	statements, columns, operations := t.diff(target, names, types, policy)
+	if len(statements) == 0 {
+		return false, nil
+	}
+	if policy.NoDDL {
+		return false, fmt.Errorf("auto ddl is disabled for table %s, required: %s", target, strings.Join(statements, "; "))
+	}
+	if s.maxColumns > 0 {
+		count := len(t.columns)
+		for name := range columns {
+			if _, ok := t.columns[name]; !ok {
+				count++
+			}
+		}
+		if count > s.maxColumns {
+			return false, fmt.Errorf("table %s would have %d columns, more than the limit %d", target, count, s.maxColumns)
+		}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	for _, stmt := range statements {
+		logrus.Infof("report auto ddl: %s", stmt)
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			_ = tx.Rollback()
+			t.loaded = false
+			return false, fmt.Errorf("exec ddl %q failed: %w", stmt, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.loaded = false
+		return false, err
+	}
+	t.exists = true
+	for name, typ := range columns {
+		t.columns[name] = typ
+	}
+	for _, operation := range operations {
+		s.metrics.ReportDDL(operation)
+	}
+	return true, nil
+}
+
+func (t *reportTableSchema) load(ctx context.Context, db *sql.DB, target reportTarget) error {
+	rows, err := db.QueryContext(ctx, `SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_catalog = current_database() AND lower(table_schema) = lower(coalesce(nullif(?, ''), current_schema()))
+		AND lower(table_name) = lower(?)`, target.Schema, target.Table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns := map[string]string{}
+	for rows.Next() {
+		var name, typ string
+		if err = rows.Scan(&name, &typ); err != nil {
+			return err
+		}
+		columns[strings.ToLower(name)] = typ
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	t.columns, t.exists, t.loaded = columns, len(columns) > 0, true
+	return nil
+}
+
+// diff 返回需要执行的 DDL、新增或修改类型的列以及指标的 operation。
+// 固定类型的列使用策略中的类型并且不放宽，NoWiden 的表只加列
+func (t *reportTableSchema) diff(target reportTarget, names, types []string, policy *ReportTypePolicy) ([]string, map[string]string, []string) {
+	columns := map[string]string{}
+	var defs, alters []string
+	for i, name := range names {
+		key := strings.ToLower(name)
+		if _, ok := columns[key]; ok {
+			continue
+		}
+		pinned, isPinned := policy.Pinned[key]
+		current, ok := t.columns[key]
+		switch {
+		case !ok:
+			typ := types[i]
+			if isPinned {
+				typ = pinned
+			}
+			columns[key] = typ
+			defs = append(defs, quoteIdentifier(name)+" "+typ)
+		case !isPinned && !policy.NoWiden:
+			if typ := widenReportType(current, types[i]); typ != normalizeReportType(current) {
+				columns[key] = typ
+				alters = append(alters, reportAlterColumnSql(target, name, current, typ))
+			}
+		}
+	}
+	if !t.exists {
+		if len(defs) == 0 {
+			return nil, nil, nil
+		}
+		statements := []string{fmt.Sprintf("CREATE TABLE %s (%s)", target.quoted(), strings.Join(defs, ", "))}
+		if target.Schema != "" {
+			statements = append([]string{"CREATE SCHEMA IF NOT EXISTS " + quoteIdentifier(target.Schema)}, statements...)
+		}
+		return statements, columns, []string{"create_table"}
+	}
+	var statements, operations []string
+	for _, def := range defs {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", target.quoted(), def))
+		operations = append(operations, "add_column")
+	}
+	for _, alter := range alters {
+		statements = append(statements, alter)
+		operations = append(operations, "alter_column_type")
+	}
+	return statements, columns, operations
+}
+
+// reportAlterColumnSql 放宽列类型。字段不同的 STRUCT 不能直接转换，通过 USING 按字段重新组装
+func reportAlterColumnSql(target reportTarget, column, from, to string) string {
+	stmt := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", target.quoted(), quoteIdentifier(column), to)
+	fromType, toType := parseReportType(from), parseReportType(to)
+	if fromType.hasStruct() && toType.hasStruct() {
+		stmt += " USING " + reportConvertExpr(quoteIdentifier(column), fromType, toType, 0)
+	}
+	return stmt
+}
+
+func reportConvertExpr(expr string, from, to *reportType, depth int) string {
+	switch {
+	case from.String() == to.String():
+		return expr
+	case from.Name == "STRUCT" && to.Name == "STRUCT":
+		fields := make([]string, len(to.Fields))
+		for i, f := range to.Fields {
+			value := "NULL::" + f.Type.String()
+			if old := from.field(f.Name); old != nil {
+				value = reportConvertExpr(fmt.Sprintf("struct_extract(%s, %s)", expr, quoteSqlString(old.Name)), old.Type, f.Type, depth)
+			}
+			fields[i] = quoteIdentifier(f.Name) + " := " + value
+		}
+		return "struct_pack(" + strings.Join(fields, ", ") + ")"
+	case from.Name == "LIST" && to.Name == "LIST":
+		x := fmt.Sprintf("x%d", depth+1)
+		return fmt.Sprintf("list_transform(%s, %s -> %s)", expr, x, reportConvertExpr(x, from.Elem, to.Elem, depth+1))
+	}
+	return fmt.Sprintf("CAST(%s AS %s)", expr, to.String())
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
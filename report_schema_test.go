@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestReportSchemas(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	s := newReportSchemas(db, nil, ReportOptions{})
+	events := reportTarget{Table: "events"}
+
+	columns := func() string {
+		var names string
+		if err := db.QueryRow("SELECT string_agg(column_name || ' ' || data_type, ',' ORDER BY column_index) FROM duckdb_columns() WHERE table_name = 'events'").Scan(&names); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	for _, step := range []struct {
+		names, types []string
+		changed      bool
+		columns      string
+	}{
+		{[]string{"id", "n"}, []string{"VARCHAR", "DOUBLE"}, true, "id VARCHAR,n DOUBLE"},
+		{[]string{"ID", "n"}, []string{"VARCHAR", "DOUBLE"}, false, "id VARCHAR,n DOUBLE"},
+		// 一次比较加入所有缺少的列
+		{[]string{"a b", "id", "ok"}, []string{"VARCHAR", "VARCHAR", "BOOLEAN"}, true, "id VARCHAR,n DOUBLE,a b VARCHAR,ok BOOLEAN"},
+	} {
+		_, changed, err := s.Ensure(ctx, events, &ReportTypePolicy{}, step.names, step.types)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != step.changed || columns() != step.columns {
+			t.Errorf("ensure %v: changed %v columns %s", step.names, changed, columns())
+		}
+	}
+
+	// 表被删除后缓存过期，重新读取后建表
+	if _, err = db.Exec("DROP TABLE events"); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, _ := s.Ensure(ctx, events, &ReportTypePolicy{}, []string{"id"}, []string{"VARCHAR"}); changed {
+		t.Error("expected cached schema before invalidate")
+	}
+	s.Invalidate(events)
+	if _, changed, err := s.Ensure(ctx, events, &ReportTypePolicy{}, []string{"id"}, []string{"VARCHAR"}); err != nil || !changed || columns() != "id VARCHAR" {
+		t.Errorf("recreate: %v %v %s", changed, err, columns())
+	}
+	// 缓存的表结构执行 DDL 失败时重新读取
+	if _, err = db.Exec("DROP TABLE events"); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, err := s.Ensure(ctx, events, &ReportTypePolicy{}, []string{"id", "x"}, []string{"VARCHAR", "BIGINT"}); err != nil || !changed || columns() != "id VARCHAR,x BIGINT" {
+		t.Errorf("recreate: %v %v %s", changed, err, columns())
+	}
+}
+
+func TestReportTypeWidening(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	policies := ReportTypePolicies{}
+	if err = policies.Pin("pinned.amount=DECIMAL(18,2)"); err != nil {
+		t.Fatal(err)
+	}
+	if err = policies.ForbidWidening("fixed"); err != nil {
+		t.Fatal(err)
+	}
+	b := newReportBuffers(db, ReportOptions{BufferMaxRows: 1, TypePolicies: policies}, nil)
+	defer b.Close()
+	report := func(table, body string) error {
+		row, err := b.Parse(table, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Add(context.Background(), table, row, body, true)
+	}
+	columns := func(table string) string {
+		var names string
+		if err := db.QueryRow("SELECT string_agg(column_name || ' ' || data_type, ',' ORDER BY column_index) FROM duckdb_columns() WHERE table_name = ?", table).Scan(&names); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+
+	for _, body := range []string{
+		`{"flag":true,"n":1,"time":1727654400028,"at":"2024-09-30T00:00:00+08:00","s":"x"}`,
+		`{"flag":2,"n":1.5}`,
+		`{"n":"many","time":"soon"}`,
+	} {
+		if err = report("events", body); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+	}
+	if got := columns("events"); got != "at TIMESTAMP WITH TIME ZONE,flag BIGINT,n VARCHAR,s VARCHAR,time VARCHAR" {
+		t.Errorf("unexpected columns %s", got)
+	}
+	var values string
+	if err = db.QueryRow("SELECT string_agg(concat_ws('|', flag, n, time), ',' ORDER BY rowid) FROM events").Scan(&values); err != nil {
+		t.Fatal(err)
+	}
+	if values != "1|1.0|2024-09-30 00:00:00.028+00,2|1.5,many|soon" {
+		t.Errorf("unexpected values %s", values)
+	}
+
+	if err = report("pinned", `{"amount":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = report("pinned", `{"amount":"x"}`); err == nil {
+		t.Error("expected pinned column to reject strings")
+	}
+	if err = report("fixed", `{"n":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = report("fixed", `{"n":"x"}`); err == nil {
+		t.Error("expected no_widen table to reject strings")
+	}
+	if got := columns("pinned") + ";" + columns("fixed"); got != "amount DECIMAL(18,2);n BIGINT" {
+		t.Errorf("unexpected columns %s", got)
+	}
+}
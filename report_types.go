@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /report 列类型的格：BOOLEAN → BIGINT → DOUBLE → VARCHAR，TIMESTAMPTZ 只能放宽为 VARCHAR。
+// 类型不同的值合并为两者中较宽的类型，已有的列通过 ALTER COLUMN ... TYPE 放宽。
+// LIST 按元素类型合并，STRUCT 合并所有字段，和标量合并时为 VARCHAR
+var reportTypeRanks = map[string]int{
+	"BOOLEAN":  0,
+	"TINYINT":  1,
+	"SMALLINT": 1,
+	"INTEGER":  1,
+	"BIGINT":   1,
+	"FLOAT":    2,
+	"DOUBLE":   2,
+	"VARCHAR":  3,
+}
+
+var reportRankTypes = []string{"BOOLEAN", "BIGINT", "DOUBLE", "VARCHAR"}
+
+var reportTypeAliases = map[string]string{
+	"TIMESTAMP WITH TIME ZONE": "TIMESTAMPTZ",
+	"INT8":                     "BIGINT",
+	"LONG":                     "BIGINT",
+	"INT":                      "INTEGER",
+	"INT4":                     "INTEGER",
+	"FLOAT8":                   "DOUBLE",
+	"DOUBLE PRECISION":         "DOUBLE",
+	"TEXT":                     "VARCHAR",
+	"STRING":                   "VARCHAR",
+	"BOOL":                     "BOOLEAN",
+}
+
+// reportTimeKeyRegexp 13 位毫秒时间戳只在名字像时间的字段上识别，例如 GaliPaiDC 的 time
+var reportTimeKeyRegexp = regexp.MustCompile(`(?i)(time|timestamp|datetime)$|(^|_)(ts|at)$`)
+
+var reportTimeRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}`)
+
+var reportTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// reportType 解析后的列类型，Name 为 STRUCT、LIST、NULL（类型不确定）或者标量类型名
+type reportType struct {
+	Name   string
+	Elem   *reportType
+	Fields []reportField
+}
+
+type reportField struct {
+	Name string
+	Type *reportType
+}
+
+var reportNullType = &reportType{Name: "NULL"}
+
+func (t *reportType) String() string {
+	switch t.Name {
+	case "LIST":
+		return t.Elem.String() + "[]"
+	case "STRUCT":
+		fields := make([]string, len(t.Fields))
+		for i, f := range t.Fields {
+			fields[i] = quoteIdentifier(f.Name) + " " + f.Type.String()
+		}
+		return "STRUCT(" + strings.Join(fields, ", ") + ")"
+	}
+	return t.Name
+}
+
+// field STRUCT 的字段，duckdb 的字段名不区分大小写
+func (t *reportType) field(name string) *reportField {
+	for i := range t.Fields {
+		if strings.EqualFold(t.Fields[i].Name, name) {
+			return &t.Fields[i]
+		}
+	}
+	return nil
+}
+
+func (t *reportType) nested() bool {
+	return t.Name == "LIST" || t.Name == "STRUCT"
+}
+
+func (t *reportType) hasStruct() bool {
+	switch t.Name {
+	case "LIST":
+		return t.Elem.hasStruct()
+	case "STRUCT":
+		return true
+	}
+	return false
+}
+
+// inLattice 格中的类型可以放宽，其他类型（例如手工建表的 DECIMAL）保持不变
+func (t *reportType) inLattice() bool {
+	_, ok := reportTypeRanks[t.Name]
+	return ok || t.Name == "TIMESTAMPTZ" || t.Name == "TIMESTAMP" || t.nested()
+}
+
+// parseReportType 解析 information_schema.columns 的 data_type，例如 STRUCT(a BIGINT, "b c" VARCHAR[])[]
+func parseReportType(s string) *reportType {
+	p := &reportTypeParser{s: s}
+	return p.parse()
+}
+
+// reportScalarTypeRegexp 格之外可以在配置中指定的标量类型
+var reportScalarTypeRegexp = regexp.MustCompile(`(?i)^(DATE|TIME|UUID|BLOB|INTERVAL|HUGEINT|UTINYINT|USMALLINT|UINTEGER|UBIGINT|(DECIMAL|NUMERIC)(\(\d+(, ?\d+)?\))?)$`)
+
+// checkReportType 检查 type_overrides 和 -report_pin_type 中的类型，返回规范形式。
+// 类型会拼接到 CREATE TABLE 和 ALTER COLUMN 中，不认识的类型或者多余的内容都返回错误
+func checkReportType(s string) (string, error) {
+	p := &reportTypeParser{s: strings.TrimSpace(s)}
+	t := p.parse()
+	if p.pos != len(p.s) || !t.valid() {
+		return "", fmt.Errorf("unknown type %q", s)
+	}
+	return t.String(), nil
+}
+
+func (t *reportType) valid() bool {
+	switch t.Name {
+	case "LIST":
+		return t.Elem.valid()
+	case "STRUCT":
+		for _, f := range t.Fields {
+			if f.Name == "" || !f.Type.valid() {
+				return false
+			}
+		}
+		return len(t.Fields) > 0
+	case "NULL":
+		return false
+	}
+	return t.inLattice() || reportScalarTypeRegexp.MatchString(t.Name)
+}
+
+type reportTypeParser struct {
+	s   string
+	pos int
+}
+
+func (p *reportTypeParser) parse() *reportType {
+	p.skipSpaces()
+	var t *reportType
+	if len(p.s)-p.pos >= 7 && strings.EqualFold(p.s[p.pos:p.pos+7], "STRUCT(") {
+		p.pos += 7
+		t = &reportType{Name: "STRUCT"}
+		for p.skipSpaces(); p.pos < len(p.s) && p.s[p.pos] != ')'; p.skipSpaces() {
+			name := p.ident()
+			t.Fields = append(t.Fields, reportField{Name: name, Type: p.parse()})
+			p.skipSpaces()
+			if p.pos < len(p.s) && p.s[p.pos] == ',' {
+				p.pos++
+			}
+		}
+		p.pos++
+	} else {
+		start, depth := p.pos, 0
+	scan:
+		for ; p.pos < len(p.s); p.pos++ {
+			switch p.s[p.pos] {
+			case '(':
+				depth++
+			case ')':
+				if depth == 0 {
+					break scan
+				}
+				depth--
+			case ',':
+				if depth == 0 {
+					break scan
+				}
+			case '[':
+				if depth == 0 && strings.HasPrefix(p.s[p.pos:], "[]") {
+					break scan
+				}
+			case '\'':
+				// ENUM('a', 'b') 的字符串
+				for p.pos++; p.pos < len(p.s) && (p.s[p.pos] != '\'' || strings.HasPrefix(p.s[p.pos:], "''")); p.pos++ {
+					if p.s[p.pos] == '\'' {
+						p.pos++
+					}
+				}
+			}
+		}
+		t = &reportType{Name: normalizeReportScalar(p.s[start:min(p.pos, len(p.s))])}
+	}
+	for strings.HasPrefix(p.s[min(p.pos, len(p.s)):], "[]") {
+		p.pos += 2
+		t = &reportType{Name: "LIST", Elem: t}
+	}
+	return t
+}
+
+func (p *reportTypeParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// ident 字段名，可能带双引号
+func (p *reportTypeParser) ident() string {
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		var sb strings.Builder
+		for p.pos++; p.pos < len(p.s); p.pos++ {
+			if p.s[p.pos] == '"' {
+				if !strings.HasPrefix(p.s[p.pos:], `""`) {
+					p.pos++
+					break
+				}
+				p.pos++
+			}
+			sb.WriteByte(p.s[p.pos])
+		}
+		return sb.String()
+	}
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ' ' {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// normalizeReportScalar 标量类型名转换为格中的类型名，其他类型原样保留
+func normalizeReportScalar(name string) string {
+	name = strings.TrimSpace(name)
+	upper := strings.ToUpper(name)
+	if alias, ok := reportTypeAliases[upper]; ok {
+		return alias
+	}
+	if _, ok := reportTypeRanks[upper]; ok || upper == "TIMESTAMPTZ" || upper == "TIMESTAMP" || upper == "NULL" {
+		return upper
+	}
+	return name
+}
+
+// normalizeReportType 类型的规范形式，用来比较 information_schema.columns 和生成的类型
+func normalizeReportType(typ string) string {
+	return parseReportType(typ).String()
+}
+
+// widenReportType 两个类型的上确界，当前类型不在格中时不放宽
+func widenReportType(current, incoming string) string {
+	return joinReportTypes(parseReportType(current), parseReportType(incoming)).String()
+}
+
+func joinReportTypes(current, incoming *reportType) *reportType {
+	switch {
+	case current.Name == "NULL":
+		return incoming
+	case incoming.Name == "NULL" || !current.inLattice():
+		return current
+	case current.Name == "LIST" && incoming.Name == "LIST":
+		return &reportType{Name: "LIST", Elem: joinReportTypes(current.Elem, incoming.Elem)}
+	case current.Name == "STRUCT" && incoming.Name == "STRUCT":
+		t := &reportType{Name: "STRUCT", Fields: make([]reportField, 0, len(current.Fields))}
+		for _, f := range current.Fields {
+			if other := incoming.field(f.Name); other != nil {
+				f = reportField{Name: f.Name, Type: joinReportTypes(f.Type, other.Type)}
+			}
+			t.Fields = append(t.Fields, f)
+		}
+		for _, f := range incoming.Fields {
+			if current.field(f.Name) == nil {
+				t.Fields = append(t.Fields, f)
+			}
+		}
+		return t
+	case current.nested() || incoming.nested():
+		return &reportType{Name: "VARCHAR"}
+	}
+	return &reportType{Name: widenReportScalar(current.Name, incoming.Name)}
+}
+
+func widenReportScalar(current, incoming string) string {
+	currentTime := current == "TIMESTAMPTZ" || current == "TIMESTAMP"
+	if current == incoming {
+		return current
+	}
+	if incoming == "TIMESTAMPTZ" || incoming == "TIMESTAMP" {
+		if currentTime || current == "VARCHAR" {
+			return current
+		}
+		return "VARCHAR"
+	}
+	incomingRank, ok := reportTypeRanks[incoming]
+	if !ok {
+		return current
+	}
+	if currentTime {
+		return "VARCHAR"
+	}
+	if incomingRank <= reportTypeRanks[current] {
+		return current
+	}
+	return reportRankTypes[incomingRank]
+}
+
+// reportValueType 事件中一个值的类型，NULL 表示不确定类型
+func reportValueType(name string, value any) *reportType {
+	switch v := value.(type) {
+	case bool:
+		return &reportType{Name: "BOOLEAN"}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			if n >= 1e12 && n < 1e13 && reportTimeKeyRegexp.MatchString(name) {
+				return &reportType{Name: "TIMESTAMPTZ"}
+			}
+			return &reportType{Name: "BIGINT"}
+		}
+		return &reportType{Name: "DOUBLE"}
+	case float64:
+		return &reportType{Name: "DOUBLE"}
+	case time.Time:
+		return &reportType{Name: "TIMESTAMPTZ"}
+	case string:
+		if _, ok := parseReportTime(v); ok {
+			return &reportType{Name: "TIMESTAMPTZ"}
+		}
+		return &reportType{Name: "VARCHAR"}
+	case []any:
+		elem := reportNullType
+		for _, e := range v {
+			elem = joinReportTypes(elem, reportValueType("", e))
+		}
+		if elem.Name == "NULL" {
+			return reportNullType
+		}
+		return &reportType{Name: "LIST", Elem: elem}
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t := &reportType{Name: "STRUCT"}
+		for _, name := range names {
+			if typ := reportValueType(name, v[name]); typ.Name != "NULL" {
+				t.Fields = append(t.Fields, reportField{Name: name, Type: typ})
+			}
+		}
+		if len(t.Fields) == 0 {
+			return reportNullType
+		}
+		return t
+	}
+	return reportNullType
+}
+
+func parseReportTime(s string) (time.Time, bool) {
+	if !reportTimeRegexp.MatchString(s) {
+		return time.Time{}, false
+	}
+	for _, layout := range reportTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// reportStageValue 把值转换为临时表的列类型，Appender 要求值的类型和列完全一致。
+// STRUCT 使用 map[string]any 并且包含所有字段，LIST 使用 []any
+func reportStageValue(value any, typ *reportType) any {
+	switch typ.Name {
+	case "STRUCT":
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		out := make(map[string]any, len(typ.Fields))
+		for _, f := range typ.Fields {
+			v, ok := m[f.Name]
+			if !ok {
+				for name, fv := range m {
+					if strings.EqualFold(name, f.Name) {
+						v = fv
+						break
+					}
+				}
+			}
+			out[f.Name] = reportStageValue(v, f.Type)
+		}
+		return out
+	case "LIST":
+		l, ok := value.([]any)
+		if !ok {
+			return nil
+		}
+		out := make([]any, len(l))
+		for i, e := range l {
+			out[i] = reportStageValue(e, typ.Elem)
+		}
+		return out
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case map[string]any, []any:
+		return reportJSONText(v)
+	case bool:
+		switch typ.Name {
+		case "BIGINT":
+			if v {
+				return int64(1)
+			}
+			return int64(0)
+		case "DOUBLE":
+			if v {
+				return float64(1)
+			}
+			return float64(0)
+		case "VARCHAR":
+			return strconv.FormatBool(v)
+		}
+		return v
+	case json.Number:
+		switch typ.Name {
+		case "BIGINT":
+			n, _ := v.Int64()
+			return n
+		case "DOUBLE":
+			f, _ := v.Float64()
+			return f
+		case "TIMESTAMPTZ":
+			n, _ := v.Int64()
+			return time.UnixMilli(n).UTC()
+		}
+		return v.String()
+	case float64:
+		if typ.Name == "VARCHAR" {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return v
+	case string:
+		if typ.Name == "TIMESTAMPTZ" {
+			t, _ := parseReportTime(v)
+			return t
+		}
+		return v
+	case time.Time:
+		if typ.Name == "VARCHAR" {
+			return v.UTC().Format(time.RFC3339Nano)
+		}
+		return v.UTC()
+	}
+	return fmt.Sprint(value)
+}
+
+// 嵌套对象的映射方式
+const (
+	reportNestedFlatten = "flatten"
+	reportNestedStruct  = "struct"
+	reportNestedJSON    = "json"
+)
+
+// ReportTypePolicy 一个表的类型策略：Pinned 中的列（小写列名）始终使用指定的类型，
+// NoWiden 时已有的列不放宽类型，类型冲突的事件写入失败。
+// Nested 为嵌套对象的映射方式：flatten（默认）展开为 prefix_key 列，struct 为 STRUCT 列，json 为 JSON 文本列。
+// NoDDL 时不建表、不加列也不修改列类型，需要 DDL 的事件写入失败
+type ReportTypePolicy struct {
+	Pinned  map[string]string
+	NoWiden bool
+	Nested  string
+	NoDDL   bool
+}
+
+// ReportTypePolicies 按小写表名索引的类型策略
+type ReportTypePolicies map[string]*ReportTypePolicy
+
+func (p ReportTypePolicies) table(name string) *ReportTypePolicy {
+	name = strings.ToLower(name)
+	policy, ok := p[name]
+	if !ok {
+		policy = &ReportTypePolicy{Pinned: map[string]string{}}
+		p[name] = policy
+	}
+	return policy
+}
+
+// Pin 解析 table.column=TYPE，用于 -report_pin_type
+func (p ReportTypePolicies) Pin(spec string) error {
+	column, typ, ok := strings.Cut(spec, "=")
+	table, column, ok2 := strings.Cut(column, ".")
+	typ = strings.TrimSpace(typ)
+	if !ok || !ok2 || table == "" || column == "" || typ == "" {
+		return fmt.Errorf("expected table.column=TYPE, got %q", spec)
+	}
+	typ, err := checkReportType(typ)
+	if err != nil {
+		return err
+	}
+	p.table(strings.TrimSpace(table)).Pinned[strings.ToLower(strings.TrimSpace(column))] = typ
+	return nil
+}
+
+// ForbidWidening 用于 -report_no_widen
+func (p ReportTypePolicies) ForbidWidening(table string) error {
+	if table = strings.TrimSpace(table); table == "" {
+		return fmt.Errorf("table name is empty")
+	}
+	p.table(table).NoWiden = true
+	return nil
+}
+
+// SetNested 解析 table=flatten|struct|json，用于 -report_nested
+func (p ReportTypePolicies) SetNested(spec string) error {
+	table, mode, ok := strings.Cut(spec, "=")
+	table, mode = strings.TrimSpace(table), strings.ToLower(strings.TrimSpace(mode))
+	if !ok || table == "" {
+		return fmt.Errorf("expected table=flatten|struct|json, got %q", spec)
+	}
+	switch mode {
+	case reportNestedFlatten, reportNestedStruct, reportNestedJSON:
+		p.table(table).Nested = mode
+		return nil
+	}
+	return fmt.Errorf("unknown nested mode %q, expected flatten, struct or json", mode)
+}
+
+func (p ReportTypePolicies) get(table string) *ReportTypePolicy {
+	if policy, ok := p[strings.ToLower(table)]; ok {
+		return policy
+	}
+	return &ReportTypePolicy{}
+}
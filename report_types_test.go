@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestWidenReportType(t *testing.T) {
+	for _, c := range [][3]string{
+		{"BOOLEAN", "BIGINT", "BIGINT"},
+		{"INTEGER", "DOUBLE", "DOUBLE"},
+		{"DOUBLE", "BIGINT", "DOUBLE"},
+		{"BIGINT", "TIMESTAMPTZ", "VARCHAR"},
+		{"TIMESTAMP WITH TIME ZONE", "TIMESTAMPTZ", "TIMESTAMPTZ"},
+		{"TIMESTAMP WITH TIME ZONE", "BOOLEAN", "VARCHAR"},
+		{"DECIMAL(18,2)", "VARCHAR", "DECIMAL(18,2)"},
+		{"ENUM('a, b', 'c''d')", "VARCHAR", "ENUM('a, b', 'c''d')"},
+		{"BIGINT[]", "DOUBLE[]", "DOUBLE[]"},
+		{"BIGINT[]", "BIGINT", "VARCHAR"},
+		{`STRUCT(a BIGINT, "b c" STRUCT(x VARCHAR[]))`, `STRUCT("b c" STRUCT(y BOOLEAN), a DOUBLE)`, `STRUCT("a" DOUBLE, "b c" STRUCT("x" VARCHAR[], "y" BOOLEAN))`},
+		{`STRUCT(a BIGINT)[]`, `STRUCT(b BIGINT)[]`, `STRUCT("a" BIGINT, "b" BIGINT)[]`},
+		{`STRUCT(a BIGINT)`, "VARCHAR", "VARCHAR"},
+	} {
+		if got := widenReportType(c[0], c[1]); got != c[2] {
+			t.Errorf("widen %s %s: got %s, want %s", c[0], c[1], got, c[2])
+		}
+	}
+	if got := reportAlterColumnSql(reportTarget{Table: "t"}, "c", `STRUCT(a BIGINT)[]`, `STRUCT("a" BIGINT, "b" BIGINT)[]`); got != `ALTER TABLE "t" ALTER COLUMN "c" TYPE STRUCT("a" BIGINT, "b" BIGINT)[] USING list_transform("c", x1 -> struct_pack("a" := struct_extract(x1, 'a'), "b" := NULL::BIGINT))` {
+		t.Errorf("unexpected alter %s", got)
+	}
+}
+
+func TestCheckReportType(t *testing.T) {
+	for in, want := range map[string]string{
+		"bigint":                         "BIGINT",
+		" TEXT ":                         "VARCHAR",
+		"TIMESTAMP WITH TIME ZONE":       "TIMESTAMPTZ",
+		"DECIMAL(18,2)":                  "DECIMAL(18,2)",
+		"date":                           "date",
+		"BIGINT[]":                       "BIGINT[]",
+		`STRUCT(a BIGINT, "b c" DATE[])`: `STRUCT("a" BIGINT, "b c" DATE[])`,
+	} {
+		if got, err := checkReportType(in); err != nil || got != want {
+			t.Errorf("check %q: got %q %v, want %q", in, got, err, want)
+		}
+	}
+	// 会拼接到 DDL 中，多余的内容和不认识的类型都拒绝
+	for _, in := range []string{
+		"",
+		"NULL",
+		"VARCHAR DEFAULT 'x'",
+		"VARCHAR); DROP TABLE t; --",
+		"BIGINT, evil VARCHAR",
+		"DECIMAL(18,2) CHECK (false)",
+		"ENUM('a')",
+		"STRUCT(a BIGINT",
+		"STRUCT()",
+		"STRUCT(a nosuch)",
+		"nosuch",
+		"BIGINT[",
+	} {
+		if got, err := checkReportType(in); err == nil {
+			t.Errorf("check %q: expected an error, got %q", in, got)
+		}
+	}
+}
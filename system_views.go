@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relationColumn 由 registry 生成的关系的列
+type relationColumn struct {
+	name string
+	typ  string
+}
+
+var processesColumns = []relationColumn{
+	{"query_id", "VARCHAR"}, {"user", "VARCHAR"}, {"address", "VARCHAR"}, {"protocol", "VARCHAR"},
+	{"query", "VARCHAR"}, {"query_start_time", "TIMESTAMPTZ"}, {"elapsed", "DOUBLE"},
+	{"read_rows", "UBIGINT"}, {"written_rows", "UBIGINT"}, {"result_rows", "UBIGINT"},
+	{"state", "VARCHAR"}, {"pid", "INTEGER"},
+}
+
+var pgStatActivityColumns = []relationColumn{
+	{"datname", "VARCHAR"}, {"pid", "INTEGER"}, {"usename", "VARCHAR"}, {"application_name", "VARCHAR"},
+	{"client_addr", "VARCHAR"}, {"client_port", "INTEGER"}, {"backend_start", "TIMESTAMPTZ"},
+	{"query_start", "TIMESTAMPTZ"}, {"state_change", "TIMESTAMPTZ"}, {"state", "VARCHAR"},
+	{"query_id", "VARCHAR"}, {"query", "VARCHAR"}, {"backend_type", "VARCHAR"},
+}
+
+// renderRelation 把行渲染为 SQL 子查询，没有行时只保留列名和类型，也用来创建空的视图
+func renderRelation(columns []relationColumn, rows [][]any) string {
+	var sb strings.Builder
+	if len(rows) == 0 {
+		sb.WriteString("SELECT ")
+		for i, col := range columns {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			fmt.Fprintf(&sb, `NULL::%s AS "%s"`, col.typ, col.name)
+		}
+		sb.WriteString(" LIMIT 0")
+		return sb.String()
+	}
+	sb.WriteString("SELECT * FROM (VALUES ")
+	for i, row := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for j, v := range row {
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(sqlLiteral(v))
+			sb.WriteString("::" + columns[j].typ)
+		}
+		sb.WriteByte(')')
+	}
+	sb.WriteString(") AS t(")
+	for i, col := range columns {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, `"%s"`, col.name)
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
+
+func sqlLiteral(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return quoteSqlString(v)
+	case time.Time:
+		if v.IsZero() {
+			return "NULL"
+		}
+		return quoteSqlString(v.Format(time.RFC3339Nano))
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// processesRelation clickhouse 的 system.processes，包括两种协议正在执行的查询
+func (r *queryRegistry) processesRelation() string {
+	var rows [][]any
+	for _, q := range r.List() {
+		rows = append(rows, []any{q.ID, q.User, q.Address, q.Protocol, q.Query, q.Start, time.Since(q.Start).Seconds(),
+			q.Progress.ReadRows(), q.Progress.WrittenRows(), q.Progress.ResultRows(), q.State(), q.PID})
+	}
+	return renderRelation(processesColumns, rows)
+}
+
+// pgStatActivityRelation postgresql 的 pg_stat_activity，包括所有 postgresql 连接和正在执行的 http 请求
+func (r *queryRegistry) pgStatActivityRelation() string {
+	var rows [][]any
+	for _, b := range r.Backends() {
+		host, port := splitClientAddr(b.Address)
+		state := "idle"
+		if b.active {
+			state = "active"
+		}
+		rows = append(rows, []any{b.Database, b.PID, b.User, b.ApplicationName, host, port, b.Start,
+			b.queryStart, b.stateChange, state, b.queryID, b.query, "client backend"})
+	}
+	for _, q := range r.List() {
+		if q.Protocol == "postgresql" {
+			continue
+		}
+		host, port := splitClientAddr(q.Address)
+		rows = append(rows, []any{nil, q.PID, q.User, q.Protocol, host, port, q.Start,
+			q.Start, q.Start, "active", q.ID, q.Query, q.Protocol})
+	}
+	return renderRelation(pgStatActivityColumns, rows)
+}
+
+func splitClientAddr(addr string) (any, any) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if addr == "" {
+			return nil, nil
+		}
+		return addr, nil
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return host, nil
+	}
+	return host, p
+}
+
+// systemViewNames 查询时替换为快照的视图，数据库中的同名视图没有行，只用于查看表结构
+var systemViewNames = []struct {
+	name  string
+	alias string
+}{
+	{"system.processes", "processes"},
+	{"pg_catalog.pg_stat_activity", "pg_stat_activity"},
+	{"main.pg_stat_activity", "pg_stat_activity"},
+	{"pg_stat_activity", "pg_stat_activity"},
+}
+
+// tableClauseKeywords 表名后面可以直接跟的关键字，其他标识符是表的别名
+var tableClauseKeywords = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true, "CROSS": true,
+	"NATURAL": true, "POSITIONAL": true, "ASOF": true, "ANTI": true, "SEMI": true, "ON": true, "USING": true,
+	"GROUP": true, "ORDER": true, "LIMIT": true, "OFFSET": true, "HAVING": true, "WINDOW": true, "QUALIFY": true,
+	"UNION": true, "EXCEPT": true, "INTERSECT": true, "FORMAT": true, "SETTINGS": true, "SAMPLE": true,
+	"TABLESAMPLE": true,
+}
+
+var nextWordRegexp = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)`)
+var describeQueryRegexp = regexp.MustCompile(`(?i)^\s*(DESCRIBE|DESC|SHOW)\b`)
+
+// expandSystemViews 把查询中的 system.processes 和 pg_stat_activity 替换为当前的快照，
+// 字符串、带引号的标识符和注释中的不处理。没有别名时加上视图名作为别名。
+// DESCRIBE 和 SHOW 查看的是视图本身，不替换
+func (r *queryRegistry) expandSystemViews(query string) string {
+	if describeQueryRegexp.MatchString(query) {
+		return query
+	}
+	var sb strings.Builder
+	relations := map[string]string{}
+	last := 0
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			i = skipQuoted(query, i)
+			continue
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(query)
+			}
+			continue
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(query)
+			}
+			continue
+		case i > 0 && (isIdentByte(query[i-1]) || query[i-1] == '.'):
+			i++
+			continue
+		}
+		matched := false
+		for _, view := range systemViewNames {
+			end := i + len(view.name)
+			if end > len(query) || !strings.EqualFold(query[i:end], view.name) || (end < len(query) && isIdentByte(query[end])) {
+				continue
+			}
+			relation, ok := relations[view.alias]
+			if !ok {
+				if view.alias == "processes" {
+					relation = r.processesRelation()
+				} else {
+					relation = r.pgStatActivityRelation()
+				}
+				relations[view.alias] = relation
+			}
+			sb.WriteString(query[last:i])
+			sb.WriteString("(" + relation + ")")
+			if m := nextWordRegexp.FindStringSubmatch(query[end:]); m == nil || tableClauseKeywords[strings.ToUpper(m[1])] {
+				sb.WriteString(" AS " + view.alias)
+			}
+			i, last, matched = end, end, true
+			break
+		}
+		if !matched {
+			i++
+		}
+	}
+	if sb.Len() == 0 {
+		return query
+	}
+	sb.WriteString(query[last:])
+	return sb.String()
+}
+
+func isIdentByte(ch byte) bool {
+	return ch == '_' || ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+var backendSignalRegexp = regexp.MustCompile(`(?is)^\s*SELECT\s+(pg_cancel_backend|pg_terminate_backend)\s*\(`)
+var backendSignalRestRegexp = regexp.MustCompile(`(?i)^(FROM|WHERE)\b`)
+
+// parseBackendSignal 识别 SELECT pg_cancel_backend(expr) [FROM ...]，返回函数名和计算 pid 的查询 SELECT expr [FROM ...]
+func parseBackendSignal(query string) (string, string, bool) {
+	m := backendSignalRegexp.FindStringSubmatchIndex(query)
+	if m == nil {
+		return "", "", false
+	}
+	depth := 1
+	i := m[1]
+	for i < len(query) && depth > 0 {
+		switch query[i] {
+		case '\'', '"':
+			i = skipQuoted(query, i)
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		i++
+	}
+	if depth > 0 {
+		return "", "", false
+	}
+	expr := query[m[1] : i-1]
+	rest := strings.TrimRight(strings.TrimSpace(query[i:]), ";")
+	if rest != "" && !backendSignalRestRegexp.MatchString(rest) {
+		return "", "", false
+	}
+	return strings.ToLower(query[m[2]:m[3]]), strings.TrimSpace("SELECT " + expr + " " + rest), true
+}
+
+// signalBackends 计算 pid 并逐个取消或终止，返回每个 pid 是否存在
+func (r *queryRegistry) signalBackends(ctx context.Context, db *sql.DB, name, query string) ([]bool, error) {
+	rows, err := db.QueryContext(ctx, r.expandSystemViews(query))
+	if err != nil {
+		return nil, err
+	}
+	var pids []sql.NullInt64
+	for rows.Next() {
+		var pid sql.NullInt64
+		if err = rows.Scan(&pid); err != nil {
+			break
+		}
+		pids = append(pids, pid)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]bool, len(pids))
+	for i, pid := range pids {
+		switch {
+		case !pid.Valid:
+		case name == "pg_terminate_backend":
+			results[i] = r.TerminatePID(int32(pid.Int64))
+		default:
+			results[i] = r.CancelPID(int32(pid.Int64))
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+func TestSystemViews(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	r := newQueryRegistry()
+	terminated := false
+	key := [8]byte{0, 0, 0, 42}
+	r.Connect(&pgBackend{PID: 42, Key: key, User: "pg", Address: "10.0.0.1:5000", Terminate: func() { terminated = true }})
+	defer r.Disconnect(key)
+	_, finish, err := r.Begin(context.Background(), &runningQuery{ID: "h1", User: "ch", Protocol: "http", Query: "SELECT 'x'", Address: "10.0.0.2:6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finish()
+
+	var n int
+	var states string
+	query := r.expandSystemViews(`SELECT count(*), string_agg(state || ':' || backend_type, ',' ORDER BY pid DESC) FROM pg_catalog.pg_stat_activity`)
+	if err = db.QueryRow(query).Scan(&n, &states); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || states != "idle:client backend,active:http" {
+		t.Errorf("unexpected pg_stat_activity: %d %s", n, states)
+	}
+	var id, address string
+	query = r.expandSystemViews(`SELECT p.query_id, address FROM system.processes p WHERE "user" = 'ch' -- system.processes`)
+	if err = db.QueryRow(query).Scan(&id, &address); err != nil {
+		t.Fatal(err)
+	}
+	if id != "h1" || address != "10.0.0.2:6000" {
+		t.Errorf("unexpected system.processes row: %s %s", id, address)
+	}
+	if query = `SELECT 'system.processes' FROM "pg_stat_activity"`; r.expandSystemViews(query) != query {
+		t.Errorf("expected quoted names to be kept: %s", r.expandSystemViews(query))
+	}
+
+	name, pidQuery, ok := parseBackendSignal(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = 'pg';`)
+	if !ok || name != "pg_terminate_backend" || pidQuery != `SELECT pid FROM pg_stat_activity WHERE usename = 'pg'` {
+		t.Fatalf("unexpected parse: %s %s %v", name, pidQuery, ok)
+	}
+	results, err := r.signalBackends(context.Background(), db, name, pidQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0] || !terminated {
+		t.Errorf("expected backend 42 to be terminated: %v %v", results, terminated)
+	}
+	if _, _, ok = parseBackendSignal(`SELECT pg_cancel_backend(1) + 1`); ok {
+		t.Error("expected expression around pg_cancel_backend to be left to the database")
+	}
+}